@@ -0,0 +1,128 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+var ErrReservedKey = errors.New("key is reserved")
+
+// WriteBatch 批量写入 要么全部生效 要么全部不生效
+type WriteBatch struct {
+	ops []batchOp
+}
+type batchOp struct {
+	typ   wal.RecordType
+	key   []byte
+	value []byte
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put 添加写入操作 数据会被拷贝
+func (b *WriteBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		typ:   wal.RecordPut,
+		key:   bytes.Clone(key),
+		value: bytes.Clone(value),
+	})
+}
+
+// Delete 添加删除操作
+func (b *WriteBatch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{typ: wal.RecordDelete, key: bytes.Clone(key)})
+}
+
+// Len 批次中的操作数量
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset 清空批次 便于复用
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write 原子地写入一个批次
+// 所有记录携带同一个 seq 最后写入提交记录 回放时没有提交记录的批次会被丢弃
+func (db *Db) Write(batch *WriteBatch) error {
+	return db.WriteWithOptions(batch, nil)
+}
+
+// WriteWithOptions 写入一个批次 wo.Sync 为 true 时等待落盘之后再返回
+func (db *Db) WriteWithOptions(batch *WriteBatch, wo *WriteOptions) error {
+	return db.write(defaultBucket, batch, wo)
+}
+
+// 检查批次中的 key 之后写入 bucket
+func (db *Db) write(bucket uint32, batch *WriteBatch, wo *WriteOptions) error {
+	if batch == nil || batch.Len() == 0 {
+		return nil
+	}
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	for _, op := range batch.ops {
+		if bytes.Equal(op.key, wal.BatchFinKey) {
+			return ErrReservedKey
+		}
+		if err := db.checkKey(op.key); err != nil {
+			return err
+		}
+	}
+	return db.update(wo, func() error {
+		return db.writeBatch(bucket, batch)
+	})
+}
+
+// 调用方需要持有写锁
+func (db *Db) writeBatch(bucket uint32, batch *WriteBatch) error {
+	table := db.table(bucket)
+	if table == nil {
+		return ErrBucketNotFound
+	}
+	// 一个批次只写在同一个文件中
+	if db.checkOverFlow() {
+		if err := db.newActiveFile(); err != nil {
+			return err
+		}
+	}
+	db.seq++
+	seq := db.seq
+
+	positions := make([]*wal.Pos, len(batch.ops))
+	for i, op := range batch.ops {
+		pos, err := db.activeFiles.WriteRecord(&wal.Record{Type: op.typ, Codec: db.opts.Compression.codec(op.value), Key: op.key, Value: op.value, Seq: seq, Bucket: bucket})
+		if err != nil {
+			return err
+		}
+		pos.Seq = seq
+		positions[i] = pos
+		db.unsynced.Add(int64(pos.Length))
+	}
+	fin, err := db.activeFiles.WriteRecord(&wal.Record{Type: wal.RecordBatchFin, Key: wal.BatchFinKey, Seq: seq})
+	if err != nil {
+		return err
+	}
+	db.unsynced.Add(int64(fin.Length))
+	for i, op := range batch.ops {
+		db.addHint(&wal.Record{Type: op.typ, Key: op.key, Bucket: bucket}, positions[i])
+	}
+
+	// 提交之后再更新内存
+	for i, op := range batch.ops {
+		if bucket == defaultBucket {
+			db.saveVersion(op.key, seq)
+		}
+		if op.typ == wal.RecordDelete {
+			table.Delete(op.key)
+		} else {
+			table.Put(op.key, positions[i])
+		}
+	}
+	return db.indexErr()
+}
@@ -0,0 +1,69 @@
+package bitcask
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xia-Sang/bitcask/utils"
+)
+
+// 读取封存的文件 对比直接读取和映射读取
+func BenchmarkDbGet(b *testing.B) {
+	const n = 10000
+	for _, mmap := range []bool{false, true} {
+		opts := NewOptions(b.TempDir(), WithMaxFileSize(64<<10))
+		opts.MmapSealed = mmap
+		db := openDb(b, opts)
+		value := utils.GenerateRandomBytes(128)
+		for i := range n {
+			if err := db.Put(utils.GenerateKey(i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprintf("mmap-%v", mmap), func(b *testing.B) {
+			b.ReportAllocs()
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < b.N; i++ {
+				if _, ok := get(b, db, utils.GenerateKey(r.Intn(n))); !ok {
+					b.Fatal("missing key")
+				}
+			}
+		})
+		db.Close()
+	}
+}
+
+// 并发写入 对比不同的落盘策略 组提交让并发写入共享一次落盘
+func BenchmarkDbPutSync(b *testing.B) {
+	policies := []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{"never", SyncPolicy{Mode: SyncNever}},
+		{"bytes-64k", SyncPolicy{Mode: SyncBytes, Bytes: 64 << 10}},
+		{"interval-10ms", SyncPolicy{Mode: SyncInterval, Interval: 10 * time.Millisecond}},
+		{"always", SyncPolicy{Mode: SyncAlways}},
+	}
+	value := utils.GenerateRandomBytes(64)
+	for _, p := range policies {
+		for _, writers := range []int{1, 16} {
+			b.Run(fmt.Sprintf("%s/writers-%d", p.name, writers), func(b *testing.B) {
+				db := openDb(b, NewOptions(b.TempDir(), WithMaxFileSize(64<<20), WithSyncPolicy(p.policy)))
+				defer db.Close()
+				var seq atomic.Int64
+				b.SetParallelism(writers)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						if err := db.Put(utils.GenerateKey(int(seq.Add(1))), value); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/xia-Sang/bitcask/memtable"
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+const (
+	defaultBucket uint32 = 0
+	metaBucket    uint32 = math.MaxUint32 //保存 bucket 的名称和编号 写入时 key 为名称 value 为编号
+)
+
+var (
+	ErrBucketNotFound    = errors.New("bucket not found")
+	ErrBucketUnsupported = errors.New("buckets are not supported with persistent index")
+	errEmptyBucketName   = errors.New("bucket name must not be empty")
+)
+
+// Bucket 独立的命名空间 拥有自己的索引 和其他 bucket 共享数据文件
+// 默认的 bucket 就是 Db 本身 每条记录的头部记录了所属的 bucket 编号
+type Bucket struct {
+	db   *Db
+	name string
+	id   uint32
+}
+
+// Bucket 返回名称对应的 bucket 不存在时创建
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	if name == "" {
+		return nil, errEmptyBucketName
+	}
+	db.mu.RLock()
+	id, ok := db.bucketIds[name]
+	closed := db.closed
+	db.mu.RUnlock()
+	switch {
+	case closed:
+		return nil, ErrClosed
+	case ok:
+		return &Bucket{db: db, name: name, id: id}, nil
+	case db.opts.ReadOnly:
+		return nil, ErrReadOnly
+	}
+	// 持久化索引从检查点恢复时 其他 bucket 的索引无法重建
+	if _, ok := db.persistentIndex(); ok {
+		return nil, ErrBucketUnsupported
+	}
+	b := &Bucket{db: db, name: name}
+	err := db.update(nil, func() error {
+		// 等待写锁期间可能已经被创建
+		if id, ok := db.bucketIds[name]; ok {
+			b.id = id
+			return nil
+		}
+		if db.nextBucket == metaBucket {
+			return fmt.Errorf("too many buckets")
+		}
+		b.id = db.nextBucket
+		err := db.writeTo(metaBucket, &wal.Record{Type: wal.RecordPut, Key: []byte(name), Value: binary.AppendUvarint(nil, uint64(b.id))})
+		if err != nil {
+			return err
+		}
+		db.nextBucket++
+		db.buckets[b.id] = db.newTable()
+		db.bucketIds[name] = b.id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// DropBucket 删除 bucket 只写入一条删除记录 数据在合并时回收
+func (db *Db) DropBucket(name string) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return db.update(nil, func() error {
+		id, ok := db.bucketIds[name]
+		if !ok {
+			return ErrBucketNotFound
+		}
+		if err := db.writeTo(metaBucket, &wal.Record{Type: wal.RecordDelete, Key: []byte(name)}); err != nil {
+			return err
+		}
+		delete(db.bucketIds, name)
+		delete(db.buckets, id)
+		delete(db.mergeFilters, id)
+		return nil
+	})
+}
+
+// Buckets 按照名称排序返回所有的 bucket 不包括默认的 bucket
+func (db *Db) Buckets() ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	names := make([]string, 0, len(db.bucketIds))
+	for name := range db.bucketIds {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// 编号对应的索引 已经删除的 bucket 返回 nil 调用方需要持有锁
+func (db *Db) table(id uint32) memtable.MemTable {
+	if id == defaultBucket {
+		return db.memTable
+	}
+	return db.buckets[id]
+}
+func (db *Db) lockedTable(id uint32) memtable.MemTable {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.table(id)
+}
+
+// 回放时按照记录中的编号找到索引 不存在时创建
+func (db *Db) replayTable(id uint32) memtable.MemTable {
+	table := db.table(id)
+	if table == nil {
+		table = db.newTable()
+		db.buckets[id] = table
+	}
+	return table
+}
+
+// 根据元数据恢复 bucket 的名称 丢弃回放时创建的已经删除的 bucket
+// 已经删除的 bucket 的数据在合并之前仍然在文件中 新的 bucket 不能复用它们的编号
+func (db *Db) loadBuckets() error {
+	meta := db.replayTable(metaBucket)
+	db.bucketIds = map[string]uint32{}
+	db.nextBucket = 1
+	for id := range db.buckets {
+		if id != metaBucket {
+			db.nextBucket = max(db.nextBucket, id+1)
+		}
+	}
+	live := map[uint32]bool{metaBucket: true}
+	for iter := meta.Iterator(); iter.Valid(); iter.Next() {
+		name, pos := iter.Curr()
+		val, err := db.getValueByPos(pos.(*wal.Pos))
+		if err != nil {
+			return err
+		}
+		id, n := binary.Uvarint(val)
+		if n <= 0 || id == uint64(defaultBucket) || id >= uint64(metaBucket) {
+			return fmt.Errorf("%w: invalid id of bucket %q", ErrCorrupted, name)
+		}
+		db.bucketIds[string(name)] = uint32(id)
+		db.nextBucket = max(db.nextBucket, uint32(id)+1)
+		live[uint32(id)] = true
+	}
+	for id := range db.buckets {
+		if !live[id] {
+			delete(db.buckets, id)
+		}
+	}
+	// 新建的 bucket 回放之前就有索引
+	for _, id := range db.bucketIds {
+		if db.buckets[id] == nil {
+			db.buckets[id] = db.newTable()
+		}
+	}
+	return nil
+}
+
+// Name bucket 的名称
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Put 写入数据 bucket 已经删除时返回 ErrBucketNotFound
+func (b *Bucket) Put(key, value []byte) error {
+	db := b.db
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	return db.update(nil, func() error {
+		return db.writeTo(b.id, &wal.Record{Type: wal.RecordPut, Codec: db.opts.Compression.codec(value), Key: key, Value: value})
+	})
+}
+
+// Delete 删除数据
+func (b *Bucket) Delete(key []byte) error {
+	db := b.db
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	return db.update(nil, func() error {
+		return db.writeTo(b.id, &wal.Record{Type: wal.RecordDelete, Key: key})
+	})
+}
+
+// Write 原子地写入一个批次 所有操作都属于这个 bucket
+func (b *Bucket) Write(batch *WriteBatch) error {
+	return b.db.write(b.id, batch, nil)
+}
+
+// CompareAndSwap 和 Db.CompareAndSwap 相同 比较和写入都在这个 bucket 中
+func (b *Bucket) CompareAndSwap(key, expected, value []byte) error {
+	db := b.db
+	return db.writeIf(b.id, key, expected, func() error {
+		return db.writeTo(b.id, &wal.Record{Type: wal.RecordPut, Codec: db.opts.Compression.codec(value), Key: key, Value: value})
+	})
+}
+
+// Get 读取数据 不存在或者已经过期时返回 ErrKeyNotFound
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	db := b.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	table := db.table(b.id)
+	if table == nil {
+		return nil, ErrBucketNotFound
+	}
+	pos, ok := table.Get(key)
+	if !ok || pos.(*wal.Pos).Expired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return db.getValueByPos(pos.(*wal.Pos))
+}
+
+// TTL 返回剩余的存活时间 0表示永不过期 只查询索引 不读取 value
+func (b *Bucket) TTL(key []byte) (time.Duration, error) {
+	db := b.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	table := db.table(b.id)
+	if table == nil {
+		return 0, ErrBucketNotFound
+	}
+	now := time.Now().UnixNano()
+	pos, ok := table.Get(key)
+	if !ok || pos.(*wal.Pos).Expired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if pos.(*wal.Pos).ExpireAt == 0 {
+		return 0, nil
+	}
+	return time.Duration(pos.(*wal.Pos).ExpireAt - now), nil
+}
+
+// MergeFilter 合并时对 bucket 中仍然有效的 key 调用 返回 true 时丢弃这个 key
+// 调用时不持有数据库的锁 可以读取数据库 丢弃的 key 在合并完成之后从索引中删除
+type MergeFilter func(key []byte) bool
+
+// SetMergeFilter 设置合并时使用的过滤函数 为空时取消
+// 过滤函数只保存在内存中 重新打开之后需要重新设置
+func (b *Bucket) SetMergeFilter(fn MergeFilter) {
+	db := b.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.mergeFilters == nil {
+		db.mergeFilters = map[uint32]MergeFilter{}
+	}
+	if fn == nil {
+		delete(db.mergeFilters, b.id)
+	} else {
+		db.mergeFilters[b.id] = fn
+	}
+}
+
+// NewIterator 按照配置遍历 bucket 中的数据 只遍历这个 bucket 的索引
+func (b *Bucket) NewIterator(opts IteratorOptions) (*Iterator, error) {
+	db := b.db
+	table := db.lockedTable(b.id)
+	if table == nil {
+		return nil, ErrBucketNotFound
+	}
+	return newIterator(table.Iterator(), db.iteratorValue(b.id), time.Now().UnixNano(), opts), nil
+}
+
+// Fold 遍历 bucket 中没有过期的数据 fn 返回 false 时停止
+func (b *Bucket) Fold(fn func(key, value []byte) bool) error {
+	it, err := b.NewIterator(IteratorOptions{})
+	if err != nil {
+		return err
+	}
+	for ; it.Valid(); it.Next() {
+		val, err := it.Value()
+		// 遍历期间被删除的key直接跳过
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(it.Key(), val) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/xia-Sang/bitcask/memtable"
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+// ErrConditionFailed 条件写入时当前的值和期望的值不同
+var ErrConditionFailed = errors.New("condition failed")
+
+// CompareAndSwap 当前的值等于 expected 时写入 value 否则返回 ErrConditionFailed
+// expected 为 nil 表示 key 不存在 空的 value 和不存在的 key 不同
+// 新的值和 Put 一样没有过期时间
+func (db *Db) CompareAndSwap(key, expected, value []byte) error {
+	return db.CompareAndSwapWithTTL(key, expected, value, 0)
+}
+
+// CompareAndSwapWithTTL 和 CompareAndSwap 相同 新的值超过 ttl 之后自动过期 ttl 不大于 0 时不过期
+func (db *Db) CompareAndSwapWithTTL(key, expected, value []byte, ttl time.Duration) error {
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	return db.writeIf(defaultBucket, key, expected, func() error {
+		return db.putLocked(key, value, expireAt)
+	})
+}
+
+// PutIfAbsent key 不存在或者已经过期时写入 否则返回 ErrConditionFailed
+func (db *Db) PutIfAbsent(key, value []byte) error {
+	return db.CompareAndSwap(key, nil, value)
+}
+
+// DeleteIf 当前的值等于 expected 时删除 key 不存在时返回 ErrConditionFailed
+func (db *Db) DeleteIf(key, expected []byte) error {
+	if expected == nil {
+		return ErrConditionFailed
+	}
+	return db.writeIf(defaultBucket, key, expected, func() error {
+		return db.deleteLocked(key)
+	})
+}
+
+// 比较和写入在同一把写锁内 中间不会插入其他写入
+func (db *Db) writeIf(bucket uint32, key, expected []byte, fn func() error) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	return db.update(nil, func() error {
+		table := db.table(bucket)
+		if table == nil {
+			return ErrBucketNotFound
+		}
+		if err := db.compare(table, key, expected); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// 比较当前的值 调用方需要持有锁
+func (db *Db) compare(table memtable.MemTable, key, expected []byte) error {
+	pos, ok := table.Get(key)
+	if !ok || pos.(*wal.Pos).Expired(time.Now().UnixNano()) {
+		if expected == nil {
+			return nil
+		}
+		return ErrConditionFailed
+	}
+	if expected == nil {
+		return ErrConditionFailed
+	}
+	val, err := db.getValueByPos(pos.(*wal.Pos))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(val, expected) {
+		return ErrConditionFailed
+	}
+	return nil
+}
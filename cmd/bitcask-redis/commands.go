@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+// arity 为正数时参数个数必须相等 为负数时至少为它的绝对值 都包含命令名称
+type command struct {
+	arity int
+	fn    func(c *client, args [][]byte)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {-1, cmdPing},
+		"hello":   {-1, cmdHello},
+		"quit":    {1, cmdQuit},
+		"select":  {2, cmdSelect},
+		"command": {-1, cmdCommand},
+		"info":    {-1, cmdInfo},
+		"get":     {2, cmdGet},
+		"set":     {-3, cmdSet},
+		"del":     {-2, cmdDel},
+		"exists":  {-2, cmdExists},
+		"mget":    {-2, cmdMGet},
+		"mset":    {-3, cmdMSet},
+		"ttl":     {2, cmdTTL},
+		"pttl":    {2, cmdPTTL},
+		"scan":    {-2, cmdScan},
+		"keys":    {2, cmdKeys},
+		"dbsize":  {1, cmdDBSize},
+		"flushdb": {-1, cmdFlushDB},
+	}
+}
+
+func cmdPing(c *client, args [][]byte) {
+	switch len(args) {
+	case 0:
+		c.w.simple("PONG")
+	case 1:
+		c.w.bulk(args[0])
+	default:
+		c.w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+// HELLO [protover [AUTH username password] [SETNAME name]]
+// 没有配置密码 AUTH 和 SETNAME 都直接忽略
+func cmdHello(c *client, args [][]byte) {
+	proto := c.w.proto
+	if len(args) > 0 {
+		n, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			c.w.error("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if n != 2 && n != 3 {
+			c.w.error("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = n
+		for i := 1; i < len(args); i++ {
+			switch strings.ToLower(string(args[i])) {
+			case "auth":
+				i += 2
+			case "setname":
+				i++
+			default:
+				c.w.error("ERR syntax error")
+				return
+			}
+			if i >= len(args) {
+				c.w.error("ERR syntax error")
+				return
+			}
+		}
+	}
+	c.w.proto = proto
+	c.w.mapHeader(7)
+	c.w.bulk([]byte("server"))
+	c.w.bulk([]byte("redis"))
+	c.w.bulk([]byte("version"))
+	c.w.bulk([]byte(redisVersion))
+	c.w.bulk([]byte("proto"))
+	c.w.integer(int64(proto))
+	c.w.bulk([]byte("id"))
+	c.w.integer(c.id)
+	c.w.bulk([]byte("mode"))
+	c.w.bulk([]byte("standalone"))
+	c.w.bulk([]byte("role"))
+	c.w.bulk([]byte("master"))
+	c.w.bulk([]byte("modules"))
+	c.w.array(0)
+}
+
+func cmdQuit(c *client, args [][]byte) {
+	c.w.simple("OK")
+	c.quit = true
+}
+
+// 只有一个数据库
+func cmdSelect(c *client, args [][]byte) {
+	if string(args[0]) != "0" {
+		c.w.error("ERR DB index is out of range")
+		return
+	}
+	c.w.simple("OK")
+}
+
+// 客户端启动时查询命令列表 返回空列表即可
+func cmdCommand(c *client, args [][]byte) {
+	c.w.array(0)
+}
+
+// INFO [section ...]
+func cmdInfo(c *client, args [][]byte) {
+	want := func(section string) bool {
+		if len(args) == 0 {
+			return true
+		}
+		for _, arg := range args {
+			switch strings.ToLower(string(arg)) {
+			case section, "all", "default", "everything":
+				return true
+			}
+		}
+		return false
+	}
+	var b strings.Builder
+	if want("server") {
+		port := 0
+		if addr, ok := c.s.ln.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+		fmt.Fprintf(&b, "# Server\r\nredis_version:%s\r\nredis_mode:standalone\r\nprocess_id:%d\r\ntcp_port:%d\r\nuptime_in_seconds:%d\r\n\r\n",
+			redisVersion, os.Getpid(), port, int64(time.Since(c.s.started).Seconds()))
+	}
+	if want("clients") {
+		fmt.Fprintf(&b, "# Clients\r\nconnected_clients:%d\r\n\r\n", c.s.numClients())
+	}
+	if want("keyspace") {
+		n := c.s.dbSize()
+		b.WriteString("# Keyspace\r\n")
+		if n > 0 {
+			fmt.Fprintf(&b, "db0:keys=%d\r\n", n)
+		}
+	}
+	c.w.bulk([]byte(b.String()))
+}
+
+func cmdGet(c *client, args [][]byte) {
+	val, err := c.s.db.Get(args[0])
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		c.w.null()
+		return
+	}
+	if err != nil {
+		c.dbError(err)
+		return
+	}
+	c.w.bulk(val)
+}
+
+// SET key value [NX|XX] [EX seconds|PX milliseconds]
+// 条件不满足时返回空值 不带过期时间的 SET 会清除原来的过期时间
+func cmdSet(c *client, args [][]byte) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToLower(string(args[i]))
+		switch {
+		case opt == "nx" && !xx:
+			nx = true
+		case opt == "xx" && !nx:
+			xx = true
+		case (opt == "ex" || opt == "px") && ttl == 0 && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				c.w.error("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > int64(1<<62)/int64(unit) {
+				c.w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+
+	// 和 DEL FLUSHDB 串行执行 XX 在读取和写入之间不会被清空
+	c.s.wmu.Lock()
+	defer c.s.wmu.Unlock()
+	var err error
+	switch {
+	case nx:
+		err = c.s.db.CompareAndSwapWithTTL(key, nil, value, ttl)
+	case xx:
+		err = c.s.replace(key, value, ttl)
+	default:
+		err = c.s.db.PutWithTTL(key, value, ttl)
+	}
+	if errors.Is(err, bitcask.ErrConditionFailed) {
+		c.w.null()
+		return
+	}
+	if err != nil {
+		c.dbError(err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+// key 存在时覆盖 不存在时返回 ErrConditionFailed 调用方需要持有 wmu
+// 比较和写入在数据库的写锁内完成 读取之后被直接使用数据库的写入修改时重试
+func (s *server) replace(key, value []byte, ttl time.Duration) error {
+	for {
+		old, err := s.db.Get(key)
+		if errors.Is(err, bitcask.ErrKeyNotFound) {
+			return bitcask.ErrConditionFailed
+		}
+		if err != nil {
+			return err
+		}
+		err = s.db.CompareAndSwapWithTTL(key, old, value, ttl)
+		if !errors.Is(err, bitcask.ErrConditionFailed) {
+			return err
+		}
+	}
+}
+
+// 返回删除的 key 的数量 重复的 key 只计算一次
+func cmdDel(c *client, args [][]byte) {
+	c.s.wmu.Lock()
+	defer c.s.wmu.Unlock()
+	batch := bitcask.NewWriteBatch()
+	seen := map[string]bool{}
+	for _, key := range args {
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		exists, err := c.s.exists(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		}
+		if exists {
+			batch.Delete(key)
+		}
+	}
+	if err := c.s.db.Write(batch); err != nil {
+		c.dbError(err)
+		return
+	}
+	c.w.integer(int64(batch.Len()))
+}
+
+// 重复的 key 会被计算多次
+func cmdExists(c *client, args [][]byte) {
+	n := 0
+	for _, key := range args {
+		exists, err := c.s.exists(key)
+		if err != nil {
+			c.dbError(err)
+			return
+		}
+		if exists {
+			n++
+		}
+	}
+	c.w.integer(int64(n))
+}
+
+func cmdMGet(c *client, args [][]byte) {
+	vals := make([][]byte, len(args))
+	for i, key := range args {
+		val, err := c.s.db.Get(key)
+		if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
+			c.dbError(err)
+			return
+		}
+		vals[i] = val
+	}
+	c.w.array(len(vals))
+	for _, val := range vals {
+		if val == nil {
+			c.w.null()
+		} else {
+			c.w.bulk(val)
+		}
+	}
+}
+
+// 作为一个批次原子地写入
+func cmdMSet(c *client, args [][]byte) {
+	if len(args)%2 != 0 {
+		c.w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	batch := bitcask.NewWriteBatch()
+	for i := 0; i < len(args); i += 2 {
+		batch.Put(args[i], args[i+1])
+	}
+	c.s.wmu.Lock()
+	defer c.s.wmu.Unlock()
+	if err := c.s.db.Write(batch); err != nil {
+		c.dbError(err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+func cmdTTL(c *client, args [][]byte) {
+	c.ttl(args[0], time.Second)
+}
+func cmdPTTL(c *client, args [][]byte) {
+	c.ttl(args[0], time.Millisecond)
+}
+
+// 不存在时返回 -2 没有过期时间时返回 -1 秒数四舍五入
+func (c *client) ttl(key []byte, unit time.Duration) {
+	ttl, err := c.s.db.TTL(key)
+	switch {
+	case errors.Is(err, bitcask.ErrKeyNotFound):
+		c.w.integer(-2)
+	case err != nil:
+		c.dbError(err)
+	case ttl == 0:
+		c.w.integer(-1)
+	default:
+		c.w.integer(int64((ttl + unit/2) / unit))
+	}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+// 按照 key 的顺序遍历 游标是上一次遍历到的 key 的编码 服务器不保存状态 COUNT 是每次最多检查的 key 的数量
+func cmdScan(c *client, args [][]byte) {
+	last, ok := decodeCursor(args[0])
+	if !ok {
+		c.w.error("ERR invalid cursor")
+		return
+	}
+	var pattern []byte
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				c.w.error("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		default:
+			c.w.error("ERR syntax error")
+			return
+		}
+	}
+
+	it := c.s.db.NewIterator(bitcask.IteratorOptions{Prefix: literalPrefix(pattern), Start: last})
+	defer it.Close()
+	var keys [][]byte
+	next := []byte("0")
+	for n := 0; it.Valid(); it.Next() {
+		key := it.Key()
+		// 起始位置包含上一次的最后一个 key
+		if last != nil && bytes.Equal(key, last) {
+			continue
+		}
+		if n == count {
+			next = encodeCursor(last)
+			break
+		}
+		n++
+		last = key
+		if pattern == nil || matchPattern(pattern, key) {
+			keys = append(keys, bytes.Clone(key))
+		}
+	}
+	c.w.array(2)
+	c.w.bulk(next)
+	c.writeKeys(keys)
+}
+
+// 游标是 0x01+key 对应的十进制整数 开头的 0x01 保留 key 开头的零字节
+// 0 表示开始和结束 客户端可以把游标当作整数处理
+func encodeCursor(key []byte) []byte {
+	n := new(big.Int).SetBytes(append([]byte{1}, key...))
+	return n.Append(nil, 10)
+}
+
+// 0 返回 nil 表示从头开始
+func decodeCursor(cursor []byte) ([]byte, bool) {
+	n, ok := new(big.Int).SetString(string(cursor), 10)
+	if !ok || n.Sign() < 0 {
+		return nil, false
+	}
+	if n.Sign() == 0 {
+		return nil, true
+	}
+	buf := n.Bytes()
+	if buf[0] != 1 {
+		return nil, false
+	}
+	return buf[1:], true
+}
+
+func cmdKeys(c *client, args [][]byte) {
+	pattern := args[0]
+	it := c.s.db.NewIterator(bitcask.IteratorOptions{Prefix: literalPrefix(pattern)})
+	defer it.Close()
+	var keys [][]byte
+	for ; it.Valid(); it.Next() {
+		if matchPattern(pattern, it.Key()) {
+			keys = append(keys, bytes.Clone(it.Key()))
+		}
+	}
+	c.writeKeys(keys)
+}
+
+func (c *client) writeKeys(keys [][]byte) {
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+}
+
+func cmdDBSize(c *client, args [][]byte) {
+	c.w.integer(int64(c.s.dbSize()))
+}
+
+// 一次 FLUSHDB 写入的批次中最多的 key 数量
+const flushChunk = 1024
+
+// FLUSHDB [ASYNC|SYNC] 删除所有的 key
+// 每个批次最多删除 flushChunk 个 key 避免一次构造过大的批次
+func cmdFlushDB(c *client, args [][]byte) {
+	if len(args) > 1 || len(args) == 1 && !strings.EqualFold(string(args[0]), "async") && !strings.EqualFold(string(args[0]), "sync") {
+		c.w.error("ERR syntax error")
+		return
+	}
+	c.s.wmu.Lock()
+	defer c.s.wmu.Unlock()
+	var start []byte
+	for more := true; more; {
+		batch := bitcask.NewWriteBatch()
+		it := c.s.db.NewIterator(bitcask.IteratorOptions{Start: start})
+		for ; it.Valid() && batch.Len() < flushChunk; it.Next() {
+			// 下一轮从最后删除的 key 之后开始 不再重复跳过已经过期的 key
+			start = append(bytes.Clone(it.Key()), 0)
+			batch.Delete(start[:len(start)-1])
+		}
+		more = it.Valid()
+		it.Close()
+		if err := c.s.db.Write(batch); err != nil {
+			c.dbError(err)
+			return
+		}
+	}
+	c.w.simple("OK")
+}
+
+// 只查询索引 不读取 value
+func (s *server) exists(key []byte) (bool, error) {
+	_, err := s.db.TTL(key)
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 没有过期的 key 的数量
+func (s *server) dbSize() int {
+	it := s.db.NewIterator(bitcask.IteratorOptions{})
+	defer it.Close()
+	n := 0
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,49 @@
+// bitcask-redis 使用 RESP 协议提供服务 可以直接使用 redis-cli 和 redis 的客户端库访问
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+func main() {
+	addr := flag.String("addr", ":6380", "The address to listen on, e.g., ':6380'")
+	dir := flag.String("dir", "./data", "The directory of the database")
+	maxFileSize := flag.Int64("max-file-size", 64<<20, "The maximum size of a data file in bytes")
+	flag.Parse()
+
+	db, err := bitcask.Open(bitcask.NewOptions(*dir, bitcask.WithMaxFileSize(*maxFileSize)))
+	if err != nil {
+		log.Fatalf("failed to open db: %v\n", err)
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		db.Close()
+		log.Fatalf("failed to listen: %v\n", err)
+	}
+	s := newServer(db)
+
+	// 收到信号之后先关闭连接 再关闭数据库
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.close()
+	}()
+
+	fmt.Printf("Starting server at %s\n", ln.Addr())
+	if err := s.serve(ln); err != nil {
+		log.Printf("failed to serve: %v\n", err)
+	}
+	s.close()
+	if err := db.Close(); err != nil {
+		log.Fatalf("failed to close db: %v\n", err)
+	}
+}
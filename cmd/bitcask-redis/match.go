@@ -0,0 +1,85 @@
+package main
+
+// 按照 redis 的 glob 规则匹配 key
+// * 匹配任意长度 ? 匹配一个字节 [abc] [^a-z] 匹配字符集合 \ 转义下一个字符
+// 遇到不匹配时回退到上一个 * 复杂度为 O(len(pattern)*len(key))
+func matchPattern(pattern, key []byte) bool {
+	p, s := 0, 0
+	starP, starS := -1, 0
+	for s < len(key) {
+		if p < len(pattern) && pattern[p] == '*' {
+			starP, starS = p, s
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if ok, n := matchOne(pattern[p:], key[s]); ok {
+				p += n
+				s++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starS++
+		p, s = starP+1, starS
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// 匹配一个字节 返回是否匹配以及消耗的模式长度
+func matchOne(p []byte, c byte) (bool, int) {
+	switch p[0] {
+	case '?':
+		return true, 1
+	case '\\':
+		if len(p) >= 2 {
+			return p[1] == c, 2
+		}
+	case '[':
+		i := 1
+		not := i < len(p) && p[i] == '^'
+		if not {
+			i++
+		}
+		ok := false
+		for i < len(p) && p[i] != ']' {
+			switch {
+			case p[i] == '\\' && i+1 < len(p):
+				ok = ok || p[i+1] == c
+				i += 2
+			case i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']':
+				lo, hi := p[i], p[i+2]
+				if lo > hi {
+					lo, hi = hi, lo
+				}
+				ok = ok || lo <= c && c <= hi
+				i += 3
+			default:
+				ok = ok || p[i] == c
+				i++
+			}
+		}
+		// 没有闭合的 [ 匹配到模式末尾
+		if i < len(p) {
+			i++
+		}
+		return ok != not, i
+	}
+	return p[0] == c, 1
+}
+
+// 模式中第一个通配符之前的部分 用于缩小遍历的范围
+func literalPrefix(pattern []byte) []byte {
+	for i, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return pattern[:i]
+		}
+	}
+	return pattern
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+const (
+	maxArgs     = 1 << 20   //一条命令最多的参数个数
+	maxBulkSize = 512 << 20 //单个参数的最大长度
+	// 客户端声明的长度不可信 预先分配的空间不超过下面的大小 之后按照实际读到的数据扩容
+	argsPrealloc = 64
+	bulkChunk    = 64 << 10
+)
+
+// 协议错误 回复之后关闭连接
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// RESP 请求的解析 支持多条批量格式和 telnet 使用的内联格式
+type respReader struct {
+	r *bufio.Reader
+}
+
+func newRespReader(r io.Reader) *respReader {
+	return &respReader{r: bufio.NewReaderSize(r, 64<<10)}
+}
+
+// 读取一行 不包含末尾的 \r\n
+func (r *respReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, protocolError("too big inline request")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'}), nil
+}
+
+// 读取一条命令 空行返回 nil
+func (r *respReader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, min(max(n, 0), argsPrealloc))
+	for range n {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError(fmt.Sprintf("expected '$', got '%s'", line[:min(len(line), 1)]))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// 读取长度为 size 的参数和末尾的 \r\n
+// 每次最多读取 bulkChunk 字节 连接断开时不会分配声明的全部长度
+func (r *respReader) readBulk(size int) ([]byte, error) {
+	buf := make([]byte, 0, min(size+2, bulkChunk))
+	for len(buf) < size+2 {
+		n := min(size+2-len(buf), bulkChunk)
+		buf = slices.Grow(buf, n)
+		if _, err := io.ReadFull(r.r, buf[len(buf):len(buf)+n]); err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+n]
+	}
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		return nil, protocolError("bulk string is not terminated by CRLF")
+	}
+	return buf[:size], nil
+}
+
+// 还有没有处理的请求 没有时再把回复写入连接
+func (r *respReader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// RESP 回复的编码 按照连接协商的协议版本输出空值和字典
+type respWriter struct {
+	w     *bufio.Writer
+	proto int //2 或者 3
+}
+
+func newRespWriter(w io.Writer) *respWriter {
+	return &respWriter{w: bufio.NewWriter(w), proto: 2}
+}
+
+func (w *respWriter) simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+func (w *respWriter) error(msg string) {
+	w.w.WriteString("-" + msg + "\r\n")
+}
+func (w *respWriter) errorf(format string, args ...any) {
+	w.error(fmt.Sprintf(format, args...))
+}
+func (w *respWriter) integer(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+func (w *respWriter) bulk(b []byte) {
+	w.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+func (w *respWriter) null() {
+	if w.proto >= 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+func (w *respWriter) array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// RESP2 没有字典 使用键值交替的数组
+func (w *respWriter) mapHeader(n int) {
+	if w.proto >= 3 {
+		w.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	w.array(2 * n)
+}
+func (w *respWriter) flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+// 兼容的 redis 版本 客户端据此判断是否支持 RESP3
+const redisVersion = "7.0.0"
+
+type server struct {
+	db      *bitcask.Db
+	wmu     sync.Mutex //串行化先读后写的命令 DEL SET 和 FLUSHDB
+	started time.Time
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	clientId atomic.Int64
+	closed   bool
+}
+
+func newServer(db *bitcask.Db) *server {
+	return &server{
+		db:      db,
+		started: time.Now(),
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// 接受连接直到监听关闭 每个连接一个协程
+func (s *server) serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+// 关闭监听和所有连接 等待正在执行的命令结束 可以重复调用
+func (s *server) close() error {
+	s.mu.Lock()
+	var err error
+	if !s.closed && s.ln != nil {
+		err = s.ln.Close()
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *server) numClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+type client struct {
+	s    *server
+	id   int64
+	r    *respReader
+	w    *respWriter
+	quit bool
+}
+
+func (s *server) handleConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	c := &client{s: s, id: s.clientId.Add(1), r: newRespReader(conn), w: newRespWriter(conn)}
+	for !c.quit {
+		args, err := c.r.readCommand()
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.w.error("ERR " + perr.Error())
+				c.w.flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("client %d: %v\n", c.id, err)
+			}
+			return
+		}
+		if len(args) > 0 {
+			c.exec(args)
+		}
+		// 流水线中的命令全部处理完之后再写回
+		if c.r.buffered() {
+			continue
+		}
+		if err := c.w.flush(); err != nil {
+			return
+		}
+	}
+	c.w.flush()
+}
+
+// 按照名称查找命令并检查参数个数
+func (c *client) exec(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.w.errorf("ERR unknown command '%s'", args[0])
+		return
+	}
+	if cmd.arity > 0 && len(args) != cmd.arity || cmd.arity < 0 && len(args) < -cmd.arity {
+		c.w.errorf("ERR wrong number of arguments for '%s' command", name)
+		return
+	}
+	cmd.fn(c, args[1:])
+}
+
+// 数据库返回的错误
+func (c *client) dbError(err error) {
+	if errors.Is(err, bitcask.ErrClosed) {
+		c.w.error("ERR server is shutting down")
+		return
+	}
+	c.w.error("ERR " + err.Error())
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+// 测试使用的 RESP 客户端 回复解析为 string int64 []any map[string]any nil 和 respErr
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type respErr string
+
+func startServer(t *testing.T) string {
+	t.Helper()
+	addr, _ := startServerDb(t)
+	return addr
+}
+
+// 同时返回数据库 测试中可以绕过服务器直接写入
+func startServerDb(t *testing.T) (string, *bitcask.Db) {
+	t.Helper()
+	db, err := bitcask.Open(bitcask.NewOptions(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(db)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(ln)
+	}()
+	t.Cleanup(func() {
+		s.close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return ln.Addr().String(), db
+}
+
+func dial(t *testing.T, addr string) *respClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+func (c *respClient) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return respErr(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '_':
+		return nil, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*', '%':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if line[0] == '%' {
+			m := map[string]any{}
+			for range n {
+				k, err := c.read()
+				if err != nil {
+					return nil, err
+				}
+				v, err := c.read()
+				if err != nil {
+					return nil, err
+				}
+				m[fmt.Sprint(k)] = v
+			}
+			return m, nil
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	return nil, fmt.Errorf("unknown reply %q", line)
+}
+
+func (c *respClient) do(t *testing.T, args ...string) any {
+	t.Helper()
+	if err := c.send(args...); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// 检查回复 期望值中的整数使用 int
+func expect(t *testing.T, c *respClient, want any, args ...string) {
+	t.Helper()
+	got := c.do(t, args...)
+	if n, ok := want.(int); ok {
+		want = int64(n)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("%v: got %#v want %#v", args, got, want)
+	}
+}
+
+func expectErr(t *testing.T, c *respClient, prefix string, args ...string) {
+	t.Helper()
+	got := c.do(t, args...)
+	if e, ok := got.(respErr); !ok || !strings.HasPrefix(string(e), prefix) {
+		t.Fatalf("%v: got %#v want error %q", args, got, prefix)
+	}
+}
+
+func TestBasicCommands(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, "PONG", "PING")
+	expectRaw(t, c, "$-1\r\n", "GET", "a")
+	expect(t, c, "hi", "ping", "hi")
+	expect(t, c, nil, "GET", "a")
+	expect(t, c, "OK", "SET", "a", "1")
+	expect(t, c, "1", "GET", "a")
+	expect(t, c, "OK", "SET", "empty", "")
+	expect(t, c, "", "GET", "empty")
+	expect(t, c, "OK", "MSET", "b", "2", "c", "3")
+	expect(t, c, []any{"1", "2", nil, "3"}, "MGET", "a", "b", "x", "c")
+	expect(t, c, 3, "EXISTS", "a", "a", "b", "x")
+	expect(t, c, 4, "DBSIZE")
+	expect(t, c, 2, "DEL", "a", "b", "a", "x")
+	expect(t, c, 0, "EXISTS", "a", "b")
+	expect(t, c, 2, "DBSIZE")
+	expect(t, c, "OK", "SELECT", "0")
+
+	expectErr(t, c, "ERR unknown command 'NOPE'", "NOPE")
+	expectErr(t, c, "ERR wrong number of arguments for 'get'", "GET")
+	expectErr(t, c, "ERR wrong number of arguments for 'get'", "GET", "a", "b")
+	expectErr(t, c, "ERR wrong number of arguments for 'mset'", "MSET", "a", "1", "b")
+	expectErr(t, c, "ERR DB index", "SELECT", "1")
+	expect(t, c, "OK", "QUIT")
+	if _, err := c.read(); err == nil {
+		t.Fatal("connection not closed after QUIT")
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+
+	expect(t, c, nil, "SET", "k", "1", "XX")
+	expect(t, c, "OK", "SET", "k", "1", "NX")
+	expect(t, c, nil, "SET", "k", "2", "NX")
+	expect(t, c, "1", "GET", "k")
+	expect(t, c, "OK", "SET", "k", "2", "XX")
+	expect(t, c, "2", "GET", "k")
+	expect(t, c, -1, "TTL", "k")
+	expect(t, c, -2, "TTL", "missing")
+	expect(t, c, -2, "PTTL", "missing")
+
+	expect(t, c, "OK", "SET", "k", "3", "EX", "100")
+	expect(t, c, 100, "TTL", "k")
+	if ms := c.do(t, "PTTL", "k").(int64); ms <= 99000 || ms > 100000 {
+		t.Fatalf("pttl %d", ms)
+	}
+	// 不带过期时间的 SET 清除过期时间
+	expect(t, c, "OK", "SET", "k", "4")
+	expect(t, c, -1, "TTL", "k")
+
+	expect(t, c, "OK", "set", "short", "v", "px", "50", "nx")
+	expect(t, c, "v", "GET", "short")
+	time.Sleep(100 * time.Millisecond)
+	expect(t, c, nil, "GET", "short")
+	expect(t, c, 0, "EXISTS", "short")
+	expect(t, c, -2, "TTL", "short")
+	expect(t, c, "OK", "SET", "short", "w", "NX")
+
+	expectErr(t, c, "ERR syntax error", "SET", "k", "v", "NX", "XX")
+	expectErr(t, c, "ERR syntax error", "SET", "k", "v", "EX", "1", "PX", "1")
+	expectErr(t, c, "ERR syntax error", "SET", "k", "v", "EX")
+	expectErr(t, c, "ERR syntax error", "SET", "k", "v", "KEEPTTL")
+	expectErr(t, c, "ERR invalid expire time", "SET", "k", "v", "EX", "0")
+	expectErr(t, c, "ERR invalid expire time", "SET", "k", "v", "PX", "-5")
+	expectErr(t, c, "ERR value is not an integer", "SET", "k", "v", "EX", "abc")
+	expect(t, c, "4", "GET", "k")
+}
+
+func TestScan(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+	want := map[string]bool{}
+	args := []string{"MSET"}
+	for i := range 50 {
+		key := fmt.Sprintf("user:%02d", i)
+		want[key] = true
+		args = append(args, key, "v", fmt.Sprintf("item:%02d", i), "v")
+	}
+	expect(t, c, "OK", args...)
+
+	scan := func(args ...string) map[string]bool {
+		got := map[string]bool{}
+		cursor := "0"
+		for calls := 0; ; calls++ {
+			if calls > 100 {
+				t.Fatal("scan does not terminate")
+			}
+			reply := c.do(t, append([]string{"SCAN", cursor}, args...)...).([]any)
+			for _, key := range reply[1].([]any) {
+				if got[key.(string)] {
+					t.Fatalf("duplicate key %s", key)
+				}
+				got[key.(string)] = true
+			}
+			if cursor = reply[0].(string); cursor == "0" {
+				return got
+			}
+		}
+	}
+	if got := scan("MATCH", "user:*", "COUNT", "7"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("scan got %d keys", len(got))
+	}
+	if got := scan(); len(got) != 100 {
+		t.Fatalf("scan got %d keys", len(got))
+	}
+	// 没有字面前缀的模式遍历所有的 key
+	if got := scan("MATCH", "*:4?", "COUNT", "3"); len(got) != 20 {
+		t.Fatalf("scan got %v", got)
+	}
+
+	// 遍历过程中的修改不影响已经返回的游标
+	reply := c.do(t, "SCAN", "0", "COUNT", "10").([]any)
+	expect(t, c, 1, "DEL", "item:15")
+	rest := c.do(t, "SCAN", reply[0].(string), "COUNT", "1000").([]any)
+	if rest[0] != "0" || len(reply[1].([]any))+len(rest[1].([]any)) != 99 {
+		t.Fatalf("%v %v", reply, rest)
+	}
+
+	// 游标不保存在服务器中 中间的其他 SCAN 不会让它失效
+	reply = c.do(t, "SCAN", "0", "COUNT", "10").([]any)
+	for range 5000 {
+		if err := c.send("SCAN", "0", "COUNT", "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 5000 {
+		if _, err := c.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rest = c.do(t, "SCAN", reply[0].(string), "COUNT", "1000").([]any)
+	if rest[0] != "0" || len(reply[1].([]any))+len(rest[1].([]any)) != 99 {
+		t.Fatalf("%v %v", reply, rest)
+	}
+
+	expectErr(t, c, "ERR invalid cursor", "SCAN", "12345")
+	expectErr(t, c, "ERR invalid cursor", "SCAN", "-1")
+	expectErr(t, c, "ERR invalid cursor", "SCAN", "abc")
+	expectErr(t, c, "ERR value is not an integer", "SCAN", "0", "COUNT", "0")
+	expectErr(t, c, "ERR syntax error", "SCAN", "0", "MATCH")
+
+	keys := c.do(t, "KEYS", "user:1[0-2]").([]any)
+	if !reflect.DeepEqual(keys, []any{"user:10", "user:11", "user:12"}) {
+		t.Fatalf("%v", keys)
+	}
+	if keys := c.do(t, "KEYS", "*").([]any); len(keys) != 99 {
+		t.Fatalf("%d keys", len(keys))
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"*b*", "abc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{`[\]]`, "]", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchPattern([]byte(tt.pattern), []byte(tt.key)); got != tt.want {
+			t.Errorf("match(%q, %q) = %v", tt.pattern, tt.key, got)
+		}
+	}
+	if p := literalPrefix([]byte("user:*:x")); string(p) != "user:" {
+		t.Fatalf("prefix %q", p)
+	}
+}
+
+func TestHello(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+
+	// RESP2 的字典是键值交替的数组
+	reply := c.do(t, "HELLO").([]any)
+	if len(reply) != 14 || reply[0] != "server" || reply[5] != int64(2) {
+		t.Fatalf("%v", reply)
+	}
+	expectErr(t, c, "NOPROTO", "HELLO", "4")
+	expectErr(t, c, "ERR syntax error", "HELLO", "3", "AUTH", "user")
+
+	m, ok := c.do(t, "HELLO", "3", "SETNAME", "test").(map[string]any)
+	if !ok || m["proto"] != int64(3) || m["version"] != redisVersion {
+		t.Fatalf("%v", m)
+	}
+	// RESP3 的空值
+	expect(t, c, nil, "GET", "missing")
+	expect(t, c, []any{nil}, "MGET", "missing")
+	expectRaw(t, c, "_\r\n", "GET", "missing")
+}
+
+// 检查原始的回复 区分 RESP2 和 RESP3 的空值
+func expectRaw(t *testing.T, c *respClient, want string, args ...string) {
+	t.Helper()
+	if err := c.send(args...); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(c.r, buf); err != nil || string(buf) != want {
+		t.Fatalf("%v: got %q want %q", args, buf, want)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+
+	// 多条命令一次写入 按顺序回复
+	var b strings.Builder
+	for i := range 100 {
+		fmt.Fprintf(&b, "*3\r\n$3\r\nSET\r\n$%d\r\nk%d\r\n$1\r\nv\r\n", len(strconv.Itoa(i))+1, i)
+	}
+	b.WriteString("DBSIZE\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("get  k7\r\n")
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		if reply, err := c.read(); err != nil || reply != "OK" {
+			t.Fatalf("%d: %v %v", i, reply, err)
+		}
+	}
+	for _, want := range []any{int64(100), "v"} {
+		if reply, err := c.read(); err != nil || reply != want {
+			t.Fatalf("%v %v", reply, err)
+		}
+	}
+
+	// 协议错误之后关闭连接
+	if _, err := c.conn.Write([]byte("*1\r\n+PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := c.read(); err != nil || !strings.HasPrefix(string(reply.(respErr)), "ERR Protocol error") {
+		t.Fatalf("%v %v", reply, err)
+	}
+	if _, err := c.read(); err == nil {
+		t.Fatal("connection not closed after protocol error")
+	}
+
+	c = dial(t, addr)
+	if _, err := c.conn.Write([]byte("*1\r\n$4\r\nPINGxx")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := c.read(); err != nil || !strings.Contains(string(reply.(respErr)), "CRLF") {
+		t.Fatalf("%v %v", reply, err)
+	}
+}
+
+// 声明的长度很大但是数据没有到达时 不会按照声明的长度分配内存
+func TestReadCommandBounded(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r := newRespReader(strings.NewReader("*1000000\r\n$536870000\r\nabc"))
+	if _, err := r.readCommand(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes", n)
+	}
+
+	// 超过 bulkChunk 的参数分多次读取
+	arg := strings.Repeat("x", 3*bulkChunk+5)
+	r = newRespReader(strings.NewReader(fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(arg), arg)))
+	args, err := r.readCommand()
+	if err != nil || len(args) != 2 || string(args[1]) != arg {
+		t.Fatalf("%d %v", len(args), err)
+	}
+}
+
+func TestFlushDBAndInfo(t *testing.T) {
+	addr := startServer(t)
+	c := dial(t, addr)
+	dial(t, addr)
+
+	expect(t, c, "OK", "MSET", "a", "1", "b", "2", "c", "3")
+	expect(t, c, "OK", "SET", "d", "4", "EX", "100")
+	info := c.do(t, "INFO").(string)
+	for _, s := range []string{"# Server", "redis_version:" + redisVersion, "connected_clients:2", "db0:keys=4"} {
+		if !strings.Contains(info, s) {
+			t.Fatalf("%q not in %q", s, info)
+		}
+	}
+	info = c.do(t, "INFO", "keyspace").(string)
+	if strings.Contains(info, "# Server") || !strings.Contains(info, "db0:keys=4") {
+		t.Fatalf("%q", info)
+	}
+
+	expectErr(t, c, "ERR syntax error", "FLUSHDB", "now")
+	expect(t, c, "OK", "FLUSHDB")
+	expect(t, c, 0, "DBSIZE")
+	expect(t, c, nil, "GET", "a")
+	expect(t, c, []any{}, "KEYS", "*")
+	expect(t, c, "OK", "FLUSHDB", "ASYNC")
+
+	// 超过 flushChunk 个 key 时分多个批次删除
+	args := []string{"MSET"}
+	for i := range 2*flushChunk + 5 {
+		args = append(args, fmt.Sprintf("k%d", i), "v")
+	}
+	expect(t, c, "OK", args...)
+	expect(t, c, "OK", "FLUSHDB")
+	expect(t, c, 0, "DBSIZE")
+	if info := c.do(t, "INFO", "keyspace").(string); strings.Contains(info, "db0") {
+		t.Fatalf("%q", info)
+	}
+}
+
+// 并发的 SET NX 只有一个成功
+func TestConcurrentSetNX(t *testing.T) {
+	addr := startServer(t)
+	const clients = 16
+	for round := range 20 {
+		key := fmt.Sprintf("lock:%d", round)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var winners []int
+		for i := range clients {
+			c := dial(t, addr)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.send("SET", key, strconv.Itoa(i), "NX"); err != nil {
+					t.Error(err)
+					return
+				}
+				reply, err := c.read()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if reply == "OK" {
+					mu.Lock()
+					winners = append(winners, i)
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(winners) != 1 {
+			t.Fatalf("round %d: winners %v", round, winners)
+		}
+		expect(t, dial(t, addr), strconv.Itoa(winners[0]), "GET", key)
+	}
+}
+
+// SET NX 和绕过服务器的条件写入竞争 只有一个成功
+func TestSetNXWithDirectWriter(t *testing.T) {
+	addr, db := startServerDb(t)
+	c := dial(t, addr)
+	for round := range 200 {
+		key := fmt.Sprintf("lock:%d", round)
+		var direct error
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			direct = db.PutIfAbsent([]byte(key), []byte("db"))
+		}()
+		reply := c.do(t, "SET", key, "server", "NX")
+		wg.Wait()
+		if (reply == "OK") == (direct == nil) {
+			t.Fatalf("round %d: server %v db %v", round, reply, direct)
+		}
+	}
+}
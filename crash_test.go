@@ -0,0 +1,362 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xia-Sang/bitcask/utils"
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+// 一次写入操作 以及对应的记录在数据文件中的位置
+type crashOp struct {
+	key     string
+	value   string
+	deleted bool
+	fileId  int
+	start   int
+	end     int
+}
+
+const crashKeys = 50
+
+// 随机写入和删除 记录每一次操作的位置
+func writeCrashOps(t *testing.T, db *Db, r *rand.Rand, n int) []crashOp {
+	t.Helper()
+	var ops []crashOp
+	for range n {
+		op := crashOp{key: fmt.Sprintf("key-%03d", r.Intn(crashKeys))}
+		fileId, offset := db.activeFiles.FileId, db.activeFiles.Offset
+		var err error
+		if r.Intn(5) == 0 {
+			op.deleted = true
+			err = db.Delete([]byte(op.key))
+		} else {
+			op.value = string(utils.GenerateRandomBytes(r.Intn(40)))
+			err = db.Put([]byte(op.key), []byte(op.value))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		op.fileId, op.start, op.end = db.activeFiles.FileId, offset, db.activeFiles.Offset
+		// 切换了活跃文件或者是文件中的第一条记录
+		if op.fileId != fileId || offset == 0 {
+			op.start = wal.FileHeaderSize
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// 按顺序回放保留下来的操作
+func expectCrashState(ops []crashOp, keep func(op crashOp) bool) map[string]string {
+	expect := map[string]string{}
+	for _, op := range ops {
+		if !keep(op) {
+			continue
+		}
+		if op.deleted {
+			delete(expect, op.key)
+		} else {
+			expect[op.key] = op.value
+		}
+	}
+	return expect
+}
+
+func checkCrashState(t *testing.T, db *Db, expect map[string]string) {
+	t.Helper()
+	for i := range crashKeys {
+		key := fmt.Sprintf("key-%03d", i)
+		val, ok := get(t, db, []byte(key))
+		want, exist := expect[key]
+		if ok != exist || string(val) != want {
+			t.Fatalf("%s: %q,%v want %q,%v", key, val, ok, want, exist)
+		}
+	}
+}
+
+// 写入一批数据之后模拟崩溃 返回数据目录和所有的操作
+func prepareCrash(t *testing.T, r *rand.Rand) (string, []crashOp, int) {
+	t.Helper()
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(1024)))
+	ops := writeCrashOps(t, db, r, 200)
+	active := db.activeFiles.FileId
+	crashDb(t, db)
+	return dir, ops, active
+}
+
+func copyDir(t *testing.T, src string) string {
+	t.Helper()
+	dst := t.TempDir()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dst
+}
+
+func walPath(dir string, fileId int) string {
+	return filepath.Join(dir, wal.GetWalPath(fileId))
+}
+
+func truncateFile(t *testing.T, path string, size int) {
+	t.Helper()
+	if err := os.Truncate(path, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipBit(t *testing.T, path string, offset int, bit uint) {
+	t.Helper()
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[offset] ^= 1 << bit
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fileSize(t *testing.T, path string) int {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int(stat.Size())
+}
+
+// 恢复之后数据库可以继续写入 重启之后状态不变 也不会再报告损坏
+func checkRecovered(t *testing.T, opts *Options, db *Db, expect map[string]string) {
+	t.Helper()
+	checkCrashState(t, db, expect)
+	if err := db.Put([]byte("key-000"), []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	expect["key-000"] = "after"
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	checkCrashState(t, db, expect)
+	db.Close()
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkCrashState(t, db, expect)
+	if c := db.Corruptions(); len(c) != 0 {
+		t.Fatalf("corruptions after recovery: %v", c)
+	}
+}
+
+func openStrict(t *testing.T, dir string) {
+	t.Helper()
+	db, err := Open(NewOptions(copyDir(t, dir), WithMaxFileSize(1024), WithRecoveryMode(RecoveryStrict)))
+	if err == nil {
+		db.Close()
+		t.Fatal("strict mode opened a corrupt database")
+	}
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expect ErrCorrupted, got %v", err)
+	}
+}
+
+// 活跃文件在随机的位置被截断 末尾不完整的记录被丢弃
+func TestCrashTornTail(t *testing.T) {
+	for i := range 20 {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			r := rand.New(rand.NewSource(int64(i)))
+			dir, ops, active := prepareCrash(t, r)
+			size := fileSize(t, walPath(dir, active))
+			if size <= wal.FileHeaderSize {
+				t.Skip("empty active file")
+			}
+			cut := wal.FileHeaderSize + r.Intn(size-wal.FileHeaderSize)
+			truncateFile(t, walPath(dir, active), cut)
+
+			// 截断之后保留下来的最后一个完整的记录
+			boundary := wal.FileHeaderSize
+			for _, op := range ops {
+				if op.fileId == active && op.end <= cut {
+					boundary = op.end
+				}
+			}
+			if boundary != cut {
+				openStrict(t, dir)
+			}
+
+			opts := NewOptions(dir, WithMaxFileSize(1024))
+			db, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(db.Corruptions()); (got != 0) != (boundary != cut) {
+				t.Fatalf("cut %d boundary %d corruptions %v", cut, boundary, db.Corruptions())
+			}
+			if got := fileSize(t, walPath(dir, active)); got != boundary {
+				t.Fatalf("active file truncated to %d want %d", got, boundary)
+			}
+			expect := expectCrashState(ops, func(op crashOp) bool {
+				return op.fileId != active || op.end <= cut
+			})
+			checkRecovered(t, opts, db, expect)
+		})
+	}
+}
+
+// 写入文件头时崩溃 活跃文件被清空
+func TestCrashTornHeader(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	dir, ops, active := prepareCrash(t, r)
+	truncateFile(t, walPath(dir, active), 1+r.Intn(wal.FileHeaderSize-1))
+	openStrict(t, dir)
+
+	opts := NewOptions(dir, WithMaxFileSize(1024))
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := db.Corruptions(); len(c) != 1 || !errors.Is(c[0].Err, wal.ErrBadFileHeader) {
+		t.Fatalf("corruptions %v", c)
+	}
+	expect := expectCrashState(ops, func(op crashOp) bool {
+		return op.fileId != active
+	})
+	checkRecovered(t, opts, db, expect)
+}
+
+// 完整的文件头校验失败时打开失败 不会清空活跃文件
+func TestCrashBadHeader(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	dir, _, active := prepareCrash(t, r)
+	size := fileSize(t, walPath(dir, active))
+	flipBit(t, walPath(dir, active), wal.FileHeaderSize-1, 0)
+	if _, err := Open(NewOptions(dir, WithMaxFileSize(1024))); !errors.Is(err, ErrCorrupted) {
+		t.Fatal(err)
+	}
+	if fileSize(t, walPath(dir, active)) != size {
+		t.Fatal("active file modified")
+	}
+}
+
+// 封存文件中随机的位置发生位翻转 只有跳过模式可以打开 丢失的只有损坏的记录
+func TestCrashSealedBitFlip(t *testing.T) {
+	for i := range 20 {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			r := rand.New(rand.NewSource(int64(i)))
+			dir, ops, active := prepareCrash(t, r)
+			var sealed []crashOp
+			for _, op := range ops {
+				if op.fileId != active {
+					sealed = append(sealed, op)
+				}
+			}
+			bad := sealed[r.Intn(len(sealed))]
+			flipBit(t, walPath(dir, bad.fileId), bad.start+r.Intn(bad.end-bad.start), uint(r.Intn(8)))
+			// 索引文件中没有value 只有扫描数据文件时才能发现损坏
+			if err := wal.RemoveHintFile(dir, bad.fileId); err != nil {
+				t.Fatal(err)
+			}
+
+			openStrict(t, dir)
+			if db, err := Open(NewOptions(copyDir(t, dir), WithMaxFileSize(1024))); err == nil {
+				db.Close()
+				t.Fatal("truncate mode opened a corrupt sealed file")
+			}
+
+			opts := NewOptions(dir, WithMaxFileSize(1024), WithRecoveryMode(RecoverySkip))
+			db, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := db.Corruptions()
+			if len(c) != 1 || c[0].FileId != bad.fileId || c[0].Offset != bad.start || c[0].Length != bad.end-bad.start {
+				t.Fatalf("corruptions %v want %+v", c, bad)
+			}
+			expect := expectCrashState(ops, func(op crashOp) bool {
+				return op != bad
+			})
+			checkRecovered(t, opts, db, expect)
+		})
+	}
+}
+
+// 活跃文件中随机的位置发生位翻转
+// 截断模式丢弃损坏的记录之后的所有内容 跳过模式只丢弃损坏的记录
+func TestCrashActiveBitFlip(t *testing.T) {
+	for i := range 20 {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			r := rand.New(rand.NewSource(int64(i)))
+			dir, ops, active := prepareCrash(t, r)
+			var inActive []crashOp
+			for _, op := range ops {
+				if op.fileId == active {
+					inActive = append(inActive, op)
+				}
+			}
+			if len(inActive) == 0 {
+				t.Skip("empty active file")
+			}
+			bad := inActive[r.Intn(len(inActive))]
+			flipBit(t, walPath(dir, active), bad.start+r.Intn(bad.end-bad.start), uint(r.Intn(8)))
+			openStrict(t, dir)
+
+			skipDir := copyDir(t, dir)
+			opts := NewOptions(dir, WithMaxFileSize(1024))
+			// 损坏之后还有完整的记录时 默认模式打开失败 不修改文件
+			if bad != inActive[len(inActive)-1] {
+				size := fileSize(t, walPath(dir, active))
+				if _, err := Open(opts); !errors.Is(err, ErrCorrupted) {
+					t.Fatal(err)
+				}
+				if fileSize(t, walPath(dir, active)) != size {
+					t.Fatal("active file modified")
+				}
+			} else {
+				db, err := Open(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c := db.Corruptions(); len(c) != 1 || c[0].Offset != bad.start {
+					t.Fatalf("corruptions %v want %+v", c, bad)
+				}
+				checkRecovered(t, opts, db, expectCrashState(ops, func(op crashOp) bool {
+					return op != bad
+				}))
+			}
+
+			opts = NewOptions(skipDir, WithMaxFileSize(1024), WithRecoveryMode(RecoverySkip))
+			db, err := Open(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := db.Corruptions(); len(c) != 1 || c[0].Offset != bad.start {
+				t.Fatalf("corruptions %v want %+v", c, bad)
+			}
+			checkRecovered(t, opts, db, expectCrashState(ops, func(op crashOp) bool {
+				return op != bad
+			}))
+		})
+	}
+}
@@ -2,152 +2,378 @@ package bitcask
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xia-Sang/bitcask/memtable"
 	"github.com/xia-Sang/bitcask/wal"
 )
 
+var (
+	ErrClosed    = errors.New("database is closed")
+	ErrCorrupted = errors.New("data corrupted") //数据文件或者索引文件损坏 和不存在的key区分
+	ErrWrongKey  = wal.ErrWrongKey              //数据文件使用的密钥没有配置
+)
+
 type Db struct {
 	opts        *Options //配置选项
 	activeFiles *wal.Wal
 	olderFiles  map[int]*wal.Wal
+	hints       []*wal.Hint //活跃文件中已经提交的记录 封存时直接写入索引文件
+	hintsValid  bool        //hints 是否覆盖了整个活跃文件 否则封存时需要扫描
 	memTable    memtable.MemTable
 	mu          *sync.RWMutex
+	seq         uint64         //最新的序号 每次写入递增
+	merging     bool           //是否正在合并
+	mergeWg     sync.WaitGroup //关闭时等待进行中的合并结束
+	closed      bool
+	fileLock    *os.File //数据目录锁
+	sweepStop   chan struct{}
+	sweepDone   chan struct{}
+
+	commit   *groupCommit //组提交
+	unsynced atomic.Int64 //还没有落盘的字节数
+	syncStop chan struct{}
+	syncDone chan struct{}
+
+	corruptions []wal.Corruption //打开时发现的损坏区域
+	keyring     *wal.Keyring     //加密数据文件和索引文件的密钥 为空表示不加密
+
+	newTable     memtable.Constructor         //创建 bucket 的索引
+	buckets      map[uint32]memtable.MemTable //默认 bucket 以外的索引 包括元数据 bucket
+	bucketIds    map[string]uint32            //bucket 名称对应的编号
+	nextBucket   uint32                       //下一个新建的 bucket 使用的编号
+	mergeFilters map[uint32]MergeFilter       //合并时丢弃 bucket 中的哪些 key
+
+	snapshots    map[uint64]int    //未释放的快照 序号到数量
+	lastSnapshot uint64            //最新的快照的序号
+	versions     memtable.MemTable //被覆盖的对快照可见的版本 没有快照时为空
+	pendingMerge *mergeTask        //等待快照释放之后再替换的合并结果
 }
 type Data struct {
 	Key   []byte
 	Value []byte
 }
 
-func (db *Db) ListKeys() (ans []*Data) {
-	for iter := db.memTable.Iterator(); iter.Valid(); iter.Next() {
-		key, pos := iter.Curr()
-		val := db.getValueByPos(pos.(*wal.Pos))
-		if !bytes.Equal(val, []byte("")) {
-			ans = append(ans, &Data{Key: key, Value: val})
-		}
+// ListKeys 返回全部没有过期的数据 读取失败时返回错误
+func (db *Db) ListKeys() ([]*Data, error) {
+	var ans []*Data
+	err := db.Fold(func(key, value []byte) bool {
+		ans = append(ans, &Data{Key: key, Value: value})
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
-	return
+	return ans, nil
 }
 func (db *Db) Fold(fn func(key, value []byte) bool) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
+	now := time.Now().UnixNano()
 	for iter := db.memTable.Iterator(); iter.Valid(); iter.Next() {
 		key, pos := iter.Curr()
-		val := db.getValueByPos(pos.(*wal.Pos))
-		if !bytes.Equal(val, []byte("")) {
-			if !fn(key, val) {
-				break
-			}
+		if pos.(*wal.Pos).Expired(now) {
+			continue
+		}
+		val, err := db.getValueByPos(pos.(*wal.Pos))
+		if err != nil {
+			return err
+		}
+		if !fn(key, val) {
+			break
 		}
 	}
 	return nil
 }
 func (db *Db) newActiveFile() error {
+	return db.rotateActiveFile(0)
+}
+
+// 封存活跃文件 新的活跃文件跳过 reserve 个编号
+func (db *Db) rotateActiveFile(reserve int) error {
 	var fileId int
 	if db.activeFiles != nil {
 		fileId = db.activeFiles.FileId
 		if err := db.activeFiles.Sync(); err != nil {
 			return err
 		}
-		db.olderFiles[fileId] = db.activeFiles
+		// 封存的文件生成索引文件 加快启动速度
+		if err := db.writeHint(db.activeFiles); err != nil {
+			return err
+		}
+		if err := db.addOlderFile(db.activeFiles); err != nil {
+			return err
+		}
 	} else {
 		fileId = 0
 	}
 
-	newActive, err := wal.NewWal(db.opts.DirPath, fileId+1)
+	newActive, err := wal.NewEncryptedWal(db.opts.DirPath, fileId+1+reserve, db.keyring)
 	if err != nil {
 		return err
 	}
 	db.activeFiles = newActive
-	return nil
+	db.hints, db.hintsValid = nil, true
+	// 检查点移动到新的活跃文件
+	return db.flushIndex()
 }
-func NewDb(opts *Options) *Db {
+
+// Open 打开数据库
+// 数据目录已经被其他进程打开时返回 ErrDatabaseLocked 数据文件损坏时返回 ErrCorrupted
+// 数据文件使用的密钥没有配置时返回 ErrWrongKey
+func Open(opts *Options) (*Db, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+	keyring, err := opts.keyring()
+	if err != nil {
+		return nil, err
+	}
 	db := &Db{
 		opts:       opts,
-		memTable:   memtable.NewBTreeMemTable(),
 		mu:         &sync.RWMutex{},
 		olderFiles: map[int]*wal.Wal{},
+		commit:     newGroupCommit(),
+		keyring:    keyring,
+		buckets:    map[uint32]memtable.MemTable{},
+	}
+	if err := db.lockDir(); err != nil {
+		return nil, err
+	}
+	if err := db.openIndex(); err != nil {
+		db.unlockDir()
+		return nil, corrupted(err)
 	}
-	if err := db.constructMemTable(); err != nil {
-		panic(err)
+	// 回放结束之后才能确定哪些 bucket 已经删除
+	if err = db.constructMemTable(); err == nil {
+		err = db.loadBuckets()
+	}
+	if err != nil {
+		db.closeFiles()
+		db.closeIndex()
+		db.unlockDir()
+		return nil, corrupted(err)
 	}
-	return db
+	if opts.ExpireSweepInterval > 0 && !opts.ReadOnly {
+		db.startSweeper(opts.ExpireSweepInterval)
+	}
+	if opts.SyncPolicy.Mode == SyncInterval && !opts.ReadOnly {
+		db.startSyncer(opts.SyncPolicy.Interval)
+	}
+	return db, nil
 }
 func (db *Db) Open(filename string) error {
 	return nil
 }
-func (db *Db) Close() {
-	db.opts = nil
+
+// Close 关闭数据文件并释放目录锁
+func (db *Db) Close() error {
+	db.stopSweeper()
+	db.stopSyncer()
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mu.Unlock()
+
+	// 合并期间仍然在读取旧文件 等待合并结束之后再关闭
+	db.mergeWg.Wait()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var errs []error
+	errs = append(errs, db.flushIndex())
+	if db.activeFiles != nil && !db.opts.ReadOnly {
+		errs = append(errs, db.activeFiles.Sync())
+	}
+	errs = append(errs, db.closeFiles())
+	errs = append(errs, db.unlockDir())
+	errs = append(errs, db.closeIndex())
+	return errors.Join(errs...)
+}
+
+// 关闭所有打开的数据文件
+func (db *Db) closeFiles() error {
+	var errs []error
+	if db.activeFiles != nil {
+		errs = append(errs, db.activeFiles.Close())
+	}
+	for _, w := range db.olderFiles {
+		errs = append(errs, w.Close())
+	}
 	db.activeFiles = nil
-	db.memTable.Clear()
-	db.mu = nil
 	db.olderFiles = nil
+	return errors.Join(errs...)
 }
-func (db *Db) Get(key []byte) ([]byte, bool) {
-	pos, ok := db.memTable.Get(key)
-	if !ok {
-		return nil, false
-	}
+
+// Get 读取数据 不存在或者已经过期时返回 ErrKeyNotFound
+func (db *Db) Get(key []byte) ([]byte, error) {
+	// 查找位置和读取需要在同一把锁内 否则合并可能在两者之间替换文件
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	val := db.getValueByPos(pos.(*wal.Pos))
-	return val, ok && !bytes.Equal(val, []byte(""))
+	if db.closed {
+		return nil, ErrClosed
+	}
+	pos, ok := db.memTable.Get(key)
+	// 过期的key对外不可见
+	if !ok || pos.(*wal.Pos).Expired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return db.getValueByPos(pos.(*wal.Pos))
 }
-func (db *Db) getValueByPos(pos *wal.Pos) []byte {
+
+// 空的 value 是一个非 nil 的空切片
+func (db *Db) getValueByPos(pos *wal.Pos) ([]byte, error) {
+	_, val, err := db.getRecordByPos(pos)
+	return val, err
+}
+func (db *Db) getRecordByPos(pos *wal.Pos) ([]byte, []byte, error) {
+	if db.closed {
+		return nil, nil, ErrClosed
+	}
 	var w *wal.Wal
-	if db.activeFiles.FileId == pos.FileId {
+	if db.activeFiles != nil && db.activeFiles.FileId == pos.FileId {
 		w = db.activeFiles
 	} else {
 		w = db.olderFiles[pos.FileId]
 	}
+	return readRecord(w, pos)
+}
+func readValue(w *wal.Wal, pos *wal.Pos) ([]byte, error) {
+	_, val, err := readRecord(w, pos)
+	return val, err
+}
+func readRecord(w *wal.Wal, pos *wal.Pos) ([]byte, []byte, error) {
+	// 索引指向了不存在的文件
 	if w == nil {
-		return nil
+		return nil, nil, fmt.Errorf("%w: data file %d not found", ErrCorrupted, pos.FileId)
+	}
+	key, val, err := w.ReadBuf(pos.Offset, pos.Length)
+	if errors.Is(err, wal.ErrClosed) {
+		return nil, nil, ErrClosed
 	}
-	_, val, err := w.ReadBuf(pos.Offset, pos.Length)
 	if err != nil {
-		return nil
+		return nil, nil, corrupted(fmt.Errorf("file %d offset %d: %w", pos.FileId, pos.Offset, err))
 	}
-	return val
+	return key, val, nil
+}
+
+// 记录或者文件头损坏的错误同时匹配 ErrCorrupted
+func corrupted(err error) error {
+	switch {
+	case errors.Is(err, ErrCorrupted):
+		return err
+	case errors.Is(err, wal.ErrCorruptRecord), errors.Is(err, wal.ErrBadFileHeader), errors.Is(err, memtable.ErrIndexCorrupted):
+		return fmt.Errorf("%w: %w", ErrCorrupted, err)
+	}
+	return err
 }
 func (db *Db) checkOverFlow() bool {
 	return db.opts.MaxFileSize <= db.activeFiles.Size()
 }
 func (db *Db) Put(key []byte, value []byte) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return db.put(key, value, 0, nil)
+}
+
+// PutWithOptions 写入数据 wo.Sync 为 true 时等待落盘之后再返回
+func (db *Db) PutWithOptions(key []byte, value []byte, wo *WriteOptions) error {
+	return db.put(key, value, 0, wo)
+}
+func (db *Db) put(key []byte, value []byte, expireAt int64, wo *WriteOptions) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	return db.update(wo, func() error {
+		return db.putLocked(key, value, expireAt)
+	})
+}
+
+// 写入一条记录并更新索引 调用方需要持有写锁
+func (db *Db) putLocked(key []byte, value []byte, expireAt int64) error {
+	return db.writeTo(defaultBucket, &wal.Record{Type: wal.RecordPut, Codec: db.opts.Compression.codec(value), Key: key, Value: value, ExpireAt: expireAt})
+}
+func (db *Db) Delete(key []byte) error {
+	return db.DeleteWithOptions(key, nil)
+}
+
+// DeleteWithOptions 删除数据 wo.Sync 为 true 时等待落盘之后再返回
+func (db *Db) DeleteWithOptions(key []byte, wo *WriteOptions) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	return db.update(wo, func() error {
+		return db.deleteLocked(key)
+	})
+}
+
+// 写入墓碑并删除索引 调用方需要持有写锁
+func (db *Db) deleteLocked(key []byte) error {
+	return db.writeTo(defaultBucket, &wal.Record{Type: wal.RecordDelete, Key: key})
+}
 
+// 写入记录并更新所属 bucket 的索引 调用方需要持有写锁
+func (db *Db) writeTo(bucket uint32, r *wal.Record) error {
+	table := db.table(bucket)
+	if table == nil {
+		return ErrBucketNotFound
+	}
+	r.Bucket = bucket
+	pos, err := db.appendRecord(r)
+	if err != nil {
+		return err
+	}
+	if bucket == defaultBucket {
+		db.saveVersion(r.Key, pos.Seq)
+	}
+	wal.ApplyRecord(table, r, pos) //存储进入内存
+	return db.indexErr()
+}
+
+// 追加写入一条记录 调用方需要持有写锁
+func (db *Db) appendRecord(r *wal.Record) (*wal.Pos, error) {
 	// 如果数据溢出 开辟新的
 	if db.checkOverFlow() {
 		if err := db.newActiveFile(); err != nil {
-			return err
+			return nil, err
 		}
 	}
-
-	pos, err := db.activeFiles.Write(key, value)
+	pos, err := db.activeFiles.WriteRecord(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.memTable.Put(key, pos) //存储进入内存
-	return nil
+	db.seq++
+	pos.Seq = db.seq
+	db.unsynced.Add(int64(pos.Length))
+	db.addHint(r, pos)
+	return pos, nil
 }
-func (db *Db) Delete(key []byte) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	_, err := db.activeFiles.Write(key, nil)
+
+// 记录活跃文件中已经提交的记录 调用方需要持有写锁
+func (db *Db) addHint(r *wal.Record, pos *wal.Pos) {
+	db.hints = append(db.hints, &wal.Hint{Key: bytes.Clone(r.Key), Pos: pos, Deleted: r.Type == wal.RecordDelete, Bucket: r.Bucket})
+}
+func (db *Db) constructMemTable() error {
+	merged, err := recoverMerge(db.opts.DirPath, db.opts.ReadOnly)
 	if err != nil {
 		return err
 	}
-	db.memTable.Delete(key)
-	return nil
-}
-func (db *Db) constructMemTable() error {
 	entries, err := os.ReadDir(db.opts.DirPath)
 	if err != nil {
 		return err
@@ -158,23 +384,62 @@ func (db *Db) constructMemTable() error {
 		if entry.IsDir() {
 			continue
 		}
-		if !strings.HasSuffix(entry.Name(), ".wal") {
+		// 跳过不是数据文件的文件 例如 backup.wal
+		fileId, ok := walFileMemTableIndex(entry.Name())
+		if !ok {
 			continue
 		}
-		fileIds = append(fileIds, walFileMemTableIndex(entry.Name()))
+		fileIds = append(fileIds, fileId)
+	}
+	// 持久化的索引只需要回放检查点之后的记录 启动时完成的合并替换了数据文件 需要重建索引
+	var cp *checkpoint
+	if !merged {
+		cp = db.indexCheckpoint(fileIds)
+	}
+	if cp == nil {
+		if err := db.resetIndex(); err != nil {
+			return err
+		}
 	}
 	if len(fileIds) == 0 {
+		// 只读模式下不创建数据文件
+		if db.opts.ReadOnly {
+			return nil
+		}
 		return db.newActiveFile()
 	}
-	return db.restoreMemTable(fileIds)
+	if cp != nil {
+		err = db.restoreFromCheckpoint(fileIds, cp)
+	} else {
+		err = db.restoreMemTable(fileIds)
+	}
+	if err != nil {
+		return err
+	}
+	return db.sealLegacyFile()
+}
+
+// 旧格式的活跃文件不能继续追加 封存之后使用新格式的活跃文件
+// 活跃文件的密钥和当前密钥不同时同样封存 新的写入使用当前密钥
+// 切换活跃文件时会写回索引
+func (db *Db) sealLegacyFile() error {
+	if db.opts.ReadOnly || db.activeFiles.Version() == wal.FormatVersion && db.activeFiles.KeyId() == db.keyring.KeyId() {
+		return db.flushIndex()
+	}
+	return db.newActiveFile()
 }
-func walFileMemTableIndex(walFile string) int {
-	rawIndex := strings.TrimSuffix(walFile, wal.WalFileName)
+
+// 数据文件名中的编号 文件名不是 %08d.wal 时返回 false
+func walFileMemTableIndex(walFile string) (int, bool) {
+	rawIndex, ok := strings.CutSuffix(walFile, wal.WalFileName)
+	if !ok {
+		return 0, false
+	}
 	index, err := strconv.Atoi(rawIndex)
-	if err != nil {
-		panic(err)
+	if err != nil || index <= 0 || wal.GetWalPath(index) != walFile {
+		return 0, false
 	}
-	return index
+	return index, true
 }
 
 func (db *Db) restoreMemTable(fileIds []int) error {
@@ -183,49 +448,84 @@ func (db *Db) restoreMemTable(fileIds []int) error {
 	})
 
 	for idx, fileId := range fileIds {
-		walReader, err := wal.NewWal(db.opts.DirPath, fileId)
+		active := idx == len(fileIds)-1
+		walReader, err := db.openWal(fileId, active)
 		if err != nil {
 			return err
 		}
-		memTable := db.memTable
-		if err = walReader.Read(memTable); err != nil {
-			return err
-		}
-		if idx == len(fileIds)-1 {
+		if active {
+			// 活跃文件没有索引文件 需要完整扫描
+			if err = db.replayFile(walReader, 0, true); err != nil {
+				return err
+			}
+			db.seq = max(db.seq, walReader.MaxSeq)
 			db.activeFiles = walReader
 		} else {
-			db.olderFiles[fileId] = walReader
+			if err = db.loadSealedFile(walReader); err != nil {
+				return err
+			}
+			if err = db.addOlderFile(walReader); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
-func (db *Db) CloseAndMerge() error {
-	lastFileId := db.activeFiles.FileId
-	if err := db.newActiveFile(); err != nil {
-		return err
-	}
-	for iter := db.memTable.Iterator(); iter.Valid(); iter.Next() {
-		key, pos := iter.Curr()
-		val := db.getValueByPos(pos.(*wal.Pos))
-		if !bytes.Equal(val, []byte("")) {
-			if db.checkOverFlow() {
-				if err := db.newActiveFile(); err != nil {
-					return err
-				}
-			}
-			if _, err := db.activeFiles.Write(key, val); err != nil {
-				return err
-			}
+// 记录封存的文件 开启映射时只读映射整个文件
+func (db *Db) addOlderFile(w *wal.Wal) error {
+	if db.opts.MmapSealed {
+		if err := w.Mmap(); err != nil && !errors.Is(err, wal.ErrMmapUnsupported) {
+			return err
 		}
 	}
-	for _, oldFile := range db.olderFiles {
-		if oldFile.FileId <= lastFileId {
-			if err := oldFile.CloseAndDelete(); err != nil {
-				return err
-			}
+	db.olderFiles[w.FileId] = w
+	return nil
+}
+
+// 优先读取索引文件 索引文件缺失或者损坏时扫描数据文件并重新生成索引文件
+// 跳过模式打开时 活跃文件中可能留有已经报告过的损坏区域
+// 封存活跃文件时生成索引文件 写入时已经记录了索引项 不需要重新扫描
+// 从检查点恢复的活跃文件缺少检查点之前的索引项 仍然需要扫描
+func (db *Db) writeHint(w *wal.Wal) error {
+	hints := db.hints
+	if !db.hintsValid {
+		var err error
+		if hints, _, err = w.ScanHints(db.opts.RecoveryMode.scanMode(false)); err != nil {
+			return err
 		}
 	}
-	db.Close()
-	return nil
+	return wal.WriteHintFile(db.opts.DirPath, w.FileId, hints, db.keyring)
+}
+
+func (db *Db) loadSealedFile(w *wal.Wal) error {
+	ok, err := wal.ReadHintFile(db.opts.DirPath, w.FileId, db.keyring, func(h *wal.Hint) {
+		wal.ApplyHint(db.replayTable(h.Bucket), h)
+		db.seq = max(db.seq, h.Pos.Seq)
+	})
+	if ok && err == nil {
+		return nil
+	}
+	// 同一个文件按顺序重放是幂等的 读了一半的索引不影响结果
+	hints, corruptions, err := w.ScanHints(db.opts.RecoveryMode.scanMode(false))
+	if err != nil {
+		return err
+	}
+	db.reportCorruptions(corruptions...)
+	for _, h := range hints {
+		wal.ApplyHint(db.replayTable(h.Bucket), h)
+	}
+	db.seq = max(db.seq, w.MaxSeq)
+	if db.opts.ReadOnly {
+		return nil
+	}
+	return wal.WriteHintFile(db.opts.DirPath, w.FileId, hints, db.keyring)
+}
+
+// CloseAndMerge 合并之后关闭数据库
+func (db *Db) CloseAndMerge() error {
+	if err := db.Merge(); err != nil {
+		return err
+	}
+	return db.Close()
 }
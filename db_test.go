@@ -1,14 +1,26 @@
 package bitcask
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/xia-Sang/bitcask/memtable"
 	"github.com/xia-Sang/bitcask/utils"
+	"github.com/xia-Sang/bitcask/wal"
 )
 
 func TestNew(t *testing.T) {
-	db := NewDb(NewOptions("./data"))
+	db := openDb(t, NewOptions("./data"))
+	defer db.Close()
 	for i := range 12 {
 		key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(12)
 		fmt.Printf("k:%s,v:%s\n", key, value)
@@ -20,15 +32,16 @@ func TestNew(t *testing.T) {
 	}
 	// for i := range 12 {
 	// 	key := utils.GenerateKey(i)
-	// 	val, ok := db.Get(key)
+	// 	val, ok := get(t, db, key)
 	// 	t.Log(string(key), string(val), ok)
 	// }
-	for _, v := range db.ListKeys() {
+	for _, v := range listKeys(t, db) {
 		fmt.Printf("(%s:%s)\n", v.Key, v.Value)
 	}
 }
 func TestNew1(t *testing.T) {
-	db := NewDb(NewOptions("./data"))
+	db := openDb(t, NewOptions("./data"))
+	defer db.Close()
 	for i := range 120 {
 		key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(12)
 		fmt.Printf("k:%s,v:%s\n", key, value)
@@ -45,12 +58,13 @@ func TestNew1(t *testing.T) {
 	}
 	for i := range 12 {
 		key := utils.GenerateKey(i)
-		val, ok := db.Get(key)
+		val, ok := get(t, db, key)
 		t.Log(string(key), string(val), ok)
 	}
 }
 func TestNew2(t *testing.T) {
-	db := NewDb(NewOptions("./data"))
+	db := openDb(t, NewOptions("./data"))
+	defer db.Close()
 
 	for iter := db.memTable.Iterator(); iter.Valid(); iter.Next() {
 		key, val := iter.Curr()
@@ -58,12 +72,12 @@ func TestNew2(t *testing.T) {
 	}
 	for i := range 120 {
 		key := utils.GenerateKey(i)
-		val, ok := db.Get(key)
+		val, ok := get(t, db, key)
 		t.Log(string(key), string(val), ok)
 	}
 }
 func TestNew3(t *testing.T) {
-	db := NewDb(NewOptions("./data"))
+	db := openDb(t, NewOptions("./data"))
 
 	for iter := db.memTable.Iterator(); iter.Valid(); iter.Next() {
 		key, val := iter.Curr()
@@ -71,9 +85,2230 @@ func TestNew3(t *testing.T) {
 	}
 	for i := range 120 {
 		key := utils.GenerateKey(i)
-		val, ok := db.Get(key)
+		val, ok := get(t, db, key)
 		t.Log(string(key), string(val), ok)
 	}
 	err := db.CloseAndMerge()
 	t.Log(err)
 }
+
+// 批量写入 重启之后依然可见
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir))
+	if err := db.Put([]byte("a"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	batch := NewWriteBatch()
+	for i := range 20 {
+		batch.Put(utils.GenerateKey(i), utils.GenerateRandomBytes(12))
+	}
+	batch.Delete([]byte("a"))
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	seq := db.seq
+
+	db.Close()
+	db = openDb(t, NewOptions(dir))
+	defer db.Close()
+	for i := range 20 {
+		if _, ok := get(t, db, utils.GenerateKey(i)); !ok {
+			t.Fatalf("key %d not found", i)
+		}
+	}
+	if _, ok := get(t, db, []byte("a")); ok {
+		t.Fatal("deleted key is visible")
+	}
+	if db.seq != seq {
+		t.Fatalf("seq %d != %d", db.seq, seq)
+	}
+}
+
+// 没有提交记录的批次在重启后被丢弃
+func TestWriteBatchUncommitted(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir))
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟批次写到一半崩溃
+	for _, key := range []string{"a", "b"} {
+		if _, err := db.activeFiles.WriteRecord(&wal.Record{Key: []byte(key), Value: []byte("2"), Seq: 7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	db = openDb(t, NewOptions(dir))
+	defer db.Close()
+	if val, ok := get(t, db, []byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("a=%s,%v", val, ok)
+	}
+	if _, ok := get(t, db, []byte("b")); ok {
+		t.Fatal("uncommitted key is visible")
+	}
+	if val, ok := get(t, db, []byte("c")); !ok || string(val) != "3" {
+		t.Fatalf("c=%s,%v", val, ok)
+	}
+}
+
+// 封存文件生成索引文件 重启时使用索引文件恢复
+func TestHintRestore(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	for i := range 100 {
+		if err := db.Put(utils.GenerateKey(i), utils.GenerateRandomBytes(12)); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			if err := db.Delete(utils.GenerateKey(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(db.olderFiles) == 0 {
+		t.Fatal("no sealed files")
+	}
+	for fileId := range db.olderFiles {
+		if _, err := os.Stat(filepath.Join(dir, wal.GetHintPath(fileId))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 删除一个索引文件 重启时重新生成
+	if err := os.Remove(filepath.Join(dir, wal.GetHintPath(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	db = openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	defer db.Close()
+	if _, err := os.Stat(filepath.Join(dir, wal.GetHintPath(1))); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 100 {
+		_, ok := get(t, db, utils.GenerateKey(i))
+		if ok != (i%3 != 0) {
+			t.Fatalf("key %d: %v", i, ok)
+		}
+	}
+}
+
+// 写入时记录的索引项和扫描数据文件的结果一致 包括重启之后回放的活跃文件和批量写入
+func TestHintAccumulated(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(512))
+	write := func(db *Db, from int) {
+		for i := from; i < from+60; i++ {
+			if err := db.Put(utils.GenerateKey(i%40), utils.GenerateRandomBytes(12)); err != nil {
+				t.Fatal(err)
+			}
+			if i%7 == 0 {
+				batch := NewWriteBatch()
+				batch.Put(utils.GenerateKey(i+1), []byte("batch"))
+				batch.Delete(utils.GenerateKey(i % 40))
+				if err := db.Write(batch); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	db := openDb(t, opts)
+	write(db, 0)
+	db.Close()
+	db = openDb(t, opts)
+	defer db.Close()
+	write(db, 60)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	write(db, 120)
+
+	for fileId, w := range db.olderFiles {
+		want, err := w.Hints()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []*wal.Hint
+		ok, err := wal.ReadHintFile(dir, fileId, db.keyring, func(h *wal.Hint) {
+			got = append(got, h)
+		})
+		if !ok || err != nil || len(got) != len(want) {
+			t.Fatalf("file %d: %d hints want %d %v", fileId, len(got), len(want), err)
+		}
+		for i, h := range got {
+			// 扫描数据文件只能恢复批次的序号 其他写入的序号只在索引文件中
+			pos := *h.Pos
+			if want[i].Pos.Seq == 0 {
+				pos.Seq = 0
+			}
+			if !bytes.Equal(h.Key, want[i].Key) || h.Deleted != want[i].Deleted || pos != *want[i].Pos {
+				t.Fatalf("file %d hint %d: %+v want %+v", fileId, i, h.Pos, want[i].Pos)
+			}
+		}
+	}
+}
+
+// 合并期间继续读写
+func TestMergeOnline(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(512)))
+	expect := map[string]string{}
+	for round := range 5 {
+		for i := range 100 {
+			key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(12)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expect[string(key)] = string(value)
+			if i%7 == round {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expect, string(key))
+			}
+		}
+	}
+	before := len(db.olderFiles)
+
+	done := make(chan error)
+	go func() {
+		done <- db.Merge()
+	}()
+	for i := 100; i < 200; i++ {
+		key, value := utils.GenerateKey(i%120), utils.GenerateRandomBytes(12)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expect[string(key)] = string(value)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(db.olderFiles) >= before {
+		t.Fatalf("files %d -> %d", before, len(db.olderFiles))
+	}
+	check := func(db *Db) {
+		for i := range 120 {
+			key := utils.GenerateKey(i)
+			val, ok := get(t, db, key)
+			want, exist := expect[string(key)]
+			if ok != exist || string(val) != want {
+				t.Fatalf("%s: %s,%v want %s,%v", key, val, ok, want, exist)
+			}
+		}
+	}
+	check(db)
+	db.Close()
+	db = openDb(t, NewOptions(dir, WithMaxFileSize(512)))
+	defer db.Close()
+	check(db)
+}
+
+// 合并期间关闭 Close 等待合并结束 合并结果不再替换数据文件
+func TestMergeClose(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(256))
+	db := openDb(t, opts)
+	for i := range 100 {
+		if err := db.Put(utils.GenerateKey(i%30), utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	task, err := db.prepareMerge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close returned during merge")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.rewriteMerge(task); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.installMerge(task); !errors.Is(err, ErrClosed) {
+		t.Fatal(err)
+	}
+	db.mergeWg.Done()
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+
+	db = openDb(t, opts)
+	defer db.Close()
+	for i := 70; i < 100; i++ {
+		if val, ok := get(t, db, utils.GenerateKey(i%30)); !ok || !bytes.Equal(val, utils.GenerateKey(i)) {
+			t.Fatalf("%d: %s", i, val)
+		}
+	}
+}
+
+// 合并之后的文件使用新的编号 旧的位置不会指向其他的数据
+func TestMergeFileIds(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(256))
+	db := openDb(t, opts)
+	defer db.Close()
+	for i := range 100 {
+		if err := db.Put(utils.GenerateKey(i%30), utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mergeUpTo := db.activeFiles.FileId
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	for fileId := 1; fileId <= mergeUpTo; fileId++ {
+		if _, err := os.Stat(walPath(dir, fileId)); !os.IsNotExist(err) {
+			t.Fatalf("file %d not removed: %v", fileId, err)
+		}
+	}
+	for fileId, w := range db.olderFiles {
+		if fileId <= mergeUpTo || fileId >= db.activeFiles.FileId || w.FileId != fileId {
+			t.Fatalf("merged file %d, merged up to %d, active %d", fileId, mergeUpTo, db.activeFiles.FileId)
+		}
+	}
+}
+
+// 关闭压缩并开启加密之后合并 重写的数据比原来大 最后一个文件超过 MaxFileSize
+func TestMergeGrowingOutput(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(512), WithCompression(wal.CodecFlate, 0)))
+	expect := map[string][]byte{}
+	for i := range 200 {
+		key, value := utils.GenerateKey(i), bytes.Repeat([]byte{byte(i)}, 200)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expect[string(key)] = value
+	}
+	db.Close()
+
+	opts := NewOptions(dir, WithMaxFileSize(512), WithEncryptionKey(bytes.Repeat([]byte{1}, 32)))
+	db = openDb(t, opts)
+	files := len(db.olderFiles) + 1
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.olderFiles) != files {
+		t.Fatalf("%d merged files from %d", len(db.olderFiles), files)
+	}
+	check := func() {
+		t.Helper()
+		for key, want := range expect {
+			if val, ok := get(t, db, []byte(key)); !ok || !bytes.Equal(val, want) {
+				t.Fatalf("%x: %v", key, ok)
+			}
+		}
+	}
+	check()
+	// 之后的合并仍然可以完成
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	db.Close()
+	db = openDb(t, opts)
+	defer db.Close()
+	check()
+}
+
+// 合并过程中崩溃 重启时恢复
+func TestMergeRecover(t *testing.T) {
+	for _, finished := range []bool{false, true} {
+		dir := t.TempDir()
+		db := openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+		for i := range 100 {
+			if err := db.Put(utils.GenerateKey(i%30), utils.GenerateRandomBytes(12)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expect := map[string][]byte{}
+		for i := range 30 {
+			expect[string(utils.GenerateKey(i))], _ = get(t, db, utils.GenerateKey(i))
+		}
+		task, err := db.prepareMerge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.rewriteMerge(task); err != nil {
+			t.Fatal(err)
+		}
+		// 没有替换数据文件就崩溃
+		db.mergeWg.Done()
+		if !finished {
+			// 没有完成标记的合并会被丢弃
+			if err := os.Remove(filepath.Join(db.mergePath(), mergeFinName)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		db.Close()
+		db = openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+		defer db.Close()
+		if _, err := os.Stat(db.mergePath()); !os.IsNotExist(err) {
+			t.Fatal("merge dir not cleaned", err)
+		}
+		if finished && len(db.olderFiles) != task.merged {
+			t.Fatalf("files %d, merged %d", len(db.olderFiles), task.merged)
+		}
+		for key, want := range expect {
+			if val, ok := get(t, db, []byte(key)); !ok || !bytes.Equal(val, want) {
+				t.Fatalf("%s: %s != %s", key, val, want)
+			}
+		}
+	}
+}
+
+// 同一个目录只能被打开一次 只读模式可以同时打开
+func TestDirLock(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(NewOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(NewOptions(dir)); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expect ErrDatabaseLocked, got %v", err)
+	}
+	if _, err := Open(NewOptions(dir, WithReadOnly())); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expect ErrDatabaseLocked, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r1, err := Open(NewOptions(dir, WithReadOnly()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, err := Open(NewOptions(dir, WithReadOnly()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	if val, ok := get(t, r2, []byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("a=%s,%v", val, ok)
+	}
+	if err := r1.Put([]byte("b"), []byte("2")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expect ErrReadOnly, got %v", err)
+	}
+	if _, err := Open(NewOptions(dir)); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expect ErrDatabaseLocked, got %v", err)
+	}
+}
+
+// 只读模式不创建目录和文件 也不修改已有的文件
+func TestReadOnlyUntouched(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := Open(NewOptions(missing, WithReadOnly())); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatal("read-only open created the directory")
+	}
+
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	for i := range 30 {
+		if err := db.Put(utils.GenerateKey(i), utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	listDir := func() map[string]os.FileInfo {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos := map[string]os.FileInfo{}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos[entry.Name()] = info
+		}
+		return infos
+	}
+	before := listDir()
+	db = openDb(t, NewOptions(dir, WithReadOnly()))
+	// 只读打开同样持有目录锁
+	if _, err := Open(NewOptions(dir)); !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("expect ErrDatabaseLocked, got %v", err)
+	}
+	for i := range 30 {
+		if val, ok := get(t, db, utils.GenerateKey(i)); !ok || !bytes.Equal(val, utils.GenerateKey(i)) {
+			t.Fatalf("%d: %s", i, val)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after := listDir()
+	if len(after) != len(before) {
+		t.Fatalf("%d files before %d after", len(before), len(after))
+	}
+	for name, info := range before {
+		if a, ok := after[name]; !ok || a.Size() != info.Size() || !a.ModTime().Equal(info.ModTime()) {
+			t.Fatalf("%s modified", name)
+		}
+	}
+}
+
+// 过期的key不可见 重启之后过期时间依然有效
+func TestTTL(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	if err := db.PutWithTTL([]byte("short"), []byte("1"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL([]byte("long"), []byte("2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL([]byte("persist"), []byte("3"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("forever"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := db.TTL([]byte("long")); err != nil || ttl <= 59*time.Minute {
+		t.Fatalf("ttl %v,%v", ttl, err)
+	}
+	if ttl, err := db.TTL([]byte("forever")); err != nil || ttl != 0 {
+		t.Fatalf("ttl %v,%v", ttl, err)
+	}
+	if err := db.Persist([]byte("persist")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Persist([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expect ErrKeyNotFound, got %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	check := func(db *Db) {
+		if _, ok := get(t, db, []byte("short")); ok {
+			t.Fatal("expired key is visible")
+		}
+		if _, err := db.TTL([]byte("short")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expired key has ttl: %v", err)
+		}
+		for _, key := range []string{"long", "persist", "forever"} {
+			if _, ok := get(t, db, []byte(key)); !ok {
+				t.Fatalf("%s not found", key)
+			}
+		}
+		cnt := 0
+		db.Fold(func(key, value []byte) bool {
+			cnt++
+			return true
+		})
+		if cnt != 3 || len(listKeys(t, db)) != 3 {
+			t.Fatalf("fold %d, list %d", cnt, len(listKeys(t, db)))
+		}
+	}
+	check(db)
+	// 合并之后过期的key被清理
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db.memTable.Get([]byte("short")); ok {
+		t.Fatal("expired key not dropped by merge")
+	}
+	check(db)
+	db.Close()
+	db = openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	defer db.Close()
+	check(db)
+}
+
+// 后台清理过期的key 超过 sweepChunk 时分批写入墓碑
+func TestExpireSweeper(t *testing.T) {
+	db := openDb(t, NewOptions(t.TempDir(), WithExpireSweepInterval(10*time.Millisecond)))
+	defer db.Close()
+	for i := range sweepChunk + 10 {
+		if err := db.PutWithTTL(utils.GenerateKey(i), utils.GenerateRandomBytes(12), 20*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if iter := db.memTable.Iterator(); iter.Valid() {
+		key, _ := iter.Curr()
+		t.Fatalf("%s is not swept", key)
+	}
+}
+
+// 快照不受之后写入和合并的影响
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	defer db.Close()
+	expect := map[string]string{}
+	for i := range 50 {
+		key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(12)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expect[string(key)] = string(value)
+	}
+	snap := db.NewSnapshot()
+	for i := range 50 {
+		if i%2 == 0 {
+			if err := db.Delete(utils.GenerateKey(i)); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := db.Put(utils.GenerateKey(i), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put([]byte("later"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	files := len(db.olderFiles)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if db.pendingMerge == nil || len(db.olderFiles) != files+1 {
+		t.Fatal("merge applied while snapshot is open")
+	}
+
+	got := map[string]string{}
+	snap.Fold(func(key, value []byte) bool {
+		got[string(key)] = string(value)
+		return true
+	})
+	if len(got) != len(expect) {
+		t.Fatalf("snapshot has %d keys, want %d", len(got), len(expect))
+	}
+	for key, want := range expect {
+		if got[key] != want {
+			t.Fatalf("%s: %s != %s", key, got[key], want)
+		}
+		if val, ok := get(t, snap, []byte(key)); !ok || string(val) != want {
+			t.Fatalf("%s: %s != %s", key, val, want)
+		}
+	}
+	if _, ok := get(t, snap, []byte("later")); ok {
+		t.Fatal("snapshot sees later write")
+	}
+
+	if err := snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if db.pendingMerge != nil || len(db.olderFiles) >= files {
+		t.Fatal("merge not applied after release")
+	}
+	for i := range 50 {
+		val, ok := get(t, db, utils.GenerateKey(i))
+		if ok != (i%2 == 1) || (ok && string(val) != "new") {
+			t.Fatalf("key %d: %s,%v", i, val, ok)
+		}
+	}
+}
+
+// 合并之后重启 序号从索引文件中恢复 不会回退
+func TestSeqAfterMergeRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(256))
+	db := openDb(t, opts)
+	for i := range 30 {
+		if err := db.Put(utils.GenerateKey(i), utils.GenerateRandomBytes(12)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := NewWriteBatch()
+	for i := range 5 {
+		batch.Put(utils.GenerateKey(i), []byte("batch"))
+	}
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	snap := db.NewSnapshot()
+	seq := snap.Seq()
+	if err := snap.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDb(t, opts)
+	defer db.Close()
+	if cur, ok := db.memTable.Get(utils.GenerateKey(29)); !ok || cur.(*wal.Pos).Seq == 0 {
+		t.Fatal("seq not restored from hint file")
+	}
+	snap = db.NewSnapshot()
+	defer snap.Release()
+	if snap.Seq() < seq {
+		t.Fatalf("seq went backwards: %d < %d", snap.Seq(), seq)
+	}
+	key := utils.GenerateKey(0)
+	if err := db.CompareAndSwap(key, []byte("batch"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := get(t, snap, key); !ok || string(val) != "batch" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+	if val, ok := get(t, db, key); !ok || string(val) != "new" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+	for i := 1; i < 30; i++ {
+		if _, ok := get(t, snap, utils.GenerateKey(i)); !ok {
+			t.Fatalf("key %d not visible in snapshot", i)
+		}
+	}
+}
+
+// 多个快照固定在不同的序号 只保存被覆盖的版本
+func TestSnapshotVersions(t *testing.T) {
+	for _, typ := range []memtable.IndexType{memtable.BTreeIndex, memtable.DiskBTreeIndex} {
+		t.Run(typ.String(), func(t *testing.T) {
+			db := openDb(t, NewOptions(t.TempDir(), WithIndexType(typ)))
+			defer db.Close()
+			put := func(key, value string) {
+				if err := db.Put([]byte(key), []byte(value)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			collect := func(snap *Snapshot, reverse bool) string {
+				var kvs []string
+				it := snap.NewIterator(IteratorOptions{Reverse: reverse})
+				defer it.Close()
+				for ; it.Valid(); it.Next() {
+					kvs = append(kvs, string(it.Key())+"="+string(value(t, it)))
+				}
+				return strings.Join(kvs, " ")
+			}
+			put("a", "1")
+			put("b", "1")
+			put("c", "1")
+			s1 := db.NewSnapshot()
+			put("a", "2")
+			if err := db.Delete([]byte("b")); err != nil {
+				t.Fatal(err)
+			}
+			put("d", "2")
+			s2 := db.NewSnapshot()
+			batch := NewWriteBatch()
+			batch.Put([]byte("a"), []byte("3"))
+			batch.Put([]byte("b"), []byte("3"))
+			batch.Delete([]byte("c"))
+			if err := db.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			put("e", "3")
+
+			if got := collect(s1, false); got != "a=1 b=1 c=1" {
+				t.Fatal(got)
+			}
+			if got := collect(s1, true); got != "c=1 b=1 a=1" {
+				t.Fatal(got)
+			}
+			if got := collect(s2, false); got != "a=2 c=1 d=2" {
+				t.Fatal(got)
+			}
+			if got := collect(s2, true); got != "d=2 c=1 a=2" {
+				t.Fatal(got)
+			}
+			if _, ok := get(t, s2, []byte("b")); ok {
+				t.Fatal("deleted key visible")
+			}
+			// 只保存 a b c 被覆盖的版本
+			var saved []string
+			for it := db.versions.Iterator(); it.Valid(); it.Next() {
+				key, _ := it.Curr()
+				saved = append(saved, string(key))
+			}
+			if strings.Join(saved, "") != "abc" {
+				t.Fatalf("versions %v", saved)
+			}
+			if err := s1.Release(); err != nil {
+				t.Fatal(err)
+			}
+			if got := collect(s2, false); got != "a=2 c=1 d=2" {
+				t.Fatal(got)
+			}
+			if _, err := s1.Get([]byte("a")); !errors.Is(err, ErrClosed) {
+				t.Fatal(err)
+			}
+			if err := s2.Release(); err != nil {
+				t.Fatal(err)
+			}
+			if db.versions != nil || db.snapshots != nil {
+				t.Fatal("versions kept after release")
+			}
+		})
+	}
+}
+
+// 范围和前缀迭代器
+func TestIterator(t *testing.T) {
+	db := openDb(t, NewOptions(t.TempDir()))
+	defer db.Close()
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := range 5 {
+			key := fmt.Sprintf("%s/%d", prefix, i)
+			if err := db.Put([]byte(key), []byte("v"+key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.PutWithTTL([]byte("b/25"), []byte("expired"), time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	collect := func(it *Iterator) (keys []string) {
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			if string(value(t, it)) != "v"+string(it.Key()) {
+				t.Fatalf("%s: %s", it.Key(), value(t, it))
+			}
+			keys = append(keys, string(it.Key()))
+		}
+		return
+	}
+	cases := []struct {
+		opts IteratorOptions
+		want string
+	}{
+		{IteratorOptions{Prefix: []byte("b")}, "b/0 b/1 b/2 b/3 b/4"},
+		{IteratorOptions{Prefix: []byte("b"), Reverse: true}, "b/4 b/3 b/2 b/1 b/0"},
+		{IteratorOptions{Start: []byte("a/3"), End: []byte("b/2")}, "a/3 a/4 b/0 b/1"},
+		{IteratorOptions{Start: []byte("a/3"), End: []byte("b/2"), Reverse: true}, "b/1 b/0 a/4 a/3"},
+		{IteratorOptions{Prefix: []byte("c"), Start: []byte("c/3")}, "c/3 c/4"},
+		{IteratorOptions{Start: []byte("c/3"), Reverse: true}, "c/4 c/3"},
+		{IteratorOptions{Prefix: []byte("d")}, ""},
+	}
+	for _, c := range cases {
+		if got := strings.Join(collect(db.NewIterator(c.opts)), " "); got != c.want {
+			t.Fatalf("%+v: %s != %s", c.opts, got, c.want)
+		}
+	}
+
+	it := db.NewIterator(IteratorOptions{Prefix: []byte("b")})
+	it.Seek([]byte("b/25"))
+	if got := strings.Join(collect(it), " "); got != "b/3 b/4" {
+		t.Fatal(got)
+	}
+	it = db.NewIterator(IteratorOptions{Prefix: []byte("b"), Reverse: true})
+	it.Seek([]byte("b/25"))
+	if got := strings.Join(collect(it), " "); got != "b/2 b/1 b/0" {
+		t.Fatal(got)
+	}
+	it = db.NewIterator(IteratorOptions{Reverse: true})
+	it.Seek([]byte("z"))
+	if !it.Valid() || string(it.Key()) != "c/4" {
+		t.Fatal("reverse seek past the end")
+	}
+}
+
+// 迭代器创建之后合并移动了数据 读取时重新查找位置
+func TestIteratorAfterMerge(t *testing.T) {
+	db := openDb(t, NewOptions(t.TempDir(), WithMaxFileSize(256)))
+	defer db.Close()
+	for i := range 100 {
+		if err := db.Put(utils.GenerateKey(i%30), utils.GenerateKey(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	it := db.NewIterator(IteratorOptions{})
+	defer it.Close()
+	if err := db.Delete(utils.GenerateKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for ; it.Valid(); it.Next() {
+		val, err := it.Value()
+		if bytes.Equal(it.Key(), utils.GenerateKey(1)) {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("deleted key: %s %v", val, err)
+			}
+			continue
+		}
+		want, _ := get(t, db, it.Key())
+		if err != nil || !bytes.Equal(val, want) {
+			t.Fatalf("%s: %s want %s %v", it.Key(), val, want, err)
+		}
+		count++
+	}
+	if count != 29 {
+		t.Fatal(count)
+	}
+}
+
+// 不同的索引实现行为一致
+func TestIndexType(t *testing.T) {
+	for _, typ := range []memtable.IndexType{memtable.BTreeIndex, memtable.SkipListIndex, memtable.ArtIndex} {
+		t.Run(typ.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := NewOptions(dir, WithMaxFileSize(512), WithIndexType(typ))
+			db := openDb(t, opts)
+			expect := map[string]string{}
+			for idx, i := range utils.RandomIntsInRange(300, 0, 100) {
+				key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(12)
+				if idx%4 == 0 {
+					if err := db.Delete(key); err != nil {
+						t.Fatal(err)
+					}
+					delete(expect, string(key))
+					continue
+				}
+				if err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				expect[string(key)] = string(value)
+			}
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			db = openDb(t, opts)
+			defer db.Close()
+			var last []byte
+			count := 0
+			for it := db.NewIterator(IteratorOptions{}); it.Valid(); it.Next() {
+				if last != nil && bytes.Compare(it.Key(), last) <= 0 {
+					t.Fatalf("%s after %s", it.Key(), last)
+				}
+				last = it.Key()
+				if want := expect[string(it.Key())]; string(value(t, it)) != want {
+					t.Fatalf("%s: %s want %s", it.Key(), value(t, it), want)
+				}
+				count++
+			}
+			if count != len(expect) {
+				t.Fatalf("iterated %d keys, want %d", count, len(expect))
+			}
+		})
+	}
+	if _, err := Open(&Options{DirPath: t.TempDir(), IndexType: 100}); !errors.Is(err, memtable.ErrUnknownIndexType) {
+		t.Fatal(err)
+	}
+}
+
+// 打开数据库 失败时终止测试
+func openDb(t testing.TB, opts *Options) *Db {
+	t.Helper()
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// 读取数据 不存在时返回 false 其他错误终止测试
+func get(t testing.TB, db interface{ Get([]byte) ([]byte, error) }, key []byte) ([]byte, bool) {
+	t.Helper()
+	val, err := db.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val, true
+}
+func listKeys(t testing.TB, db *Db) []*Data {
+	t.Helper()
+	ans, err := db.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ans
+}
+func value(t testing.TB, it *Iterator) []byte {
+	t.Helper()
+	val, err := it.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+// 模拟进程崩溃 不写回索引直接关闭文件
+func crashDb(t *testing.T, db *Db) {
+	t.Helper()
+	db.stopSweeper()
+	db.activeFiles.Close()
+	for _, w := range db.olderFiles {
+		w.Close()
+	}
+	if index, ok := db.persistentIndex(); ok {
+		index.Close()
+	}
+	if err := db.unlockDir(); err != nil {
+		t.Fatal(err)
+	}
+	db.closed = true
+}
+
+// 磁盘索引 重启时不需要扫描检查点之前的数据文件
+func TestDiskIndex(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(1024), WithIndexType(memtable.DiskBTreeIndex))
+	db := openDb(t, opts)
+	expect := map[string]string{}
+	check := func(db *Db) {
+		t.Helper()
+		for i := range 600 {
+			key := utils.GenerateKey(i)
+			val, ok := get(t, db, key)
+			want, exist := expect[string(key)]
+			if ok != exist || string(val) != want {
+				t.Fatalf("%s: %s,%v want %s,%v", key, val, ok, want, exist)
+			}
+		}
+	}
+	write := func(db *Db, n int) {
+		t.Helper()
+		for idx, i := range utils.RandomIntsInRange(n, 0, 600) {
+			key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(16)
+			if idx%5 == 0 {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expect, string(key))
+				continue
+			}
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expect[string(key)] = string(value)
+		}
+	}
+	write(db, 2000)
+	if _, ok := db.memTable.(*memtable.DiskBTreeMemTable); !ok {
+		t.Fatalf("unexpected index %T", db.memTable)
+	}
+	if err := db.Put(bytes.Repeat([]byte("k"), memtable.DiskBTreeMaxKeySize+1), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// 删除封存文件的索引文件 使用检查点启动时不会重新生成
+	if err := os.Remove(filepath.Join(dir, wal.GetHintPath(1))); err != nil {
+		t.Fatal(err)
+	}
+	db = openDb(t, opts)
+	check(db)
+	if _, err := os.Stat(filepath.Join(dir, wal.GetHintPath(1))); !os.IsNotExist(err) {
+		t.Fatal("sealed file was scanned on startup", err)
+	}
+
+	// 崩溃之后回放检查点之后的记录
+	write(db, 500)
+	crashDb(t, db)
+	db = openDb(t, opts)
+	check(db)
+
+	// 合并之后索引指向新的文件
+	write(db, 500)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	write(db, 100)
+	crashDb(t, db)
+	db = openDb(t, opts)
+	check(db)
+	db.Close()
+
+	// 索引文件损坏时从数据文件重建
+	fp, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("broken"), 0); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	db = openDb(t, opts)
+	check(db)
+	db.Close()
+
+	// 只读模式直接使用索引文件
+	db = openDb(t, NewOptions(dir, WithReadOnly(), WithIndexType(memtable.DiskBTreeIndex)))
+	defer db.Close()
+	if _, ok := db.memTable.(*memtable.DiskBTreeMemTable); !ok {
+		t.Fatalf("unexpected index %T", db.memTable)
+	}
+	check(db)
+}
+
+// 映射封存的文件 合并和关闭时并发读取
+func TestMmapSealed(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(512), WithMmapSealed())
+	db := openDb(t, opts)
+	expect := map[string]string{}
+	for round := range 5 {
+		for i := range 100 {
+			key, value := utils.GenerateKey(i), utils.GenerateRandomBytes(12)
+			if err := db.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expect[string(key)] = string(value)
+			if i%7 == round {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expect, string(key))
+			}
+		}
+	}
+	for _, w := range db.olderFiles {
+		if !w.Mapped() {
+			t.Fatalf("file %d not mapped", w.FileId)
+		}
+	}
+	check := func(db *Db) {
+		for i := range 100 {
+			key := utils.GenerateKey(i)
+			val, ok := get(t, db, key)
+			want, exist := expect[string(key)]
+			if ok != exist || string(val) != want {
+				t.Errorf("%s: %s,%v want %s,%v", key, val, ok, want, exist)
+				return
+			}
+		}
+	}
+
+	// 合并替换文件时 读取不会访问已经解除的映射
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					check(db)
+				}
+			}
+		}()
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+	check(db)
+	for _, w := range db.olderFiles {
+		if !w.Mapped() {
+			t.Fatalf("merged file %d not mapped", w.FileId)
+		}
+	}
+	db.Close()
+
+	db = openDb(t, opts)
+	defer db.Close()
+	check(db)
+}
+
+// 落盘策略和组提交
+func TestSyncPolicy(t *testing.T) {
+	onDisk := func(db *Db) int64 {
+		stat, err := os.Stat(filepath.Join(db.opts.DirPath, wal.GetWalPath(db.activeFiles.FileId)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Size()
+	}
+	policies := map[string]SyncPolicy{
+		"never":    {Mode: SyncNever},
+		"always":   {Mode: SyncAlways},
+		"bytes":    {Mode: SyncBytes, Bytes: 256},
+		"interval": {Mode: SyncInterval, Interval: time.Millisecond},
+	}
+	for name, policy := range policies {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := NewOptions(dir, WithMaxFileSize(1<<20), WithSyncPolicy(policy))
+			db := openDb(t, opts)
+			if err := db.Put([]byte("k"), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+			switch policy.Mode {
+			case SyncNever, SyncBytes:
+				// 记录还在写缓冲区中
+				if onDisk(db) != 0 {
+					t.Fatal("record written without sync")
+				}
+			case SyncAlways:
+				if onDisk(db) != int64(db.activeFiles.Offset) {
+					t.Fatal("record not synced")
+				}
+			}
+			// 单次写入要求落盘
+			if err := db.PutWithOptions([]byte("sync"), []byte("v"), &WriteOptions{Sync: true}); err != nil {
+				t.Fatal(err)
+			}
+			if onDisk(db) != int64(db.activeFiles.Offset) {
+				t.Fatal("record not synced")
+			}
+
+			var wg sync.WaitGroup
+			for g := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range 50 {
+						key := utils.GenerateKey(g*100 + i)
+						if err := db.PutWithOptions(key, key, &WriteOptions{Sync: i%5 == 0}); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if policy.Mode == SyncBytes && int64(db.activeFiles.Offset)-onDisk(db) >= policy.Bytes {
+				t.Fatalf("unsynced %d bytes", int64(db.activeFiles.Offset)-onDisk(db))
+			}
+			if err := db.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			if onDisk(db) != int64(db.activeFiles.Offset) {
+				t.Fatal("record not synced")
+			}
+			db.Close()
+
+			db = openDb(t, opts)
+			defer db.Close()
+			for g := range 8 {
+				for i := range 50 {
+					key := utils.GenerateKey(g*100 + i)
+					if val, ok := get(t, db, key); !ok || !bytes.Equal(val, key) {
+						t.Fatalf("%s: %s,%v", key, val, ok)
+					}
+				}
+			}
+		})
+	}
+	if _, err := Open(&Options{DirPath: t.TempDir(), SyncPolicy: SyncPolicy{Mode: SyncBytes}}); err == nil {
+		t.Fatal("invalid sync policy")
+	}
+}
+
+// 并发等待落盘的写入共享一次同步
+func TestGroupCommit(t *testing.T) {
+	g := newGroupCommit()
+	var calls atomic.Int32
+	syncFn := func() error {
+		calls.Add(1)
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}
+	var wg sync.WaitGroup
+	for range 32 {
+		ticket := g.issue()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := g.wait(ticket, syncFn); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n == 0 || n >= 32 {
+		t.Fatalf("%d syncs for 32 writes", n)
+	}
+
+	// 同步失败时返回错误 之后的等待者重新同步
+	ticket := g.issue()
+	if err := g.wait(ticket, func() error { return errors.New("sync failed") }); err == nil {
+		t.Fatal("expect error")
+	}
+	if err := g.wait(ticket, syncFn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 打开旧格式的数据目录 旧文件只读 新的写入使用新格式
+func TestLegacyFormat(t *testing.T) {
+	for name, version := range map[string]uint32{"v0": 0} {
+		t.Run(name, func(t *testing.T) {
+			testOldFormat(t, filepath.Join("testdata", name), version)
+		})
+	}
+}
+func testOldFormat(t *testing.T, src string, version uint32) {
+	dir := copyDir(t, src)
+	expect := map[string]string{}
+	for i := range 40 {
+		if i%5 != 0 {
+			expect[fmt.Sprintf("key-%02d", i)] = fmt.Sprintf("value-%02d", i)
+		}
+	}
+	expect["key-01"] = "batch-01"
+	delete(expect, "key-02")
+	check := func(db *Db) {
+		t.Helper()
+		for i := range 41 {
+			key := fmt.Sprintf("key-%02d", i)
+			val, ok := get(t, db, []byte(key))
+			want, exist := expect[key]
+			if ok != exist || string(val) != want {
+				t.Fatalf("%s: %s,%v want %s,%v", key, val, ok, want, exist)
+			}
+		}
+	}
+
+	// 只读模式直接读取旧文件
+	db := openDb(t, NewOptions(dir, WithReadOnly()))
+	check(db)
+	db.Close()
+
+	opts := NewOptions(dir, WithMaxFileSize(512))
+	db = openDb(t, opts)
+	check(db)
+	if db.activeFiles.Version() != wal.FormatVersion || db.olderFiles[2].Version() != version {
+		t.Fatalf("active %d older %d", db.activeFiles.Version(), db.olderFiles[2].Version())
+	}
+	if err := db.Put([]byte("key-40"), []byte("value-40")); err != nil {
+		t.Fatal(err)
+	}
+	expect["key-40"] = "value-40"
+	db.Close()
+
+	db = openDb(t, opts)
+	check(db)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	for _, w := range db.olderFiles {
+		if w.Version() != wal.FormatVersion {
+			t.Fatalf("file %d version %d after merge", w.FileId, w.Version())
+		}
+	}
+	db.Close()
+	db = openDb(t, opts)
+	defer db.Close()
+	check(db)
+}
+
+// 没有文件头的文件第一条记录无法解析时拒绝打开 不截断文件
+func TestLegacyUnrecognized(t *testing.T) {
+	dir := copyDir(t, filepath.Join("testdata", "v0"))
+	path := walPath(dir, 3)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[8] ^= 0xff
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []RecoveryMode{RecoveryTruncate, RecoverySkip} {
+		opts := NewOptions(dir)
+		opts.RecoveryMode = mode
+		if _, err := Open(opts); !errors.Is(err, ErrCorrupted) {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, buf) {
+			t.Fatalf("mode %d: file changed to %d bytes %v", mode, len(got), err)
+		}
+	}
+}
+
+// 空的 value 和删除是不同的 重启和合并之后仍然可以区分
+func TestEmptyValue(t *testing.T) {
+	for name, mmap := range map[string]bool{"pread": false, "mmap": true} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := NewOptions(dir, WithMaxFileSize(256))
+			opts.MmapSealed = mmap
+			db := openDb(t, opts)
+			if err := db.Put([]byte("empty"), []byte{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put([]byte("nil"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutWithTTL([]byte("ttl"), nil, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Put([]byte("deleted"), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Delete([]byte("deleted")); err != nil {
+				t.Fatal(err)
+			}
+			batch := NewWriteBatch()
+			batch.Put([]byte("batch"), []byte{})
+			batch.Delete([]byte("nil-deleted"))
+			if err := db.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			// 后面的写入让上面的记录落在封存的文件中
+			for i := range 20 {
+				if err := db.Put(utils.GenerateKey(i), utils.GenerateRandomBytes(12)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			present := []string{"batch", "empty", "nil", "ttl"}
+			check := func(db *Db) {
+				t.Helper()
+				for _, key := range present {
+					val, ok := get(t, db, []byte(key))
+					if !ok || val == nil || len(val) != 0 {
+						t.Fatalf("%s: %q,%v", key, val, ok)
+					}
+				}
+				for _, key := range []string{"deleted", "nil-deleted"} {
+					if val, ok := get(t, db, []byte(key)); ok {
+						t.Fatalf("%s: %q", key, val)
+					}
+				}
+				var keys []string
+				for _, kv := range listKeys(t, db) {
+					if len(kv.Value) == 0 {
+						keys = append(keys, string(kv.Key))
+					}
+				}
+				if strings.Join(keys, ",") != strings.Join(present, ",") {
+					t.Fatalf("list keys %v", keys)
+				}
+				it := db.NewIterator(IteratorOptions{Prefix: []byte("empty")})
+				if !it.Valid() || value(t, it) == nil {
+					t.Fatal("iterator skipped empty value")
+				}
+				it.Close()
+				snap := db.NewSnapshot()
+				if val, ok := get(t, snap, []byte("empty")); !ok || val == nil {
+					t.Fatalf("snapshot: %q,%v", val, ok)
+				}
+				snap.Release()
+			}
+			check(db)
+			db.Close()
+
+			db = openDb(t, opts)
+			check(db)
+			if err := db.Merge(); err != nil {
+				t.Fatal(err)
+			}
+			check(db)
+			db.Close()
+
+			db = openDb(t, opts)
+			defer db.Close()
+			check(db)
+		})
+	}
+}
+
+// 不存在的key 损坏的数据和关闭的数据库返回不同的错误
+func TestErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(NewOptions(dir, WithRecoveryMode(-1))); err == nil {
+		t.Fatal("invalid options should fail to open")
+	}
+	opts := NewOptions(dir, WithMaxFileSize(256))
+	db := openDb(t, opts)
+	for i := range 20 {
+		if err := db.Put(utils.GenerateKey(i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expect ErrKeyNotFound, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(utils.GenerateKey(0)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if _, err := db.TTL(utils.GenerateKey(0)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if err := db.Put([]byte("a"), []byte("1")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+	if err := db.Merge(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expect ErrClosed, got %v", err)
+	}
+
+	// 索引文件完好 value 损坏只有读取时才能发现
+	db = openDb(t, opts)
+	pos, _ := db.memTable.Get(utils.GenerateKey(0))
+	db.Close()
+	p := pos.(*wal.Pos)
+	flipBit(t, walPath(dir, p.FileId), p.Offset+p.Length-1, 0)
+	db = openDb(t, opts)
+	defer db.Close()
+	if _, err := db.Get(utils.GenerateKey(0)); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expect ErrCorrupted, got %v", err)
+	}
+	if _, err := db.ListKeys(); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expect ErrCorrupted, got %v", err)
+	}
+	if val, ok := get(t, db, utils.GenerateKey(1)); !ok || string(val) != "value" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+}
+
+// 压缩之后数据文件变小 合并时按照新的配置重新压缩
+func TestCompression(t *testing.T) {
+	value := func(i int) []byte {
+		if i%4 == 0 {
+			return []byte(fmt.Sprintf("small-%d", i))
+		}
+		var b strings.Builder
+		b.WriteString(`{"items":[`)
+		for j := range 8 {
+			fmt.Fprintf(&b, `{"id":%d,"name":"user-%d","status":"active","tags":["alpha","beta"]},`, i*10+j, i)
+		}
+		b.WriteString(`{}]}`)
+		return []byte(b.String())
+	}
+	dataSize := func(db *Db) (n int64) {
+		for _, w := range db.olderFiles {
+			n += w.Size()
+		}
+		return n + db.activeFiles.Size()
+	}
+	plain := openDb(t, NewOptions(t.TempDir(), WithMaxFileSize(16<<10)))
+	defer plain.Close()
+
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(16<<10), WithCompression(wal.CodecSnappy, 64))
+	db := openDb(t, opts)
+	for i := range 200 {
+		for _, d := range []*Db{plain, db} {
+			if err := d.Put(utils.GenerateKey(i), value(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	batch := NewWriteBatch()
+	batch.Put([]byte("batch"), value(1))
+	batch.Delete(utils.GenerateKey(1))
+	if err := db.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := dataSize(db), dataSize(plain); n*2 > m {
+		t.Fatalf("compressed %d plain %d", n, m)
+	}
+	check := func(db *Db) {
+		t.Helper()
+		for i := range 200 {
+			val, ok := get(t, db, utils.GenerateKey(i))
+			if i == 1 {
+				if ok {
+					t.Fatalf("deleted key: %s", val)
+				}
+				continue
+			}
+			if !ok || !bytes.Equal(val, value(i)) {
+				t.Fatalf("%d: %s,%v", i, val, ok)
+			}
+		}
+		if val, ok := get(t, db, []byte("batch")); !ok || !bytes.Equal(val, value(1)) {
+			t.Fatalf("batch: %s,%v", val, ok)
+		}
+	}
+	check(db)
+	db.Close()
+
+	// 换成 flate 之后合并 旧的数据被重新压缩
+	opts = NewOptions(dir, WithMaxFileSize(16<<10), WithCompression(wal.CodecFlate, 64), WithMmapSealed())
+	db = openDb(t, opts)
+	defer db.Close()
+	check(db)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	for _, w := range db.olderFiles {
+		if err := w.Fold(func(r *wal.Record, pos *wal.Pos) error {
+			if want := opts.Compression.codec(r.Value); r.Codec != want {
+				t.Fatalf("%s: codec %v want %v", r.Key, r.Codec, want)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 数据文件和索引文件加密 合并时换成当前密钥
+func TestEncryption(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	secret := func(i int) []byte {
+		return []byte(fmt.Sprintf("secret-value-%d", i))
+	}
+	check := func(db *Db, n int) {
+		t.Helper()
+		for i := range n {
+			val, ok := get(t, db, utils.GenerateKey(i))
+			if i == 0 {
+				if ok {
+					t.Fatalf("deleted key: %s", val)
+				}
+				continue
+			}
+			if !ok || !bytes.Equal(val, secret(i)) {
+				t.Fatalf("%d: %s,%v", i, val, ok)
+			}
+		}
+	}
+	put := func(db *Db, from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := db.Put(utils.GenerateKey(i), secret(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 明文的数据目录换成加密 旧文件仍然可以读取
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(1024)))
+	put(db, 0, 50)
+	db.Close()
+	db = openDb(t, NewOptions(dir, WithMaxFileSize(1024), WithEncryptionKey(key1)))
+	if db.activeFiles.KeyId() != wal.KeyId(key1) {
+		t.Fatalf("active key id %08x", db.activeFiles.KeyId())
+	}
+	put(db, 50, 100)
+	if err := db.Delete(utils.GenerateKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	check(db, 100)
+	db.Close()
+
+	for _, opts := range []*Options{
+		NewOptions(dir),
+		NewOptions(dir, WithEncryptionKey(key2)),
+	} {
+		if _, err := Open(opts); !errors.Is(err, ErrWrongKey) {
+			t.Fatal(err)
+		}
+	}
+
+	// 新密钥加上旧密钥打开 合并之后所有文件都使用新密钥
+	db = openDb(t, NewOptions(dir, WithMaxFileSize(1024), WithEncryptionKey(key2, key1)))
+	check(db, 100)
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check(db, 100)
+	files := []*wal.Wal{db.activeFiles}
+	for _, w := range db.olderFiles {
+		files = append(files, w)
+	}
+	for _, w := range files {
+		if w.KeyId() != wal.KeyId(key2) {
+			t.Fatalf("file %d key id %08x", w.FileId, w.KeyId())
+		}
+	}
+	db.Close()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		buf, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte("secret-value")) || bytes.Contains(buf, utils.GenerateKey(1)) {
+			t.Fatalf("%s contains plaintext", e.Name())
+		}
+	}
+	db = openDb(t, NewOptions(dir, WithEncryptionKey(key2)))
+	defer db.Close()
+	check(db, 100)
+
+	for _, opts := range []*Options{
+		NewOptions(t.TempDir(), WithEncryptionKey([]byte("short"))),
+		NewOptions(t.TempDir(), WithEncryptionKey(key1), WithIndexType(memtable.DiskBTreeIndex)),
+	} {
+		if _, err := Open(opts); err == nil {
+			t.Fatal("invalid options accepted")
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir))
+	key := []byte("lease")
+	if err := db.PutIfAbsent(key, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutIfAbsent(key, []byte("b")); !errors.Is(err, ErrConditionFailed) {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap(key, []byte("b"), []byte("c")); !errors.Is(err, ErrConditionFailed) {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap(key, []byte("a"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteIf(key, []byte("a")); !errors.Is(err, ErrConditionFailed) {
+		t.Fatal(err)
+	}
+	if val, ok := get(t, db, key); !ok || string(val) != "c" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+	if err := db.DeleteIf(key, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteIf(key, []byte("c")); !errors.Is(err, ErrConditionFailed) {
+		t.Fatal(err)
+	}
+	if _, ok := get(t, db, key); ok {
+		t.Fatal("deleted key exists")
+	}
+
+	// 空的 value 和不存在的 key 不同
+	empty := []byte("empty")
+	if err := db.Put(empty, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap(empty, nil, []byte("x")); !errors.Is(err, ErrConditionFailed) {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwap(empty, []byte{}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	// 过期的 key 视为不存在
+	ttl := []byte("ttl")
+	if err := db.PutWithTTL(ttl, []byte("old"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := db.PutIfAbsent(ttl, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompareAndSwapWithTTL(ttl, []byte("new"), []byte("expiring"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := db.TTL(ttl); err != nil || d <= 59*time.Minute {
+		t.Fatalf("ttl %v,%v", d, err)
+	}
+
+	// 并发的计数器 每次递增都基于读到的值
+	counter := []byte("counter")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				for {
+					old, err := db.Get(counter)
+					if errors.Is(err, ErrKeyNotFound) {
+						old = nil
+					} else if err != nil {
+						t.Error(err)
+						return
+					}
+					n, _ := strconv.Atoi(string(old))
+					err = db.CompareAndSwap(counter, old, []byte(strconv.Itoa(n+1)))
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConditionFailed) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	db.Close()
+
+	db = openDb(t, NewOptions(dir))
+	defer db.Close()
+	for k, want := range map[string]string{"counter": "800", "empty": "x", "ttl": "expiring"} {
+		if val, ok := get(t, db, []byte(k)); !ok || string(val) != want {
+			t.Fatalf("%s: %s,%v", k, val, ok)
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir, WithMaxFileSize(256)))
+	for _, k := range []string{"x", "y", "gone"} {
+		if err := db.Put([]byte(k), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 读取事务自己的写入 提交之前对外不可见
+	tx := db.Begin()
+	if err := tx.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete([]byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := get(t, tx, []byte("a")); !ok || string(val) != "2" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+	if _, ok := get(t, tx, []byte("gone")); ok {
+		t.Fatal("deleted key visible in tx")
+	}
+	if _, ok := get(t, db, []byte("a")); ok {
+		t.Fatal("uncommitted write visible")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxClosed) {
+		t.Fatal(err)
+	}
+	if val, ok := get(t, db, []byte("a")); !ok || string(val) != "2" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+	if _, ok := get(t, db, []byte("gone")); ok {
+		t.Fatal("deleted key exists")
+	}
+
+	// 写偏序 两个事务读取相同的key 写入不同的key 只有一个可以提交
+	tx1, tx2 := db.Begin(), db.Begin()
+	for _, tx := range []*Tx{tx1, tx2} {
+		get(t, tx, []byte("x"))
+		get(t, tx, []byte("y"))
+	}
+	if err := tx1.Put([]byte("x"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Put([]byte("y"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); !errors.Is(err, ErrTxConflict) {
+		t.Fatal(err)
+	}
+	if val, _ := get(t, db, []byte("y")); string(val) != "1" {
+		t.Fatalf("conflicting tx written: %s", val)
+	}
+
+	conflict := func(name string, read string, fn func(), want error) {
+		t.Helper()
+		tx := db.Begin()
+		get(t, tx, []byte(read))
+		fn()
+		if err := tx.Put([]byte("out"), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); !errors.Is(err, want) {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	put := func(k string) func() {
+		return func() {
+			if err := db.Put([]byte(k), []byte("2")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// 读取时不存在的key 之后被写入
+	conflict("insert", "new", put("new"), ErrTxConflict)
+	// 读取过的key被删除
+	conflict("delete", "x", func() {
+		if err := db.Delete([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}, ErrTxConflict)
+	// 没有读取过的key不检查
+	conflict("blind", "y", put("out"), nil)
+	// 合并移动了数据 但没有修改
+	conflict("merge", "y", func() {
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+	}, nil)
+	// 合并之前的修改仍然可以检测到
+	conflict("merged write", "y", func() {
+		put("y")()
+		if err := db.Merge(); err != nil {
+			t.Fatal(err)
+		}
+	}, ErrTxConflict)
+
+	// 并发的计数器 冲突之后重试
+	counter := []byte("counter")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				for {
+					tx := db.Begin()
+					old, err := tx.Get(counter)
+					if err != nil && !errors.Is(err, ErrKeyNotFound) {
+						t.Error(err)
+						return
+					}
+					n, _ := strconv.Atoi(string(old))
+					if err := tx.Put(counter, []byte(strconv.Itoa(n+1))); err != nil {
+						t.Error(err)
+						return
+					}
+					err = tx.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrTxConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	db.Close()
+
+	db = openDb(t, NewOptions(dir))
+	defer db.Close()
+	if val, ok := get(t, db, counter); !ok || string(val) != "400" {
+		t.Fatalf("counter %s,%v", val, ok)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(1024))
+	db := openDb(t, opts)
+	if _, err := db.Bucket(""); err == nil {
+		t.Fatal("empty bucket name accepted")
+	}
+	bucket := func(name string) *Bucket {
+		t.Helper()
+		b, err := db.Bucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	bucketKeys := func(b *Bucket) []string {
+		t.Helper()
+		var keys []string
+		if err := b.Fold(func(key, value []byte) bool {
+			keys = append(keys, string(key)+"="+string(value))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	users, orders := bucket("users"), bucket("orders")
+	for i := range 50 {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		for _, p := range []struct {
+			put    func(key, value []byte) error
+			prefix string
+		}{{db.Put, "default"}, {users.Put, "user"}, {orders.Put, "order"}} {
+			if err := p.put(key, []byte(fmt.Sprintf("%s-%02d", p.prefix, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := users.Delete([]byte("key-00")); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		t.Helper()
+		if val, ok := get(t, db, []byte("key-00")); !ok || string(val) != "default-00" {
+			t.Fatalf("default: %s,%v", val, ok)
+		}
+		if _, ok := get(t, users, []byte("key-00")); ok {
+			t.Fatal("deleted key exists")
+		}
+		if val, ok := get(t, users, []byte("key-01")); !ok || string(val) != "user-01" {
+			t.Fatalf("users: %s,%v", val, ok)
+		}
+		if keys := bucketKeys(users); len(keys) != 49 || keys[0] != "key-01=user-01" {
+			t.Fatalf("users: %v", keys)
+		}
+		if n := len(listKeys(t, db)); n != 50 {
+			t.Fatalf("default has %d keys", n)
+		}
+	}
+	check()
+	if val, ok := get(t, orders, []byte("key-00")); !ok || string(val) != "order-00" {
+		t.Fatalf("orders: %s,%v", val, ok)
+	}
+	it, err := orders.NewIterator(IteratorOptions{Prefix: []byte("key-4")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for ; it.Valid(); it.Next() {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("prefix iterator got %d keys", n)
+	}
+	if names, err := db.Buckets(); err != nil || fmt.Sprint(names) != "[orders users]" {
+		t.Fatal(names, err)
+	}
+
+	// 重新打开之后 bucket 和数据仍然存在
+	db.Close()
+	db = openDb(t, opts)
+	users, orders = bucket("users"), bucket("orders")
+	check()
+	if val, ok := get(t, orders, []byte("key-00")); !ok || string(val) != "order-00" {
+		t.Fatalf("orders: %s,%v", val, ok)
+	}
+
+	// 删除之后旧的句柄不能再使用 同名的 bucket 重新创建之后为空
+	if err := db.DropBucket("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("orders"); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatal(err)
+	}
+	if _, err := orders.Get([]byte("key-00")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatal(err)
+	}
+	if err := orders.Put([]byte("key-00"), []byte("x")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatal(err)
+	}
+	orders = bucket("orders")
+	if keys := bucketKeys(orders); len(keys) != 0 {
+		t.Fatalf("recreated bucket: %v", keys)
+	}
+	if err := orders.Put([]byte("new"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDb(t, opts)
+	users, orders = bucket("users"), bucket("orders")
+	check()
+	if keys := bucketKeys(orders); fmt.Sprint(keys) != "[new=1]" {
+		t.Fatalf("orders after reopen: %v", keys)
+	}
+	// 合并时回收已经删除的 bucket 的数据
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	n = 0
+	for _, w := range db.olderFiles {
+		if err := w.Fold(func(r *wal.Record, pos *wal.Pos) error {
+			if strings.HasPrefix(string(r.Value), "order-") {
+				t.Fatalf("dropped data %s survived merge", r.Value)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n == 0 {
+		t.Fatal("no merged records")
+	}
+	db.Close()
+
+	db = openDb(t, NewOptions(dir, WithReadOnly()))
+	users = bucket("users")
+	check()
+	if keys := bucketKeys(bucket("orders")); fmt.Sprint(keys) != "[new=1]" {
+		t.Fatalf("orders after merge: %v", keys)
+	}
+	if _, err := db.Bucket("other"); !errors.Is(err, ErrReadOnly) {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDb(t, NewOptions(t.TempDir(), WithIndexType(memtable.DiskBTreeIndex)))
+	defer db.Close()
+	if _, err := db.Bucket("users"); !errors.Is(err, ErrBucketUnsupported) {
+		t.Fatal(err)
+	}
+}
+
+// 空的 key 和默认 bucket 一样可以写入 不同 bucket 中互不影响
+func TestBucketEmptyKey(t *testing.T) {
+	dir := t.TempDir()
+	db := openDb(t, NewOptions(dir))
+	b, err := db.Bucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(nil, []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put([]byte{}, []byte("bucket")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := b.Get(nil); err != nil || string(val) != "bucket" {
+		t.Fatalf("%s %v", val, err)
+	}
+	if err := b.Delete(nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDb(t, NewOptions(dir))
+	defer db.Close()
+	if b, err = db.Bucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(nil); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	if val, ok := get(t, db, nil); !ok || string(val) != "default" {
+		t.Fatalf("%s,%v", val, ok)
+	}
+}
+
+// bucket 中的批次原子地写入 合并时按照过滤函数丢弃 key
+func TestBucketBatchAndMergeFilter(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir, WithMaxFileSize(1024))
+	db := openDb(t, opts)
+	b, err := db.Bucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := NewWriteBatch()
+	for i := range 20 {
+		batch.Put([]byte(fmt.Sprintf("keep-%02d", i)), []byte("v"))
+		batch.Put([]byte(fmt.Sprintf("tmp-%02d", i)), []byte("v"))
+	}
+	batch.Delete([]byte("keep-00"))
+	if err := b.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	// 条件写入只比较这个 bucket 中的值
+	if err := db.Put([]byte("cas"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CompareAndSwap([]byte("cas"), []byte("x"), []byte("y")); !errors.Is(err, ErrConditionFailed) {
+		t.Fatal(err)
+	}
+	if err := b.CompareAndSwap([]byte("cas"), nil, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := b.Get([]byte("cas")); err != nil || string(val) != "y" {
+		t.Fatalf("%s %v", val, err)
+	}
+	if err := db.Delete([]byte("cas")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete([]byte("cas")); err != nil {
+		t.Fatal(err)
+	}
+	count := func() (keep, tmp int) {
+		t.Helper()
+		if err := b.Fold(func(key, value []byte) bool {
+			if strings.HasPrefix(string(key), "tmp-") {
+				tmp++
+			} else {
+				keep++
+			}
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return keep, tmp
+	}
+	if keep, tmp := count(); keep != 19 || tmp != 20 {
+		t.Fatalf("%d keep %d tmp", keep, tmp)
+	}
+	if n := len(listKeys(t, db)); n != 0 {
+		t.Fatalf("default has %d keys", n)
+	}
+	if ttl, err := b.TTL([]byte("keep-01")); err != nil || ttl != 0 {
+		t.Fatal(ttl, err)
+	}
+	if _, err := b.TTL([]byte("keep-00")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openDb(t, opts)
+	if b, err = db.Bucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if keep, tmp := count(); keep != 19 || tmp != 20 {
+		t.Fatalf("after reopen %d keep %d tmp", keep, tmp)
+	}
+	b.SetMergeFilter(func(key []byte) bool {
+		return strings.HasPrefix(string(key), "tmp-")
+	})
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if keep, tmp := count(); keep != 19 || tmp != 0 {
+		t.Fatalf("after merge %d keep %d tmp", keep, tmp)
+	}
+	db.Close()
+
+	db = openDb(t, opts)
+	if b, err = db.Bucket("b"); err != nil {
+		t.Fatal(err)
+	}
+	if keep, tmp := count(); keep != 19 || tmp != 0 {
+		t.Fatalf("after merge and reopen %d keep %d tmp", keep, tmp)
+	}
+	db.Close()
+}
+
+// 数据目录中名称不符合 %08d.wal 的文件被忽略
+func TestForeignWalFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := NewOptions(dir)
+	db := openDb(t, opts)
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	for _, name := range []string{"backup.wal", "1.wal", "00000001.wal.bak", "x00000001.wal"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("foreign"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = openDb(t, opts)
+	defer db.Close()
+	if val, ok := get(t, db, []byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("%s", val)
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "1.wal")); err != nil {
+		t.Fatal(err)
+	}
+}
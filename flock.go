@@ -0,0 +1,40 @@
+package bitcask
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	ErrDatabaseLocked = errors.New("database is locked by another process")
+	ErrReadOnly       = errors.New("database is opened in read-only mode")
+)
+
+// 对数据目录本身加锁 只读模式使用共享锁
+// 目录总是存在 只读模式不需要创建锁文件 也不会在没有锁的情况下打开
+func (db *Db) lockDir() error {
+	fp, err := os.Open(db.opts.DirPath)
+	if err != nil {
+		return err
+	}
+	if err := flock(fp, db.opts.ReadOnly); err != nil {
+		fp.Close()
+		return err
+	}
+	db.fileLock = fp
+	return nil
+}
+
+func (db *Db) unlockDir() error {
+	if db.fileLock == nil {
+		return nil
+	}
+	defer func() {
+		db.fileLock = nil
+	}()
+	if err := funlock(db.fileLock); err != nil {
+		db.fileLock.Close()
+		return err
+	}
+	return db.fileLock.Close()
+}
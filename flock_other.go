@@ -0,0 +1,14 @@
+//go:build !unix
+
+package bitcask
+
+import "os"
+
+// 其他平台暂不支持文件锁
+func flock(fp *os.File, shared bool) error {
+	return nil
+}
+
+func funlock(fp *os.File) error {
+	return nil
+}
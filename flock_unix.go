@@ -0,0 +1,26 @@
+//go:build unix
+
+package bitcask
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// 加锁失败时不阻塞 直接返回 ErrDatabaseLocked
+func flock(fp *os.File, shared bool) error {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrDatabaseLocked
+	}
+	return err
+}
+
+func funlock(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,201 @@
+package bitcask
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/xia-Sang/bitcask/memtable"
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+const indexFileName = "INDEX" //磁盘索引文件
+
+var ErrKeyTooLarge = memtable.ErrKeyTooLarge
+
+// 持久化的索引 启动时只需要回放检查点之后的记录
+type persistentIndex interface {
+	memtable.MemTable
+	Checkpoint() []byte
+	Flush(checkpoint []byte) error
+	MarkDirty() error
+	Close() error
+	Err() error
+	MaxKeySize() int
+}
+
+// 检查点 索引中已经包含了 fileId 文件 offset 之前的所有记录
+type checkpoint struct {
+	fileId int
+	offset int
+	seq    uint64
+}
+
+func (cp *checkpoint) encode() []byte {
+	buf := make([]byte, 0, 3*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, uint64(cp.fileId))
+	buf = binary.AppendUvarint(buf, uint64(cp.offset))
+	return binary.AppendUvarint(buf, cp.seq)
+}
+func decodeCheckpoint(buf []byte) (*checkpoint, bool) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, false
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	return &checkpoint{fileId: int(fields[0]), offset: int(fields[1]), seq: fields[2]}, true
+}
+
+// 根据索引类型创建索引
+// 持久化索引只用于默认的 bucket 其他 bucket 使用内存中的b树
+func (db *Db) openIndex() error {
+	db.newTable = memtable.NewBTreeMemTable
+	if !db.opts.IndexType.Persistent() {
+		newMemTable, err := db.opts.IndexType.Constructor()
+		if err != nil {
+			return err
+		}
+		db.newTable = newMemTable
+		db.memTable = newMemTable()
+		return nil
+	}
+	path := filepath.Join(db.opts.DirPath, indexFileName)
+	opts := memtable.DiskBTreeOptions{Codec: wal.PosCodec{}, ReadOnly: db.opts.ReadOnly}
+	index, err := memtable.OpenDiskBTreeMemTable(path, opts)
+	if err != nil {
+		if !errors.Is(err, memtable.ErrIndexCorrupted) && !os.IsNotExist(err) {
+			return err
+		}
+		// 只读模式下不能重建索引文件 使用内存索引
+		if db.opts.ReadOnly {
+			db.memTable = memtable.NewBTreeMemTable()
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if index, err = memtable.OpenDiskBTreeMemTable(path, opts); err != nil {
+			return err
+		}
+	}
+	db.memTable = index
+	return nil
+}
+
+func (db *Db) persistentIndex() (persistentIndex, bool) {
+	index, ok := db.memTable.(persistentIndex)
+	return index, ok
+}
+
+// 返回可以使用的检查点 对应的数据文件必须仍然存在
+func (db *Db) indexCheckpoint(fileIds []int) *checkpoint {
+	index, ok := db.persistentIndex()
+	if !ok {
+		return nil
+	}
+	cp, ok := decodeCheckpoint(index.Checkpoint())
+	if !ok || !slices.Contains(fileIds, cp.fileId) {
+		return nil
+	}
+	// 数据文件被截断之后 检查点之前的记录可能已经不存在
+	stat, err := os.Stat(filepath.Join(db.opts.DirPath, wal.GetWalPath(cp.fileId)))
+	if err != nil || stat.Size() < int64(cp.offset) {
+		return nil
+	}
+	return cp
+}
+
+// 丢弃索引中的内容 之后从数据文件重建
+func (db *Db) resetIndex() error {
+	index, ok := db.persistentIndex()
+	if !ok {
+		return nil
+	}
+	if db.opts.ReadOnly {
+		db.memTable = memtable.NewBTreeMemTable()
+		return index.Close()
+	}
+	index.Clear()
+	return index.Err()
+}
+
+// 写回索引并记录当前活跃文件的位置 调用方需要持有写锁
+func (db *Db) flushIndex() error {
+	index, ok := db.persistentIndex()
+	if !ok || db.opts.ReadOnly || db.activeFiles == nil {
+		return nil
+	}
+	// 检查点之前的记录必须已经落盘
+	if err := db.activeFiles.Sync(); err != nil {
+		return err
+	}
+	cp := &checkpoint{fileId: db.activeFiles.FileId, offset: db.activeFiles.Offset, seq: db.seq}
+	return index.Flush(cp.encode())
+}
+
+// 数据文件即将发生无法回放的变化 索引在下一次写回之前不再可信
+func (db *Db) invalidateIndex() error {
+	if index, ok := db.persistentIndex(); ok {
+		return index.MarkDirty()
+	}
+	return nil
+}
+func (db *Db) closeIndex() error {
+	if index, ok := db.persistentIndex(); ok {
+		return index.Close()
+	}
+	db.memTable.Clear()
+	return nil
+}
+
+// 磁盘索引读写文件时的错误
+func (db *Db) indexErr() error {
+	if index, ok := db.persistentIndex(); ok {
+		return index.Err()
+	}
+	return nil
+}
+func (db *Db) checkKey(key []byte) error {
+	if index, ok := db.persistentIndex(); ok && len(key) > index.MaxKeySize() {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// 从检查点开始回放 之前的记录已经在索引中
+func (db *Db) restoreFromCheckpoint(fileIds []int, cp *checkpoint) error {
+	slices.Sort(fileIds)
+	db.seq = cp.seq
+	for idx, fileId := range fileIds {
+		active := idx == len(fileIds)-1
+		w, err := db.openWal(fileId, active)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fileId == cp.fileId:
+			err = db.replayFile(w, cp.offset, active)
+		case fileId > cp.fileId && active:
+			err = db.replayFile(w, 0, true)
+		case fileId > cp.fileId:
+			err = db.loadSealedFile(w)
+		}
+		if err != nil {
+			return err
+		}
+		// 索引文件和数据文件中出现过的序号都不能再次使用
+		db.seq = max(db.seq, w.MaxSeq)
+		if active {
+			db.activeFiles = w
+		} else if err := db.addOlderFile(w); err != nil {
+			return err
+		}
+	}
+	return db.indexErr()
+}
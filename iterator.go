@@ -0,0 +1,187 @@
+package bitcask
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/xia-Sang/bitcask/memtable"
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+// IteratorOptions 迭代器配置
+type IteratorOptions struct {
+	Prefix  []byte //只遍历带有该前缀的key
+	Start   []byte //起始key 包含
+	End     []byte //结束key 不包含
+	Reverse bool   //逆序遍历
+}
+
+// Iterator 有序遍历key 过期的key会被跳过
+// value 只有在调用 Value 时才会读取
+type Iterator struct {
+	iter      memtable.Iterator
+	readValue func(key []byte, pos *wal.Pos) ([]byte, error)
+	now       int64
+	opts      IteratorOptions
+	lower     []byte //下界 包含
+	upper     []byte //上界 不包含
+}
+
+// NewIterator 创建迭代器 使用完毕之后调用 Close
+func (db *Db) NewIterator(opts IteratorOptions) *Iterator {
+	return newIterator(db.memTable.Iterator(), db.iteratorValue(defaultBucket), time.Now().UnixNano(), opts)
+}
+
+// 迭代器中的位置在创建之后可能失效 合并会移动数据并删除原来的文件
+// 读取时在锁内重新查找key的位置 并检查记录中的key 返回读取时最新的value
+func (db *Db) iteratorValue(bucket uint32) func(key []byte, pos *wal.Pos) ([]byte, error) {
+	return func(key []byte, _ *wal.Pos) ([]byte, error) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if db.closed {
+			return nil, ErrClosed
+		}
+		table := db.table(bucket)
+		if table == nil {
+			return nil, ErrBucketNotFound
+		}
+		pos, ok := table.Get(key)
+		if !ok || pos.(*wal.Pos).Expired(time.Now().UnixNano()) {
+			return nil, ErrKeyNotFound
+		}
+		recordKey, val, err := db.getRecordByPos(pos.(*wal.Pos))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(recordKey, key) {
+			return nil, fmt.Errorf("%w: file %d offset %d: key mismatch", ErrCorrupted, pos.(*wal.Pos).FileId, pos.(*wal.Pos).Offset)
+		}
+		return val, nil
+	}
+}
+
+func newIterator(iter memtable.Iterator, readValue func(key []byte, pos *wal.Pos) ([]byte, error), now int64, opts IteratorOptions) *Iterator {
+	it := &Iterator{iter: iter, readValue: readValue, now: now, opts: opts}
+	// 前缀和起止key共同决定上下界
+	it.lower = opts.Start
+	if bytes.Compare(opts.Prefix, it.lower) > 0 {
+		it.lower = opts.Prefix
+	}
+	it.upper = opts.End
+	if end := prefixEnd(opts.Prefix); end != nil && (it.upper == nil || bytes.Compare(end, it.upper) < 0) {
+		it.upper = end
+	}
+	it.Rewind()
+	return it
+}
+
+// 前缀的后继 所有带该前缀的key都小于它
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Rewind 回到第一个位置 逆序时为最后一个key
+func (it *Iterator) Rewind() {
+	if !it.opts.Reverse {
+		if it.lower != nil {
+			it.iter.Seek(it.lower)
+		} else {
+			it.iter.SeekToFirst()
+		}
+	} else {
+		if it.upper != nil {
+			it.seekLE(it.upper, false)
+		} else {
+			it.iter.SeekToLast()
+		}
+	}
+	it.skip()
+}
+
+// 逆序定位到最后一个小于(等于)key的位置
+func (it *Iterator) seekLE(key []byte, inclusive bool) {
+	it.iter.Seek(key)
+	if !it.iter.Valid() {
+		it.iter.SeekToLast()
+		return
+	}
+	curr, _ := it.iter.Curr()
+	if cmp := bytes.Compare(curr, key); cmp > 0 || (cmp == 0 && !inclusive) {
+		it.iter.Prev()
+	}
+}
+
+// 跳过已经过期的key
+func (it *Iterator) skip() {
+	for it.Valid() {
+		_, pos := it.iter.Curr()
+		if !pos.(*wal.Pos).Expired(it.now) {
+			return
+		}
+		it.step()
+	}
+}
+func (it *Iterator) step() {
+	if it.opts.Reverse {
+		it.iter.Prev()
+	} else {
+		it.iter.Next()
+	}
+}
+
+// Valid 当前位置是否在范围之内
+func (it *Iterator) Valid() bool {
+	if it.iter == nil || !it.iter.Valid() {
+		return false
+	}
+	key, _ := it.iter.Curr()
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		return false
+	}
+	if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		return false
+	}
+	return true
+}
+func (it *Iterator) Next() {
+	it.step()
+	it.skip()
+}
+
+// Seek 正序定位到第一个大于等于key的位置 逆序定位到最后一个小于等于key的位置
+func (it *Iterator) Seek(key []byte) {
+	if !it.opts.Reverse {
+		if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+			key = it.lower
+		}
+		it.iter.Seek(key)
+	} else if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		it.seekLE(it.upper, false)
+	} else {
+		it.seekLE(key, true)
+	}
+	it.skip()
+}
+func (it *Iterator) Key() []byte {
+	key, _ := it.iter.Curr()
+	return key
+}
+
+// Value 需要时才读取value 空的 value 返回非 nil 的空切片
+// 遍历到这个key之后被删除时返回 ErrKeyNotFound
+func (it *Iterator) Value() ([]byte, error) {
+	key, pos := it.iter.Curr()
+	return it.readValue(key, pos.(*wal.Pos))
+}
+func (it *Iterator) Close() {
+	it.iter = nil
+	it.readValue = nil
+}
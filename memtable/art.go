@@ -0,0 +1,609 @@
+package memtable
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// 自适应基数树 Adaptive Radix Tree
+// 内部节点根据孩子数量在 node4/node16/node48/node256 之间切换
+// 只有一个孩子的路径会被压缩到 prefix 中 叶子节点同样把剩余的key保存在 prefix 中
+// key 可以是另一个key的前缀 因此每个节点都可以挂一个在此结束的 leaf
+
+const (
+	artNode4 = iota
+	artNode16
+	artNode48
+	artNode256
+)
+
+type artLeaf struct {
+	key   []byte
+	value interface{}
+}
+
+type artNode struct {
+	kind   uint8
+	prefix []byte   //压缩的路径
+	leaf   *artLeaf //在此结束的key
+	size   int      //孩子数量
+
+	keys     []byte     //node4/node16 有序的边 与 children 一一对应
+	index    *[256]byte //node48 边到 children 下标的映射 0表示不存在
+	children []*artNode
+}
+
+func newArtNode(kind uint8) *artNode {
+	n := &artNode{kind: kind}
+	switch kind {
+	case artNode4:
+		n.keys, n.children = make([]byte, 0, 4), make([]*artNode, 0, 4)
+	case artNode16:
+		n.keys, n.children = make([]byte, 0, 16), make([]*artNode, 0, 16)
+	case artNode48:
+		n.index, n.children = new([256]byte), make([]*artNode, 48)
+	case artNode256:
+		n.children = make([]*artNode, 256)
+	}
+	return n
+}
+
+// 只保存一个key的节点
+func newArtLeafNode(suffix []byte, leaf *artLeaf) *artNode {
+	n := newArtNode(artNode4)
+	n.prefix = bytes.Clone(suffix)
+	n.leaf = leaf
+	return n
+}
+
+func (n *artNode) full() bool {
+	switch n.kind {
+	case artNode4:
+		return n.size == 4
+	case artNode16:
+		return n.size == 16
+	case artNode48:
+		return n.size == 48
+	}
+	return false
+}
+
+// 孩子数量过少时缩小节点
+func (n *artNode) sparse() bool {
+	switch n.kind {
+	case artNode16:
+		return n.size <= 3
+	case artNode48:
+		return n.size <= 12
+	case artNode256:
+		return n.size <= 37
+	}
+	return false
+}
+
+func (n *artNode) findChild(c byte) *artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == c {
+				return n.children[i]
+			}
+		}
+	case artNode48:
+		if idx := n.index[c]; idx > 0 {
+			return n.children[idx-1]
+		}
+	case artNode256:
+		return n.children[c]
+	}
+	return nil
+}
+
+// 调用方保证节点没有满并且边不存在
+func (n *artNode) addChild(c byte, child *artNode) {
+	switch n.kind {
+	case artNode4, artNode16:
+		i := 0
+		for i < len(n.keys) && n.keys[i] < c {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = c
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+	case artNode48:
+		slot := 0
+		for n.children[slot] != nil {
+			slot++
+		}
+		n.children[slot] = child
+		n.index[c] = byte(slot + 1)
+	case artNode256:
+		n.children[c] = child
+	}
+	n.size++
+}
+func (n *artNode) replaceChild(c byte, child *artNode) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == c {
+				n.children[i] = child
+				return
+			}
+		}
+	case artNode48:
+		n.children[n.index[c]-1] = child
+	case artNode256:
+		n.children[c] = child
+	}
+}
+func (n *artNode) removeChild(c byte) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == c {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				copy(n.children[i:], n.children[i+1:])
+				n.children[len(n.children)-1] = nil
+				n.children = n.children[:len(n.children)-1]
+				break
+			}
+		}
+	case artNode48:
+		n.children[n.index[c]-1] = nil
+		n.index[c] = 0
+	case artNode256:
+		n.children[c] = nil
+	}
+	n.size--
+}
+
+// 转换成另一种类型的节点 保留前缀和叶子
+func (n *artNode) resize(kind uint8) *artNode {
+	m := newArtNode(kind)
+	m.prefix, m.leaf = n.prefix, n.leaf
+	n.forEach(func(c byte, child *artNode) bool {
+		m.addChild(c, child)
+		return true
+	})
+	return m
+}
+
+// 按照边从小到大遍历孩子
+func (n *artNode) forEach(fn func(c byte, child *artNode) bool) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if !fn(k, n.children[i]) {
+				return
+			}
+		}
+	case artNode48:
+		for c := 0; c < 256; c++ {
+			if idx := n.index[c]; idx > 0 && !fn(byte(c), n.children[idx-1]) {
+				return
+			}
+		}
+	case artNode256:
+		for c := 0; c < 256; c++ {
+			if child := n.children[c]; child != nil && !fn(byte(c), child) {
+				return
+			}
+		}
+	}
+}
+
+// 第一个边大于等于c的孩子
+func (n *artNode) ceilChild(c int) *artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if int(k) >= c {
+				return n.children[i]
+			}
+		}
+	case artNode48:
+		for ; c < 256; c++ {
+			if idx := n.index[c]; idx > 0 {
+				return n.children[idx-1]
+			}
+		}
+	case artNode256:
+		for ; c < 256; c++ {
+			if n.children[c] != nil {
+				return n.children[c]
+			}
+		}
+	}
+	return nil
+}
+
+// 最后一个边小于等于c的孩子
+func (n *artNode) floorChild(c int) *artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := len(n.keys) - 1; i >= 0; i-- {
+			if int(n.keys[i]) <= c {
+				return n.children[i]
+			}
+		}
+	case artNode48:
+		for ; c >= 0; c-- {
+			if idx := n.index[c]; idx > 0 {
+				return n.children[idx-1]
+			}
+		}
+	case artNode256:
+		for ; c >= 0; c-- {
+			if n.children[c] != nil {
+				return n.children[c]
+			}
+		}
+	}
+	return nil
+}
+
+// 子树中最小的key 在节点上结束的key小于所有孩子
+func (n *artNode) minimum() *artLeaf {
+	for n != nil {
+		if n.leaf != nil {
+			return n.leaf
+		}
+		n = n.ceilChild(0)
+	}
+	return nil
+}
+func (n *artNode) maximum() *artLeaf {
+	for n != nil {
+		if child := n.floorChild(255); child != nil {
+			n = child
+			continue
+		}
+		return n.leaf
+	}
+	return nil
+}
+
+type artTree struct {
+	root *artNode
+	size int
+	mu   sync.RWMutex
+}
+
+func newArtTree() *artTree {
+	return &artTree{}
+}
+
+func (t *artTree) get(key []byte) (interface{}, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n, depth := t.root, 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil, false
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil, false
+			}
+			return n.leaf.value, true
+		}
+		n = n.findChild(key[depth])
+		depth++
+	}
+	return nil, false
+}
+
+func (t *artTree) put(key []byte, value interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	leaf := &artLeaf{key: key, value: value}
+	if t.root == nil {
+		t.root = newArtLeafNode(key, leaf)
+		t.size++
+		return
+	}
+	var added bool
+	if t.root, added = t.insert(t.root, key, 0, leaf); added {
+		t.size++
+	}
+}
+
+// 返回替换之后的节点 以及是否新增了key
+func (t *artTree) insert(n *artNode, key []byte, depth int, leaf *artLeaf) (*artNode, bool) {
+	rest := key[depth:]
+	p := commonPrefix(n.prefix, rest)
+	if p < len(n.prefix) {
+		// 前缀不匹配 在分叉的位置拆分节点
+		split := newArtNode(artNode4)
+		split.prefix = n.prefix[:p:p]
+		edge := n.prefix[p]
+		n.prefix = n.prefix[p+1:]
+		split.addChild(edge, n)
+		if p == len(rest) {
+			split.leaf = leaf
+		} else {
+			split.addChild(rest[p], newArtLeafNode(rest[p+1:], leaf))
+		}
+		return split, true
+	}
+	depth += p
+	if depth == len(key) {
+		added := n.leaf == nil
+		n.leaf = leaf
+		return n, added
+	}
+	c := key[depth]
+	if child := n.findChild(c); child != nil {
+		newChild, added := t.insert(child, key, depth+1, leaf)
+		if newChild != child {
+			n.replaceChild(c, newChild)
+		}
+		return n, added
+	}
+	if n.full() {
+		n = n.resize(n.kind + 1)
+	}
+	n.addChild(c, newArtLeafNode(key[depth+1:], leaf))
+	return n, true
+}
+
+func (t *artTree) remove(key []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.root == nil {
+		return
+	}
+	var removed bool
+	if t.root, removed = t.delete(t.root, key, 0); removed {
+		t.size--
+	}
+}
+
+// 返回替换之后的节点 节点为空时返回nil
+func (t *artTree) delete(n *artNode, key []byte, depth int) (*artNode, bool) {
+	if !bytes.HasPrefix(key[depth:], n.prefix) {
+		return n, false
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return n, false
+		}
+		n.leaf = nil
+		return n.compact(), true
+	}
+	c := key[depth]
+	child := n.findChild(c)
+	if child == nil {
+		return n, false
+	}
+	newChild, removed := t.delete(child, key, depth+1)
+	if !removed {
+		return n, false
+	}
+	if newChild == nil {
+		n.removeChild(c)
+	} else if newChild != child {
+		n.replaceChild(c, newChild)
+	}
+	return n.compact(), true
+}
+
+// 删除之后整理节点
+// 没有叶子并且只剩一个孩子时 与孩子合并成一条压缩路径
+func (n *artNode) compact() *artNode {
+	if n.leaf == nil {
+		switch n.size {
+		case 0:
+			return nil
+		case 1:
+			var edge byte
+			var child *artNode
+			n.forEach(func(c byte, ch *artNode) bool {
+				edge, child = c, ch
+				return false
+			})
+			prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+			prefix = append(append(append(prefix, n.prefix...), edge), child.prefix...)
+			child.prefix = prefix
+			return child
+		}
+	}
+	if n.sparse() {
+		return n.resize(n.kind - 1)
+	}
+	return n
+}
+
+// 第一个大于(等于)key的叶子
+func (n *artNode) seekGE(key []byte, depth int, inclusive bool) *artLeaf {
+	rest := key[depth:]
+	m := min(len(n.prefix), len(rest))
+	if cmp := bytes.Compare(n.prefix[:m], rest[:m]); cmp != 0 {
+		if cmp > 0 {
+			return n.minimum()
+		}
+		return nil
+	}
+	if len(rest) < len(n.prefix) {
+		return n.minimum()
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if inclusive && n.leaf != nil {
+			return n.leaf
+		}
+		return n.ceilChild(0).minimum()
+	}
+	c := key[depth]
+	if child := n.findChild(c); child != nil {
+		if leaf := child.seekGE(key, depth+1, inclusive); leaf != nil {
+			return leaf
+		}
+	}
+	return n.ceilChild(int(c) + 1).minimum()
+}
+
+// 最后一个小于(等于)key的叶子
+func (n *artNode) seekLE(key []byte, depth int, inclusive bool) *artLeaf {
+	rest := key[depth:]
+	m := min(len(n.prefix), len(rest))
+	if cmp := bytes.Compare(n.prefix[:m], rest[:m]); cmp != 0 {
+		if cmp < 0 {
+			return n.maximum()
+		}
+		return nil
+	}
+	if len(rest) < len(n.prefix) {
+		return nil
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if inclusive {
+			return n.leaf
+		}
+		return nil
+	}
+	c := key[depth]
+	if child := n.findChild(c); child != nil {
+		if leaf := child.seekLE(key, depth+1, inclusive); leaf != nil {
+			return leaf
+		}
+	}
+	if child := n.floorChild(int(c) - 1); child != nil {
+		return child.maximum()
+	}
+	return n.leaf
+}
+
+func (n *artNode) show(depth int) {
+	indent := bytes.Repeat([]byte("  "), depth)
+	if n.leaf != nil {
+		fmt.Printf("%sprefix:%q (%s:%v)\n", indent, n.prefix, n.leaf.key, n.leaf.value)
+	} else {
+		fmt.Printf("%sprefix:%q node%d\n", indent, n.prefix, []int{4, 16, 48, 256}[n.kind])
+	}
+	n.forEach(func(c byte, child *artNode) bool {
+		fmt.Printf("%s%q\n", indent, c)
+		child.show(depth + 1)
+		return true
+	})
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+type ArtMemTable struct {
+	tree *artTree
+}
+
+func NewArtMemTable() MemTable {
+	return &ArtMemTable{tree: newArtTree()}
+}
+func (a *ArtMemTable) Put(key []byte, value interface{}) {
+	a.tree.put(key, value)
+}
+func (a *ArtMemTable) Get(key []byte) (interface{}, bool) {
+	val, ok := a.tree.get(key)
+	return val, ok && val != nil
+}
+func (a *ArtMemTable) Delete(key []byte) {
+	a.tree.remove(key)
+}
+func (a *ArtMemTable) Show() {
+	a.tree.mu.RLock()
+	defer a.tree.mu.RUnlock()
+	if a.tree.root != nil {
+		a.tree.root.show(0)
+	}
+}
+func (a *ArtMemTable) Iterator() Iterator {
+	iter := &ArtMemTableIter{tree: a.tree}
+	iter.SeekToFirst()
+	return iter
+}
+func (a *ArtMemTable) Clear() {
+	a.tree.mu.Lock()
+	defer a.tree.mu.Unlock()
+	a.tree.root = nil
+	a.tree.size = 0
+}
+
+// ArtMemTableIter 基数树迭代器
+// 每次移动都从根节点查找当前key的前驱或者后继 复杂度与key的长度相关
+// 不需要记录路径 遍历期间的修改自然可见
+type ArtMemTableIter struct {
+	tree  *artTree
+	key   []byte
+	value interface{}
+	valid bool
+}
+
+func (i *ArtMemTableIter) Valid() bool {
+	return i.valid
+}
+func (i *ArtMemTableIter) Curr() ([]byte, interface{}) {
+	return i.key, i.value
+}
+func (i *ArtMemTableIter) SeekToFirst() {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.set(i.tree.root.minimum())
+}
+func (i *ArtMemTableIter) SeekToLast() {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.set(i.tree.root.maximum())
+}
+func (i *ArtMemTableIter) Seek(key []byte) {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.set(i.seek(key, true))
+}
+func (i *ArtMemTableIter) Next() {
+	if !i.valid {
+		return
+	}
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	i.set(i.seek(i.key, false))
+}
+func (i *ArtMemTableIter) Prev() {
+	if !i.valid {
+		return
+	}
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	if i.tree.root == nil {
+		i.set(nil)
+		return
+	}
+	i.set(i.tree.root.seekLE(i.key, 0, false))
+}
+func (i *ArtMemTableIter) seek(key []byte, inclusive bool) *artLeaf {
+	if i.tree.root == nil {
+		return nil
+	}
+	return i.tree.root.seekGE(key, 0, inclusive)
+}
+func (i *ArtMemTableIter) set(leaf *artLeaf) {
+	if leaf == nil {
+		i.valid, i.key, i.value = false, nil, nil
+		return
+	}
+	i.valid, i.key, i.value = true, leaf.key, leaf.value
+}
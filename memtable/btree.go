@@ -9,20 +9,17 @@ import (
 // 注意 b树的实现参考的是 可视化的逻辑进行的
 // https://www.cs.usfca.edu/~galles/visualization/BTree.html
 // 但可以根据具体的应用场景进行切换
-// 对于删除操作 后续进行补充实现
-// 目前使用懒删除 标记删除即可
-// 已经达到学习要求了
+// 删除时直接从节点中移除 不足时向兄弟节点借或者与兄弟节点合并
 type data struct {
-	key     []byte
-	value   interface{}
-	deleted bool
+	key   []byte
+	value interface{}
 }
 
 func newData(key []byte, value interface{}) *data {
-	return &data{key, value, false}
+	return &data{key, value}
 }
 func (i *data) info() string {
-	return fmt.Sprintf("(%s:%s:%v)", i.key, i.value, i.deleted)
+	return fmt.Sprintf("(%s:%s)", i.key, i.value)
 }
 
 type DataItem []*data
@@ -36,7 +33,6 @@ func (dt *DataItem) showInfo() (ans string) {
 
 func (dt DataItem) changeData(index int, item *data) {
 	dt[index].value = item.value
-	dt[index].deleted = item.deleted
 }
 
 func (dt DataItem) search(data *data) (int, bool) {
@@ -69,10 +65,11 @@ type btreeNode struct {
 	parent   *btreeNode
 }
 type btree struct {
-	root  *btreeNode
-	order int
-	size  int
-	mu    *sync.RWMutex // 读写互斥锁
+	root    *btreeNode
+	order   int
+	size    int
+	version uint64        // 每次修改递增 迭代器据此发现修改
+	mu      *sync.RWMutex // 读写互斥锁
 }
 
 // 这部分存在差异 但并不影响
@@ -80,6 +77,11 @@ func (bt *btree) maxEntries() int {
 	return bt.order - 1
 }
 
+// 非根节点最少的数据量 与分裂之后左节点的数据量一致
+func (bt *btree) minEntries() int {
+	return bt.middle()
+}
+
 func (bt *btree) middle() int {
 	return (bt.order - 1) / 2
 }
@@ -94,17 +96,135 @@ func (bt *btree) Put(item *data) {
 	bt.mu.Lock()
 	defer bt.mu.Unlock()
 
+	bt.version++
 	if bt.root == nil {
 		bt.root = &btreeNode{entries: DataItem{item}}
+		bt.size++
 		return
 	}
 	if bt.insert(bt.root, item) {
 		bt.size++
 	}
 }
+
+// 删除数据 内部节点使用前驱替换之后转换为叶子节点的删除
 func (bt *btree) delete(node *btreeNode, idx int) {
-	node.entries[idx].deleted = true
+	if !bt.isLeaf(node) {
+		leaf := node.children[idx]
+		for !bt.isLeaf(leaf) {
+			leaf = leaf.children[len(leaf.children)-1]
+		}
+		node.entries[idx] = leaf.entries[len(leaf.entries)-1]
+		node, idx = leaf, len(leaf.entries)-1
+	}
+	node.entries = removeAt(node.entries, idx)
 	bt.size--
+	bt.rebalance(node)
+}
+
+// 节点数据不足时 先尝试向兄弟节点借 否则与兄弟节点合并
+func (bt *btree) rebalance(node *btreeNode) {
+	if node == bt.root {
+		if len(node.entries) > 0 {
+			return
+		}
+		// 根节点为空时 树的高度减一
+		if bt.isLeaf(node) {
+			bt.root = nil
+		} else {
+			bt.root = node.children[0]
+			bt.root.parent = nil
+		}
+		return
+	}
+	if len(node.entries) >= bt.minEntries() {
+		return
+	}
+	parent := node.parent
+	index := childIndex(parent, node)
+
+	// 向左兄弟借
+	if index > 0 {
+		left := parent.children[index-1]
+		if len(left.entries) > bt.minEntries() {
+			node.entries = insertAt(node.entries, 0, parent.entries[index-1])
+			parent.entries[index-1] = left.entries[len(left.entries)-1]
+			left.entries = removeAt(left.entries, len(left.entries)-1)
+			if !bt.isLeaf(left) {
+				child := left.children[len(left.children)-1]
+				left.children = left.children[:len(left.children)-1]
+				node.children = append([]*btreeNode{child}, node.children...)
+				child.parent = node
+			}
+			return
+		}
+	}
+	// 向右兄弟借
+	if index < len(parent.children)-1 {
+		right := parent.children[index+1]
+		if len(right.entries) > bt.minEntries() {
+			node.entries = append(node.entries, parent.entries[index])
+			parent.entries[index] = right.entries[0]
+			right.entries = removeAt(right.entries, 0)
+			if !bt.isLeaf(right) {
+				child := right.children[0]
+				right.children = append([]*btreeNode{}, right.children[1:]...)
+				node.children = append(node.children, child)
+				child.parent = node
+			}
+			return
+		}
+	}
+	// 与兄弟节点合并 统一合并到左边的节点
+	if index > 0 {
+		bt.merge(parent, index-1)
+	} else {
+		bt.merge(parent, index)
+	}
+	bt.rebalance(parent)
+}
+
+// 合并 parent.children[index] 和 parent.children[index+1]
+func (bt *btree) merge(parent *btreeNode, index int) {
+	left, right := parent.children[index], parent.children[index+1]
+
+	entries := make(DataItem, 0, len(left.entries)+len(right.entries)+1)
+	entries = append(entries, left.entries...)
+	entries = append(entries, parent.entries[index])
+	left.entries = append(entries, right.entries...)
+	if !bt.isLeaf(left) {
+		children := make([]*btreeNode, 0, len(left.children)+len(right.children))
+		children = append(children, left.children...)
+		left.children = append(children, right.children...)
+		setParentBTree(right.children, left)
+	}
+
+	parent.entries = removeAt(parent.entries, index)
+	copy(parent.children[index+1:], parent.children[index+2:])
+	parent.children[len(parent.children)-1] = nil
+	parent.children = parent.children[:len(parent.children)-1]
+}
+
+func childIndex(parent, child *btreeNode) int {
+	for i, c := range parent.children {
+		if c == child {
+			return i
+		}
+	}
+	panic("child not found in parent")
+}
+
+// 删除之后重新分配 避免与其他节点共享底层数组
+func removeAt[S ~[]E, E any](entries S, index int) S {
+	ans := make(S, 0, len(entries)-1)
+	ans = append(ans, entries[:index]...)
+	return append(ans, entries[index+1:]...)
+}
+func insertAt[S ~[]E, E any](entries S, index int, item E) S {
+	ans := make(S, 0, len(entries)+1)
+	ans = append(ans, entries[:index]...)
+	ans = append(ans, item)
+	return append(ans, entries[index:]...)
 }
 func (bt *btree) Remove(item *data) bool {
 	bt.mu.Lock()
@@ -112,6 +232,7 @@ func (bt *btree) Remove(item *data) bool {
 
 	node, idx, ok := bt.search(bt.root, item)
 	if ok {
+		bt.version++
 		bt.delete(node, idx)
 	}
 	return ok
@@ -137,11 +258,11 @@ func (bt *btree) Get(item *data) bool {
 	defer bt.mu.RUnlock()
 
 	node, index, ok := bt.search(bt.root, item)
-	if ok && !node.entries[index].deleted {
+	if ok {
 		item.value = node.entries[index].value
 	}
 	//对于数据进行查找处理
-	return ok && !node.entries[index].deleted
+	return ok
 }
 func (bt *btree) insertLeaf(node *btreeNode, item *data) bool {
 	index, ok := node.entries.search(item)
@@ -174,12 +295,13 @@ func (bt *btree) splitRoot() {
 	midItem := node.entries[mid]
 	newRoot := &btreeNode{entries: DataItem{midItem}}
 
-	leftNode := &btreeNode{entries: node.entries[:mid], parent: newRoot}
+	// 左节点限制容量 避免追加时覆盖右节点共享的底层数组
+	leftNode := &btreeNode{entries: node.entries[:mid:mid], parent: newRoot}
 	// rightNode := &btreeNode{entries: node.entries[mid+1:], parent: newRoot}
 	rightNode := &btreeNode{entries: node.entries[mid+1:], parent: newRoot}
 
 	if !bt.isLeaf(node) {
-		leftNode.children = node.children[:mid+1]
+		leftNode.children = node.children[: mid+1 : mid+1]
 		rightNode.children = node.children[mid+1:]
 		setParentBTree(leftNode.children, leftNode)
 		setParentBTree(rightNode.children, rightNode)
@@ -194,10 +316,10 @@ func (bt *btree) splitNonRoot(node *btreeNode) {
 
 	midItem := node.entries[mid]
 
-	leftNode := &btreeNode{entries: node.entries[:mid], parent: parent}
+	leftNode := &btreeNode{entries: node.entries[:mid:mid], parent: parent}
 	rightNode := &btreeNode{entries: node.entries[mid+1:], parent: parent}
 	if !bt.isLeaf(node) {
-		leftNode.children = node.children[:mid+1]
+		leftNode.children = node.children[: mid+1 : mid+1]
 		rightNode.children = node.children[mid+1:]
 		setParentBTree(leftNode.children, leftNode)
 		setParentBTree(rightNode.children, rightNode)
@@ -291,3 +413,74 @@ func (t *btree) inOrderTraversalNode(node *btreeNode, fn func(*data)) {
 		t.inOrderTraversalNode(node.children[n], fn)
 	}
 }
+
+// 检查b树的性质 供测试使用
+// 数据有序且在父节点的区间内 节点数据量合法 父指针正确 叶子节点深度一致
+func (bt *btree) validate() error {
+	bt.mu.RLock()
+	defer bt.mu.RUnlock()
+
+	if bt.root == nil {
+		if bt.size != 0 {
+			return fmt.Errorf("empty tree with size %d", bt.size)
+		}
+		return nil
+	}
+	if bt.root.parent != nil {
+		return fmt.Errorf("root has parent")
+	}
+	count, leafDepth := 0, -1
+	var check func(node *btreeNode, depth int, lower, upper []byte) error
+	check = func(node *btreeNode, depth int, lower, upper []byte) error {
+		n := len(node.entries)
+		if n == 0 || n > bt.maxEntries() {
+			return fmt.Errorf("node has %d entries", n)
+		}
+		if node != bt.root && n < bt.minEntries() {
+			return fmt.Errorf("node has %d entries, less than %d", n, bt.minEntries())
+		}
+		for i, e := range node.entries {
+			if i > 0 && bytes.Compare(node.entries[i-1].key, e.key) >= 0 {
+				return fmt.Errorf("entries not sorted at %s", e.key)
+			}
+			if (lower != nil && bytes.Compare(e.key, lower) <= 0) || (upper != nil && bytes.Compare(e.key, upper) >= 0) {
+				return fmt.Errorf("entry %s out of range", e.key)
+			}
+		}
+		count += n
+		if bt.isLeaf(node) {
+			if leafDepth == -1 {
+				leafDepth = depth
+			} else if leafDepth != depth {
+				return fmt.Errorf("leaf depth %d != %d", depth, leafDepth)
+			}
+			return nil
+		}
+		if len(node.children) != n+1 {
+			return fmt.Errorf("node has %d entries and %d children", n, len(node.children))
+		}
+		for i, child := range node.children {
+			if child.parent != node {
+				return fmt.Errorf("wrong parent of child %d", i)
+			}
+			lo, hi := lower, upper
+			if i > 0 {
+				lo = node.entries[i-1].key
+			}
+			if i < n {
+				hi = node.entries[i].key
+			}
+			if err := check(child, depth+1, lo, hi); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := check(bt.root, 0, nil, nil); err != nil {
+		return err
+	}
+	if count != bt.size {
+		return fmt.Errorf("count %d != size %d", count, bt.size)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package memtable
+
+import "bytes"
+
+// 迭代器路径上的一层
+// 祖先节点的 index 表示下降到了第几个孩子 最后一层的 index 表示当前数据的位置
+type iterFrame struct {
+	node  *btreeNode
+	index int
+}
+
+// BTreeMemTableIter 使用栈记录从根节点到当前位置的路径
+// 定位是 O(log n) 的 Next/Prev 均摊 O(1)
+// 每次操作只短暂持有读锁 通过 version 发现遍历期间的修改
+type BTreeMemTableIter struct {
+	tree    *btree
+	stack   []iterFrame
+	version uint64 //构建路径时树的版本
+	key     []byte
+	value   interface{}
+	valid   bool
+}
+
+func (i *BTreeMemTableIter) Valid() bool {
+	return i.valid
+}
+func (i *BTreeMemTableIter) Curr() ([]byte, interface{}) {
+	return i.key, i.value
+}
+func (i *BTreeMemTableIter) SeekToFirst() {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+
+	i.reset()
+	if i.tree.root != nil {
+		i.descendFirst(i.tree.root)
+	}
+	i.load()
+}
+func (i *BTreeMemTableIter) SeekToLast() {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+
+	i.reset()
+	if i.tree.root != nil {
+		i.descendLast(i.tree.root)
+	}
+	i.load()
+}
+func (i *BTreeMemTableIter) Seek(key []byte) {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+
+	i.seek(key)
+	i.load()
+}
+func (i *BTreeMemTableIter) Next() {
+	if !i.valid {
+		return
+	}
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+
+	if i.version != i.tree.version {
+		// 树被修改过 从当前key重新定位到第一个更大的key
+		key := i.key
+		i.seek(key)
+		if len(i.stack) == 0 || !bytes.Equal(i.currEntry().key, key) {
+			i.load()
+			return
+		}
+	}
+	i.next()
+	i.load()
+}
+func (i *BTreeMemTableIter) Prev() {
+	if !i.valid {
+		return
+	}
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+
+	if i.version != i.tree.version {
+		// 树被修改过 从当前key重新定位到最后一个更小的key
+		i.seek(i.key)
+		if len(i.stack) == 0 {
+			i.reset()
+			if i.tree.root != nil {
+				i.descendLast(i.tree.root)
+			}
+			i.load()
+			return
+		}
+	}
+	i.prev()
+	i.load()
+}
+
+func (i *BTreeMemTableIter) reset() {
+	i.stack = i.stack[:0]
+	i.version = i.tree.version
+}
+func (i *BTreeMemTableIter) top() *iterFrame {
+	return &i.stack[len(i.stack)-1]
+}
+func (i *BTreeMemTableIter) currEntry() *data {
+	top := i.top()
+	return top.node.entries[top.index]
+}
+
+// 根据路径读取当前数据 路径为空表示迭代器失效
+func (i *BTreeMemTableIter) load() {
+	if len(i.stack) == 0 {
+		i.valid, i.key, i.value = false, nil, nil
+		return
+	}
+	d := i.currEntry()
+	i.valid, i.key, i.value = true, d.key, d.value
+}
+
+// 定位到第一个大于等于key的位置
+func (i *BTreeMemTableIter) seek(key []byte) {
+	i.reset()
+	node := i.tree.root
+	for node != nil {
+		idx, found := node.entries.search(&data{key: key})
+		i.stack = append(i.stack, iterFrame{node, idx})
+		if found {
+			return
+		}
+		if i.tree.isLeaf(node) {
+			i.ascendForward()
+			return
+		}
+		node = node.children[idx]
+	}
+}
+
+// 下降到子树中最小的数据
+func (i *BTreeMemTableIter) descendFirst(node *btreeNode) {
+	for {
+		i.stack = append(i.stack, iterFrame{node, 0})
+		if i.tree.isLeaf(node) {
+			return
+		}
+		node = node.children[0]
+	}
+}
+
+// 下降到子树中最大的数据
+func (i *BTreeMemTableIter) descendLast(node *btreeNode) {
+	for !i.tree.isLeaf(node) {
+		i.stack = append(i.stack, iterFrame{node, len(node.entries)})
+		node = node.children[len(node.entries)]
+	}
+	i.stack = append(i.stack, iterFrame{node, len(node.entries) - 1})
+}
+
+// 当前节点已经遍历完 向上找到下一个数据
+// 从第c个孩子返回时 父节点的第c个数据就是后继
+func (i *BTreeMemTableIter) ascendForward() {
+	for len(i.stack) > 0 && i.top().index >= len(i.top().node.entries) {
+		i.stack = i.stack[:len(i.stack)-1]
+	}
+}
+
+// 从第c个孩子返回时 父节点的第c-1个数据就是前驱
+func (i *BTreeMemTableIter) ascendBackward() {
+	for len(i.stack) > 0 && i.top().index < 0 {
+		i.stack = i.stack[:len(i.stack)-1]
+		if len(i.stack) > 0 {
+			i.top().index--
+		}
+	}
+}
+func (i *BTreeMemTableIter) next() {
+	top := i.top()
+	if i.tree.isLeaf(top.node) {
+		top.index++
+		i.ascendForward()
+		return
+	}
+	top.index++
+	i.descendFirst(top.node.children[top.index])
+}
+func (i *BTreeMemTableIter) prev() {
+	top := i.top()
+	if i.tree.isLeaf(top.node) {
+		top.index--
+		i.ascendBackward()
+		return
+	}
+	i.descendLast(top.node.children[top.index])
+}
@@ -0,0 +1,361 @@
+package memtable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/xia-Sang/bitcask/utils"
+)
+
+var indexTypes = []IndexType{BTreeIndex, SkipListIndex, ArtIndex}
+
+// 所有索引实现共用的测试
+func TestMemTableConformance(t *testing.T) {
+	suite := []struct {
+		name string
+		fn   func(t *testing.T, c Constructor)
+	}{
+		{"RandomOps", testRandomOps},
+		{"Iterate", testIterate},
+		{"PrefixKeys", testPrefixKeys},
+		{"WideFanout", testWideFanout},
+		{"ModifyDuringIteration", testModifyDuringIteration},
+		{"Clear", testClear},
+	}
+	constructors := map[string]Constructor{}
+	for _, typ := range indexTypes {
+		c, err := typ.Constructor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		constructors[typ.String()] = c
+	}
+	// 缓存很小 测试过程中会不断淘汰页
+	constructors[DiskBTreeIndex.String()] = func() MemTable {
+		return openTestDiskBTree(t, filepath.Join(t.TempDir(), "index"), 4)
+	}
+	for name, c := range constructors {
+		for _, tc := range suite {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				tc.fn(t, c)
+			})
+		}
+	}
+	if _, err := IndexType(100).Constructor(); err == nil {
+		t.Fatal("unknown index type should fail")
+	}
+}
+
+// 检查迭代器按顺序返回所有的key 并且前后移动与有序数组一致
+func checkOrder(t *testing.T, m MemTable, expect map[string]int) {
+	t.Helper()
+	keys := make([]string, 0, len(expect))
+	for k := range expect {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	iter := m.Iterator()
+	for _, k := range keys {
+		key, val := iter.Curr()
+		if !iter.Valid() || string(key) != k || val.(int) != expect[k] {
+			t.Fatalf("forward: got %q:%v want %q:%d", key, val, k, expect[k])
+		}
+		iter.Next()
+	}
+	if iter.Valid() {
+		key, _ := iter.Curr()
+		t.Fatalf("forward: unexpected key %q", key)
+	}
+	iter.SeekToLast()
+	for i := len(keys) - 1; i >= 0; i-- {
+		if key, _ := iter.Curr(); !iter.Valid() || string(key) != keys[i] {
+			t.Fatalf("backward: got %q want %q", key, keys[i])
+		}
+		iter.Prev()
+	}
+	if iter.Valid() {
+		t.Fatal("backward: iterator valid before the first key")
+	}
+}
+
+func testRandomOps(t *testing.T, c Constructor) {
+	m := c()
+	expect := map[string]int{}
+	for idx, i := range utils.RandomIntsInRange(5000, 0, 1000) {
+		key := utils.GenerateKey(i)
+		if idx%3 == 0 {
+			m.Delete(key)
+			delete(expect, string(key))
+		} else {
+			m.Put(key, idx)
+			expect[string(key)] = idx
+		}
+	}
+	for i := range 1000 {
+		key := utils.GenerateKey(i)
+		val, ok := m.Get(key)
+		want, exist := expect[string(key)]
+		if ok != exist || (ok && val.(int) != want) {
+			t.Fatalf("key %s: %v,%v want %v,%v", key, val, ok, want, exist)
+		}
+	}
+	checkOrder(t, m, expect)
+
+	// value 为 nil 时视为不存在
+	m.Put([]byte("nil-value"), nil)
+	if _, ok := m.Get([]byte("nil-value")); ok {
+		t.Fatal("nil value should not be found")
+	}
+}
+
+func testIterate(t *testing.T, c Constructor) {
+	m := c()
+	var keys []int
+	for i := 0; i < 2000; i += 2 {
+		m.Put(utils.GenerateKey(i), i)
+		keys = append(keys, i)
+	}
+	iter := m.Iterator()
+	for _, target := range utils.RandomIntsInRange(500, -1, 2001) {
+		iter.Seek(utils.GenerateKey(target))
+		idx := sort.SearchInts(keys, target)
+		if idx == len(keys) {
+			if iter.Valid() {
+				t.Fatalf("seek %d should be invalid", target)
+			}
+			continue
+		}
+		if _, val := iter.Curr(); !iter.Valid() || val.(int) != keys[idx] {
+			t.Fatalf("seek %d: %v want %d", target, val, keys[idx])
+		}
+		iter.Prev()
+		if idx == 0 {
+			if iter.Valid() {
+				t.Fatal("prev of the first key should be invalid")
+			}
+			continue
+		}
+		if _, val := iter.Curr(); val.(int) != keys[idx-1] {
+			t.Fatalf("prev of %d: %v want %d", target, val, keys[idx-1])
+		}
+		iter.Next()
+		iter.Next()
+		if idx+1 == len(keys) {
+			if iter.Valid() {
+				t.Fatal("next of the last key should be invalid")
+			}
+			continue
+		}
+		if _, val := iter.Curr(); val.(int) != keys[idx+1] {
+			t.Fatalf("next of %d: %v want %d", target, val, keys[idx+1])
+		}
+	}
+	// 失效之后 Next/Prev 不再移动
+	iter.SeekToLast()
+	iter.Next()
+	iter.Prev()
+	if iter.Valid() {
+		t.Fatal("invalid iterator should stay invalid")
+	}
+}
+
+// key 互为前缀 以及包含任意字节
+func testPrefixKeys(t *testing.T, c Constructor) {
+	m := c()
+	expect := map[string]int{}
+	put := func(key string, val int) {
+		m.Put([]byte(key), val)
+		expect[key] = val
+	}
+	for i, key := range []string{"", "a", "ab", "abc", "abd", "b", "ba", "a\x00", "a\xff", "\xff\xff"} {
+		put(key, i)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := range 2000 {
+		key := make([]byte, r.Intn(6))
+		for j := range key {
+			key[j] = "ab\x00\xff"[r.Intn(4)]
+		}
+		put(string(key), i)
+	}
+	checkOrder(t, m, expect)
+	for key := range expect {
+		if len(key)%2 == 0 {
+			m.Delete([]byte(key))
+			delete(expect, key)
+		}
+	}
+	checkOrder(t, m, expect)
+	for key, want := range expect {
+		if val, ok := m.Get([]byte(key)); !ok || val.(int) != want {
+			t.Fatalf("key %q: %v,%v want %d", key, val, ok, want)
+		}
+	}
+	for key := range expect {
+		m.Delete([]byte(key))
+	}
+	if m.Iterator().Valid() {
+		t.Fatal("memtable should be empty")
+	}
+}
+
+// 同一个位置上出现所有的字节 节点需要扩大再缩小
+func testWideFanout(t *testing.T, c Constructor) {
+	m := c()
+	expect := map[string]int{}
+	for i := range 256 {
+		for _, key := range []string{string([]byte{byte(i)}), string([]byte{'k', byte(i), 'v'})} {
+			m.Put([]byte(key), i)
+			expect[key] = i
+		}
+	}
+	checkOrder(t, m, expect)
+	r := rand.New(rand.NewSource(2))
+	for _, i := range r.Perm(256) {
+		key := string([]byte{'k', byte(i), 'v'})
+		m.Delete([]byte(key))
+		delete(expect, key)
+		if len(expect)%50 == 0 {
+			checkOrder(t, m, expect)
+		}
+	}
+	checkOrder(t, m, expect)
+}
+
+// 遍历过程中修改数据 之后的遍历能看到最新的数据 并且不会重复返回同一个key
+func testModifyDuringIteration(t *testing.T, c Constructor) {
+	m := c()
+	for i := 0; i < 100; i += 2 {
+		m.Put(utils.GenerateKey(i), i)
+	}
+	iter := m.Iterator()
+	iter.Seek(utils.GenerateKey(10))
+	m.Delete(utils.GenerateKey(10))
+	m.Delete(utils.GenerateKey(12))
+	m.Put(utils.GenerateKey(13), 13)
+	iter.Next()
+	if _, val := iter.Curr(); val.(int) != 13 {
+		t.Fatalf("next after modify: %v", val)
+	}
+	m.Put(utils.GenerateKey(11), 11)
+	iter.Prev()
+	if _, val := iter.Curr(); val.(int) != 11 {
+		t.Fatalf("prev after modify: %v", val)
+	}
+
+	var last []byte
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key, _ := iter.Curr()
+		if last != nil && bytes.Compare(key, last) <= 0 {
+			t.Fatalf("key %s after %s", key, last)
+		}
+		last = key
+		// 删除当前key 在已经遍历过的位置插入新的key
+		m.Delete(key)
+		m.Put(append([]byte("a-"), key...), 0)
+	}
+}
+
+func testClear(t *testing.T, c Constructor) {
+	m := c()
+	for i := range 100 {
+		m.Put(utils.GenerateKey(i), i)
+	}
+	m.Clear()
+	if _, ok := m.Get(utils.GenerateKey(1)); ok {
+		t.Fatal("key found after clear")
+	}
+}
+
+// 不同形状的key
+var keyShapes = []struct {
+	name string
+	gen  func(i int) []byte
+}{
+	{"sequential", utils.GenerateKey},
+	{"random", func(i int) []byte {
+		return []byte(fmt.Sprintf("%016x", uint64(i)*0x9e3779b97f4a7c15))
+	}},
+	{"shared-prefix", func(i int) []byte {
+		return []byte(fmt.Sprintf("user:%06d:profile:%d", i/10, i%10))
+	}},
+}
+
+func benchKeys(gen func(int) []byte, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = gen(i)
+	}
+	rand.New(rand.NewSource(1)).Shuffle(n, func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys
+}
+
+func benchmarkIndexes(b *testing.B, fn func(b *testing.B, c Constructor, keys [][]byte)) {
+	const n = 100000
+	for _, shape := range keyShapes {
+		keys := benchKeys(shape.gen, n)
+		for _, typ := range indexTypes {
+			c, _ := typ.Constructor()
+			b.Run(shape.name+"/"+typ.String(), func(b *testing.B) {
+				fn(b, c, keys)
+			})
+		}
+		b.Run(shape.name+"/"+DiskBTreeIndex.String(), func(b *testing.B) {
+			fn(b, func() MemTable {
+				d, err := OpenDiskBTreeMemTable(filepath.Join(b.TempDir(), "index"), DiskBTreeOptions{Codec: intCodec{}})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() { d.Close() })
+				return d
+			}, keys)
+		})
+	}
+}
+
+func BenchmarkMemTablePut(b *testing.B) {
+	benchmarkIndexes(b, func(b *testing.B, c Constructor, keys [][]byte) {
+		m := c()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.Put(keys[i%len(keys)], i)
+		}
+	})
+}
+
+func BenchmarkMemTableGet(b *testing.B) {
+	benchmarkIndexes(b, func(b *testing.B, c Constructor, keys [][]byte) {
+		m := c()
+		for i, key := range keys {
+			m.Put(key, i)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.Get(keys[i%len(keys)])
+		}
+	})
+}
+
+func BenchmarkMemTableIterate(b *testing.B) {
+	benchmarkIndexes(b, func(b *testing.B, c Constructor, keys [][]byte) {
+		m := c()
+		for i, key := range keys {
+			m.Put(key, i)
+		}
+		b.ResetTimer()
+		iter := m.Iterator()
+		for i := 0; i < b.N; i++ {
+			if !iter.Valid() {
+				iter.SeekToFirst()
+			}
+			iter.Next()
+		}
+	})
+}
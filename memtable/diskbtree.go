@@ -0,0 +1,878 @@
+package memtable
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 磁盘b+树 key和编码之后的value保存在叶子页中 叶子页之间通过 prev/next 连接
+// 第0页是元数据页 记录根节点 页数 空闲页 以及调用方的检查点
+// 修改只发生在缓存中 Flush 时写回所有脏页并在最后写入元数据
+// 元数据中的 clean 标记表示磁盘上的页与检查点一致 缓存淘汰时需要提前写回脏页 此时会先清除该标记
+// 删除时不做合并 只回收变空的节点
+
+const (
+	diskPageSize = 4096
+	diskMagic    = "BCBPTREE"
+	diskVersion  = 1
+
+	// DiskBTreeMaxKeySize 保证每一页至少可以存放三个数据 分裂之后两边都不会超过一页
+	DiskBTreeMaxKeySize = 1024
+
+	pageTypeLeaf   = 1
+	pageTypeBranch = 2
+	pageTypeFree   = 3
+
+	defaultDiskCacheSize = 1024 //默认缓存的页数
+)
+
+var (
+	ErrKeyTooLarge    = errors.New("key too large")
+	ErrIndexCorrupted = errors.New("index file corrupted")
+	ErrIndexReadOnly  = errors.New("index is read only")
+)
+
+// ValueCodec 磁盘索引中value的编码方式
+type ValueCodec interface {
+	Encode(value interface{}) []byte
+	Decode(buf []byte) interface{}
+}
+
+// DiskBTreeOptions 磁盘索引的配置
+type DiskBTreeOptions struct {
+	Codec     ValueCodec
+	CacheSize int  //缓存的页数
+	ReadOnly  bool //只读模式下脏页不会被淘汰 也不会写回
+}
+
+type diskNode struct {
+	id       uint32
+	leaf     bool
+	keys     [][]byte
+	values   [][]byte //叶子节点
+	children []uint32 //内部节点 比 keys 多一个
+	prev     uint32   //叶子节点的兄弟 0表示不存在
+	next     uint32
+	dirty    bool
+	elem     *list.Element
+}
+
+// 序列化之后的大小
+func (n *diskNode) encodedSize() int {
+	size := 1 + 2 + 8 + 4
+	for i, key := range n.keys {
+		size += uvarintLen(len(key)) + len(key)
+		if n.leaf {
+			size += uvarintLen(len(n.values[i])) + len(n.values[i])
+		} else {
+			size += 4
+		}
+	}
+	if !n.leaf {
+		size += 4
+	}
+	return size
+}
+
+// 页格式 type+count+prev+next+entries+crc
+// 叶子节点 entry 为 keySize+key+valueSize+value
+// 内部节点 首先是第一个孩子 之后 entry 为 keySize+key+child
+func (n *diskNode) encode() []byte {
+	buf := make([]byte, diskPageSize)
+	if n.leaf {
+		buf[0] = pageTypeLeaf
+	} else {
+		buf[0] = pageTypeBranch
+	}
+	binary.LittleEndian.PutUint16(buf[1:], uint16(len(n.keys)))
+	binary.LittleEndian.PutUint32(buf[3:], n.prev)
+	binary.LittleEndian.PutUint32(buf[7:], n.next)
+	index := 11
+	if !n.leaf {
+		binary.LittleEndian.PutUint32(buf[index:], n.children[0])
+		index += 4
+	}
+	for i, key := range n.keys {
+		index += binary.PutUvarint(buf[index:], uint64(len(key)))
+		index += copy(buf[index:], key)
+		if n.leaf {
+			index += binary.PutUvarint(buf[index:], uint64(len(n.values[i])))
+			index += copy(buf[index:], n.values[i])
+		} else {
+			binary.LittleEndian.PutUint32(buf[index:], n.children[i+1])
+			index += 4
+		}
+	}
+	putPageCrc(buf)
+	return buf
+}
+func decodeDiskNode(id uint32, buf []byte) (*diskNode, error) {
+	if !checkPageCrc(buf) || (buf[0] != pageTypeLeaf && buf[0] != pageTypeBranch) {
+		return nil, fmt.Errorf("%w: page %d", ErrIndexCorrupted, id)
+	}
+	n := &diskNode{id: id, leaf: buf[0] == pageTypeLeaf}
+	count := int(binary.LittleEndian.Uint16(buf[1:]))
+	n.prev = binary.LittleEndian.Uint32(buf[3:])
+	n.next = binary.LittleEndian.Uint32(buf[7:])
+	body := buf[11 : diskPageSize-4]
+	readBytes := func() ([]byte, bool) {
+		size, m := binary.Uvarint(body)
+		if m <= 0 || uint64(len(body)-m) < size {
+			return nil, false
+		}
+		b := bytes.Clone(body[m : m+int(size)])
+		body = body[m+int(size):]
+		return b, true
+	}
+	readChild := func() (uint32, bool) {
+		if len(body) < 4 {
+			return 0, false
+		}
+		child := binary.LittleEndian.Uint32(body)
+		body = body[4:]
+		return child, true
+	}
+	if !n.leaf {
+		child, ok := readChild()
+		if !ok {
+			return nil, fmt.Errorf("%w: page %d", ErrIndexCorrupted, id)
+		}
+		n.children = append(n.children, child)
+	}
+	for range count {
+		key, ok := readBytes()
+		if !ok {
+			return nil, fmt.Errorf("%w: page %d", ErrIndexCorrupted, id)
+		}
+		n.keys = append(n.keys, key)
+		if n.leaf {
+			val, ok := readBytes()
+			if !ok {
+				return nil, fmt.Errorf("%w: page %d", ErrIndexCorrupted, id)
+			}
+			n.values = append(n.values, val)
+		} else {
+			child, ok := readChild()
+			if !ok {
+				return nil, fmt.Errorf("%w: page %d", ErrIndexCorrupted, id)
+			}
+			n.children = append(n.children, child)
+		}
+	}
+	return n, nil
+}
+
+// 第一个大于等于key的位置
+func (n *diskNode) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// 内部节点中key所在的孩子 孩子i中的key小于keys[i] 大于等于keys[i-1]
+func (n *diskNode) childIndex(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) > 0
+	})
+}
+
+func uvarintLen(x int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(x))
+}
+func putPageCrc(buf []byte) {
+	binary.LittleEndian.PutUint32(buf[diskPageSize-4:], crc32.ChecksumIEEE(buf[:diskPageSize-4]))
+}
+func checkPageCrc(buf []byte) bool {
+	return binary.LittleEndian.Uint32(buf[diskPageSize-4:]) == crc32.ChecksumIEEE(buf[:diskPageSize-4])
+}
+
+type diskBTree struct {
+	mu         sync.Mutex
+	fp         *os.File
+	opts       DiskBTreeOptions
+	root       uint32 //0表示空树
+	pageCount  uint32
+	free       []uint32 //空闲页
+	size       int
+	clean      bool //磁盘上的页与检查点一致
+	checkpoint []byte
+	version    uint64 //每次修改递增 迭代器据此发现修改
+
+	cache map[uint32]*diskNode //页缓存
+	lru   *list.List
+}
+
+func openDiskBTree(path string, opts DiskBTreeOptions) (*diskBTree, error) {
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultDiskCacheSize
+	}
+	flag := os.O_RDWR | os.O_CREATE
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := &diskBTree{fp: fp, opts: opts, cache: map[uint32]*diskNode{}, lru: list.New()}
+	stat, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		if opts.ReadOnly {
+			fp.Close()
+			return nil, fmt.Errorf("%w: empty file", ErrIndexCorrupted)
+		}
+		t.pageCount = 1
+		if err := t.writeMeta(); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		return t, nil
+	}
+	if err := t.readMeta(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// 元数据页 magic+version+root+pageCount+freeHead+size+clean+checkpointSize+checkpoint+crc
+func (t *diskBTree) writeMeta() error {
+	if len(t.checkpoint) > diskPageSize/2 {
+		return errors.New("checkpoint too large")
+	}
+	buf := make([]byte, diskPageSize)
+	index := copy(buf, diskMagic)
+	binary.LittleEndian.PutUint32(buf[index:], diskVersion)
+	binary.LittleEndian.PutUint32(buf[index+4:], t.root)
+	binary.LittleEndian.PutUint32(buf[index+8:], t.pageCount)
+	var freeHead uint32
+	if len(t.free) > 0 {
+		freeHead = t.free[0]
+	}
+	binary.LittleEndian.PutUint32(buf[index+12:], freeHead)
+	binary.LittleEndian.PutUint64(buf[index+16:], uint64(t.size))
+	index += 24
+	if t.clean {
+		buf[index] = 1
+	}
+	index++
+	index += binary.PutUvarint(buf[index:], uint64(len(t.checkpoint)))
+	copy(buf[index:], t.checkpoint)
+	putPageCrc(buf)
+	if _, err := t.fp.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return t.fp.Sync()
+}
+func (t *diskBTree) readMeta() error {
+	buf := make([]byte, diskPageSize)
+	if _, err := io.ReadFull(io.NewSectionReader(t.fp, 0, diskPageSize), buf); err != nil {
+		return fmt.Errorf("%w: %v", ErrIndexCorrupted, err)
+	}
+	if !checkPageCrc(buf) || string(buf[:len(diskMagic)]) != diskMagic {
+		return fmt.Errorf("%w: bad meta page", ErrIndexCorrupted)
+	}
+	index := len(diskMagic)
+	if version := binary.LittleEndian.Uint32(buf[index:]); version != diskVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrIndexCorrupted, version)
+	}
+	t.root = binary.LittleEndian.Uint32(buf[index+4:])
+	t.pageCount = binary.LittleEndian.Uint32(buf[index+8:])
+	freeHead := binary.LittleEndian.Uint32(buf[index+12:])
+	t.size = int(binary.LittleEndian.Uint64(buf[index+16:]))
+	index += 24
+	t.clean = buf[index] == 1
+	index++
+	size, n := binary.Uvarint(buf[index:])
+	if n <= 0 || size > diskPageSize/2 {
+		return fmt.Errorf("%w: bad checkpoint", ErrIndexCorrupted)
+	}
+	t.checkpoint = bytes.Clone(buf[index+n : index+n+int(size)])
+	// 空闲页通过页首的指针串联起来
+	for id := freeHead; id != 0; {
+		page, err := t.readPage(id)
+		if err != nil {
+			return err
+		}
+		if page[0] != pageTypeFree || !checkPageCrc(page) {
+			return fmt.Errorf("%w: bad free page %d", ErrIndexCorrupted, id)
+		}
+		t.free = append(t.free, id)
+		id = binary.LittleEndian.Uint32(page[1:])
+		if len(t.free) > int(t.pageCount) {
+			return fmt.Errorf("%w: free list loop", ErrIndexCorrupted)
+		}
+	}
+	return nil
+}
+
+func (t *diskBTree) readPage(id uint32) ([]byte, error) {
+	if id == 0 || id >= t.pageCount {
+		return nil, fmt.Errorf("%w: page %d out of range", ErrIndexCorrupted, id)
+	}
+	buf := make([]byte, diskPageSize)
+	if _, err := t.fp.ReadAt(buf, int64(id)*diskPageSize); err != nil {
+		return nil, fmt.Errorf("%w: page %d: %v", ErrIndexCorrupted, id, err)
+	}
+	return buf, nil
+}
+func (t *diskBTree) writePage(id uint32, buf []byte) error {
+	_, err := t.fp.WriteAt(buf, int64(id)*diskPageSize)
+	return err
+}
+
+// 读取节点 优先从缓存中获取
+func (t *diskBTree) node(id uint32) (*diskNode, error) {
+	if n, ok := t.cache[id]; ok {
+		t.lru.MoveToFront(n.elem)
+		return n, nil
+	}
+	buf, err := t.readPage(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := decodeDiskNode(id, buf)
+	if err != nil {
+		return nil, err
+	}
+	t.cacheNode(n)
+	return n, nil
+}
+func (t *diskBTree) cacheNode(n *diskNode) {
+	n.elem = t.lru.PushFront(n)
+	t.cache[n.id] = n
+}
+func (t *diskBTree) alloc(leaf bool) *diskNode {
+	var id uint32
+	if len(t.free) > 0 {
+		id, t.free = t.free[0], t.free[1:]
+	} else {
+		id = t.pageCount
+		t.pageCount++
+	}
+	n := &diskNode{id: id, leaf: leaf, dirty: true}
+	t.cacheNode(n)
+	return n
+}
+func (t *diskBTree) release(n *diskNode) {
+	t.lru.Remove(n.elem)
+	delete(t.cache, n.id)
+	t.free = append(t.free, n.id)
+}
+
+// 第一次在检查点之外写入页时 先清除元数据中的 clean 标记
+func (t *diskBTree) markDirty() error {
+	if !t.clean {
+		return nil
+	}
+	t.clean = false
+	return t.writeMeta()
+}
+
+// 淘汰最久没有使用的页 只在一次操作完成之后调用 保证操作过程中的节点不会失效
+func (t *diskBTree) trim() error {
+	for elem := t.lru.Back(); elem != nil && len(t.cache) > t.opts.CacheSize; {
+		n := elem.Value.(*diskNode)
+		elem = elem.Prev()
+		if n.dirty {
+			if t.opts.ReadOnly {
+				continue
+			}
+			if err := t.markDirty(); err != nil {
+				return err
+			}
+			if err := t.writePage(n.id, n.encode()); err != nil {
+				return err
+			}
+		}
+		t.lru.Remove(n.elem)
+		delete(t.cache, n.id)
+	}
+	return nil
+}
+
+// 写回所有的脏页和空闲页 最后写入带有检查点的元数据
+func (t *diskBTree) flush(checkpoint []byte) error {
+	if t.opts.ReadOnly {
+		return ErrIndexReadOnly
+	}
+	if err := t.markDirty(); err != nil {
+		return err
+	}
+	for _, n := range t.cache {
+		if !n.dirty {
+			continue
+		}
+		if err := t.writePage(n.id, n.encode()); err != nil {
+			return err
+		}
+		n.dirty = false
+	}
+	for i, id := range t.free {
+		buf := make([]byte, diskPageSize)
+		buf[0] = pageTypeFree
+		if i+1 < len(t.free) {
+			binary.LittleEndian.PutUint32(buf[1:], t.free[i+1])
+		}
+		putPageCrc(buf)
+		if err := t.writePage(id, buf); err != nil {
+			return err
+		}
+	}
+	if err := t.fp.Truncate(int64(t.pageCount) * diskPageSize); err != nil {
+		return err
+	}
+	if err := t.fp.Sync(); err != nil {
+		return err
+	}
+	t.clean = true
+	t.checkpoint = bytes.Clone(checkpoint)
+	return t.writeMeta()
+}
+
+// 从根节点下降到key所在的叶子 返回路径以及每一层选择的孩子
+func (t *diskBTree) descend(key []byte) ([]*diskNode, []int, error) {
+	var path []*diskNode
+	var indexes []int
+	for id := t.root; ; {
+		n, err := t.node(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		path = append(path, n)
+		if n.leaf {
+			return path, indexes, nil
+		}
+		i := n.childIndex(key)
+		indexes = append(indexes, i)
+		id = n.children[i]
+	}
+}
+
+func (t *diskBTree) get(key []byte) ([]byte, bool, error) {
+	if t.root == 0 {
+		return nil, false, nil
+	}
+	path, _, err := t.descend(key)
+	if err != nil {
+		return nil, false, err
+	}
+	leaf := path[len(path)-1]
+	i, found := leaf.search(key)
+	if !found {
+		return nil, false, nil
+	}
+	return leaf.values[i], true, nil
+}
+
+func (t *diskBTree) put(key, value []byte) error {
+	if len(key) > DiskBTreeMaxKeySize {
+		return fmt.Errorf("%w: %d bytes", ErrKeyTooLarge, len(key))
+	}
+	key = bytes.Clone(key)
+	t.version++
+	if t.root == 0 {
+		n := t.alloc(true)
+		n.keys, n.values = [][]byte{key}, [][]byte{value}
+		t.root = n.id
+		t.size++
+		return nil
+	}
+	path, indexes, err := t.descend(key)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1]
+	leaf.dirty = true
+	i, found := leaf.search(key)
+	if found {
+		leaf.values[i] = value
+		return nil
+	}
+	leaf.keys = insertAt(leaf.keys, i, key)
+	leaf.values = insertAt(leaf.values, i, value)
+	t.size++
+	return t.split(path, indexes)
+}
+
+// 自底向上分裂超过一页的节点
+func (t *diskBTree) split(path []*diskNode, indexes []int) error {
+	for level := len(path) - 1; level >= 0; level-- {
+		n := path[level]
+		if n.encodedSize() <= diskPageSize {
+			return nil
+		}
+		// 按照字节数找到中间的位置
+		mid, size, half := 0, 0, n.encodedSize()/2
+		for mid < len(n.keys)-1 && size < half {
+			size += len(n.keys[mid])
+			if n.leaf {
+				size += len(n.values[mid])
+			}
+			size += 8
+			mid++
+		}
+		mid = max(mid, 1)
+
+		m := t.alloc(n.leaf)
+		var sep []byte
+		if n.leaf {
+			m.keys = append([][]byte(nil), n.keys[mid:]...)
+			m.values = append([][]byte(nil), n.values[mid:]...)
+			n.keys, n.values = n.keys[:mid:mid], n.values[:mid:mid]
+			sep = m.keys[0]
+			m.prev, m.next = n.id, n.next
+			if n.next != 0 {
+				next, err := t.node(n.next)
+				if err != nil {
+					return err
+				}
+				next.prev = m.id
+				next.dirty = true
+			}
+			n.next = m.id
+		} else {
+			sep = n.keys[mid]
+			m.keys = append([][]byte(nil), n.keys[mid+1:]...)
+			m.children = append([]uint32(nil), n.children[mid+1:]...)
+			n.keys, n.children = n.keys[:mid:mid], n.children[:mid+1:mid+1]
+		}
+		n.dirty = true
+
+		if level == 0 {
+			root := t.alloc(false)
+			root.keys = [][]byte{sep}
+			root.children = []uint32{n.id, m.id}
+			t.root = root.id
+			return nil
+		}
+		parent, ci := path[level-1], indexes[level-1]
+		parent.keys = insertAt(parent.keys, ci, sep)
+		parent.children = insertAt(parent.children, ci+1, m.id)
+		parent.dirty = true
+	}
+	return nil
+}
+
+func (t *diskBTree) remove(key []byte) error {
+	if t.root == 0 {
+		return nil
+	}
+	path, indexes, err := t.descend(key)
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1]
+	i, found := leaf.search(key)
+	if !found {
+		return nil
+	}
+	t.version++
+	t.size--
+	leaf.keys = removeAt(leaf.keys, i)
+	leaf.values = removeAt(leaf.values, i)
+	leaf.dirty = true
+	if len(leaf.keys) > 0 {
+		return nil
+	}
+	// 叶子变空 从兄弟链表和父节点中移除
+	for _, id := range []uint32{leaf.prev, leaf.next} {
+		if id == 0 {
+			continue
+		}
+		sibling, err := t.node(id)
+		if err != nil {
+			return err
+		}
+		if id == leaf.prev {
+			sibling.next = leaf.next
+		} else {
+			sibling.prev = leaf.prev
+		}
+		sibling.dirty = true
+	}
+	return t.removeChild(path, indexes, len(path)-1)
+}
+
+// 删除 path[level] 节点 父节点只剩一个孩子时由孩子代替父节点
+func (t *diskBTree) removeChild(path []*diskNode, indexes []int, level int) error {
+	n := path[level]
+	t.release(n)
+	if level == 0 {
+		t.root = 0
+		return nil
+	}
+	parent, ci := path[level-1], indexes[level-1]
+	parent.dirty = true
+	parent.children = removeAt(parent.children, ci)
+	parent.keys = removeAt(parent.keys, max(ci-1, 0))
+	if len(parent.children) > 1 {
+		return nil
+	}
+	only := parent.children[0]
+	t.release(parent)
+	if level == 1 {
+		t.root = only
+		return nil
+	}
+	grand, pi := path[level-2], indexes[level-2]
+	grand.children[pi] = only
+	grand.dirty = true
+	return nil
+}
+
+func (t *diskBTree) clear() error {
+	if t.opts.ReadOnly {
+		return ErrIndexReadOnly
+	}
+	t.root, t.pageCount, t.free, t.size = 0, 1, nil, 0
+	t.cache, t.lru = map[uint32]*diskNode{}, list.New()
+	t.clean, t.checkpoint = false, nil
+	t.version++
+	if err := t.fp.Truncate(diskPageSize); err != nil {
+		return err
+	}
+	return t.writeMeta()
+}
+
+// 最左边和最右边的叶子
+func (t *diskBTree) edgeLeaf(last bool) (*diskNode, error) {
+	if t.root == 0 {
+		return nil, nil
+	}
+	for id := t.root; ; {
+		n, err := t.node(id)
+		if err != nil {
+			return nil, err
+		}
+		if n.leaf {
+			return n, nil
+		}
+		if last {
+			id = n.children[len(n.children)-1]
+		} else {
+			id = n.children[0]
+		}
+	}
+}
+
+// 检查b+树的性质 供测试使用
+func (t *diskBTree) validate() error {
+	if t.root == 0 {
+		if t.size != 0 {
+			return fmt.Errorf("empty tree with size %d", t.size)
+		}
+		return nil
+	}
+	count := 0
+	var lastLeaf uint32
+	var lastKey []byte
+	var walk func(id uint32, lower, upper []byte, depth int, leafDepth *int) error
+	walk = func(id uint32, lower, upper []byte, depth int, leafDepth *int) error {
+		n, err := t.node(id)
+		if err != nil {
+			return err
+		}
+		if n.encodedSize() > diskPageSize {
+			return fmt.Errorf("page %d overflow", id)
+		}
+		for _, key := range n.keys {
+			if lower != nil && bytes.Compare(key, lower) < 0 || upper != nil && bytes.Compare(key, upper) >= 0 {
+				return fmt.Errorf("page %d key %q out of range", id, key)
+			}
+		}
+		if n.leaf {
+			if *leafDepth == 0 {
+				*leafDepth = depth
+			} else if *leafDepth != depth {
+				return fmt.Errorf("page %d depth %d != %d", id, depth, *leafDepth)
+			}
+			if len(n.keys) == 0 {
+				return fmt.Errorf("empty leaf %d", id)
+			}
+			if n.prev != lastLeaf {
+				return fmt.Errorf("leaf %d prev %d != %d", id, n.prev, lastLeaf)
+			}
+			for _, key := range n.keys {
+				if lastKey != nil && bytes.Compare(key, lastKey) <= 0 {
+					return fmt.Errorf("leaf %d key %q not sorted", id, key)
+				}
+				lastKey = key
+			}
+			lastLeaf = id
+			count += len(n.keys)
+			return nil
+		}
+		if len(n.children) != len(n.keys)+1 || len(n.children) < 2 {
+			return fmt.Errorf("branch %d has %d keys %d children", id, len(n.keys), len(n.children))
+		}
+		for i, child := range n.children {
+			lo, hi := lower, upper
+			if i > 0 {
+				lo = n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				hi = n.keys[i]
+			}
+			if err := walk(child, lo, hi, depth+1, leafDepth); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	leafDepth := 0
+	if err := walk(t.root, nil, nil, 1, &leafDepth); err != nil {
+		return err
+	}
+	if count != t.size {
+		return fmt.Errorf("size %d != %d", count, t.size)
+	}
+	return nil
+}
+
+// DiskBTreeMemTable 持久化在磁盘上的索引 数据量可以超过内存
+// MemTable 接口没有返回错误 读写文件出错时记录下来 通过 Err 获取
+type DiskBTreeMemTable struct {
+	tree *diskBTree
+	err  error
+}
+
+// OpenDiskBTreeMemTable 打开或者创建磁盘索引
+func OpenDiskBTreeMemTable(path string, opts DiskBTreeOptions) (*DiskBTreeMemTable, error) {
+	if opts.Codec == nil {
+		return nil, errors.New("value codec is required")
+	}
+	tree, err := openDiskBTree(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskBTreeMemTable{tree: tree}, nil
+}
+
+func (d *DiskBTreeMemTable) setErr(err error) {
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+}
+
+// Err 返回第一次读写文件时发生的错误
+func (d *DiskBTreeMemTable) Err() error {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	return d.err
+}
+
+// MaxKeySize 可以存放的最大key
+func (d *DiskBTreeMemTable) MaxKeySize() int {
+	return DiskBTreeMaxKeySize
+}
+func (d *DiskBTreeMemTable) Put(key []byte, value interface{}) {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	d.setErr(d.tree.put(key, d.tree.opts.Codec.Encode(value)))
+	d.setErr(d.tree.trim())
+}
+func (d *DiskBTreeMemTable) Get(key []byte) (interface{}, bool) {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	buf, ok, err := d.tree.get(key)
+	d.setErr(err)
+	d.setErr(d.tree.trim())
+	if !ok {
+		return nil, false
+	}
+	val := d.tree.opts.Codec.Decode(buf)
+	return val, val != nil
+}
+func (d *DiskBTreeMemTable) Delete(key []byte) {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	d.setErr(d.tree.remove(key))
+	d.setErr(d.tree.trim())
+}
+func (d *DiskBTreeMemTable) Show() {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	leaf, err := d.tree.edgeLeaf(false)
+	for err == nil && leaf != nil {
+		for i, key := range leaf.keys {
+			fmt.Printf("page:%d (%s:%v)\n", leaf.id, key, d.tree.opts.Codec.Decode(leaf.values[i]))
+		}
+		if leaf.next == 0 {
+			break
+		}
+		leaf, err = d.tree.node(leaf.next)
+	}
+	d.setErr(err)
+}
+func (d *DiskBTreeMemTable) Iterator() Iterator {
+	iter := &DiskBTreeMemTableIter{table: d}
+	iter.SeekToFirst()
+	return iter
+}
+
+// Clear 清空索引文件
+func (d *DiskBTreeMemTable) Clear() {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	d.setErr(d.tree.clear())
+}
+
+// Checkpoint 返回上一次 Flush 时记录的检查点 索引与检查点不一致时返回nil
+func (d *DiskBTreeMemTable) Checkpoint() []byte {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	if !d.tree.clean {
+		return nil
+	}
+	return d.tree.checkpoint
+}
+
+// Flush 写回所有的修改 并记录检查点
+func (d *DiskBTreeMemTable) Flush(checkpoint []byte) error {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	return d.tree.flush(checkpoint)
+}
+
+// MarkDirty 清除磁盘上的 clean 标记 之后的 Checkpoint 返回nil
+// 在数据文件发生无法通过检查点回放的变化之前调用 比如合并替换文件
+func (d *DiskBTreeMemTable) MarkDirty() error {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	if d.tree.opts.ReadOnly {
+		return ErrIndexReadOnly
+	}
+	return d.tree.markDirty()
+}
+
+// Close 关闭索引文件 没有 Flush 的修改会丢失
+func (d *DiskBTreeMemTable) Close() error {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	return d.tree.fp.Close()
+}
+
+// Validate 检查b+树的性质 供测试使用
+func (d *DiskBTreeMemTable) Validate() error {
+	d.tree.mu.Lock()
+	defer d.tree.mu.Unlock()
+	return d.tree.validate()
+}
@@ -0,0 +1,157 @@
+package memtable
+
+import "bytes"
+
+// DiskBTreeMemTableIter 沿着叶子链表遍历
+// 记录当前所在的叶子页和下标 树被修改之后从当前key重新定位
+type DiskBTreeMemTableIter struct {
+	table   *DiskBTreeMemTable
+	leaf    uint32
+	index   int
+	version uint64 //定位时树的版本
+	key     []byte
+	value   interface{}
+	valid   bool
+}
+
+func (i *DiskBTreeMemTableIter) Valid() bool {
+	return i.valid
+}
+func (i *DiskBTreeMemTableIter) Curr() ([]byte, interface{}) {
+	return i.key, i.value
+}
+func (i *DiskBTreeMemTableIter) SeekToFirst() {
+	i.lock()
+	defer i.unlock()
+	leaf, err := i.table.tree.edgeLeaf(false)
+	i.set(leaf, 0, err)
+}
+func (i *DiskBTreeMemTableIter) SeekToLast() {
+	i.lock()
+	defer i.unlock()
+	leaf, err := i.table.tree.edgeLeaf(true)
+	if leaf == nil {
+		i.set(nil, 0, err)
+		return
+	}
+	i.set(leaf, len(leaf.keys)-1, err)
+}
+func (i *DiskBTreeMemTableIter) Seek(key []byte) {
+	i.lock()
+	defer i.unlock()
+	i.seek(key)
+}
+func (i *DiskBTreeMemTableIter) Next() {
+	if !i.valid {
+		return
+	}
+	i.lock()
+	defer i.unlock()
+
+	if i.version != i.table.tree.version {
+		// 树被修改过 从当前key重新定位到第一个更大的key
+		key := i.key
+		i.seek(key)
+		if !i.valid || !bytes.Equal(i.key, key) {
+			return
+		}
+	}
+	leaf, err := i.table.tree.node(i.leaf)
+	if err != nil {
+		i.set(nil, 0, err)
+		return
+	}
+	i.forward(leaf, i.index+1)
+}
+func (i *DiskBTreeMemTableIter) Prev() {
+	if !i.valid {
+		return
+	}
+	i.lock()
+	defer i.unlock()
+
+	if i.version != i.table.tree.version {
+		// 树被修改过 从当前key重新定位到最后一个更小的key
+		key := i.key
+		i.seek(key)
+		if !i.valid {
+			leaf, err := i.table.tree.edgeLeaf(true)
+			if leaf == nil {
+				i.set(nil, 0, err)
+				return
+			}
+			i.set(leaf, len(leaf.keys)-1, err)
+			return
+		}
+	}
+	leaf, err := i.table.tree.node(i.leaf)
+	if err != nil {
+		i.set(nil, 0, err)
+		return
+	}
+	if i.index > 0 {
+		i.set(leaf, i.index-1, nil)
+		return
+	}
+	if leaf.prev == 0 {
+		i.set(nil, 0, nil)
+		return
+	}
+	prev, err := i.table.tree.node(leaf.prev)
+	if err != nil {
+		i.set(nil, 0, err)
+		return
+	}
+	i.set(prev, len(prev.keys)-1, nil)
+}
+
+// 迭代器同样会读取页 结束时需要淘汰缓存
+func (i *DiskBTreeMemTableIter) lock() {
+	i.table.tree.mu.Lock()
+}
+func (i *DiskBTreeMemTableIter) unlock() {
+	i.table.setErr(i.table.tree.trim())
+	i.table.tree.mu.Unlock()
+}
+
+// 定位到第一个大于等于key的位置
+func (i *DiskBTreeMemTableIter) seek(key []byte) {
+	if i.table.tree.root == 0 {
+		i.set(nil, 0, nil)
+		return
+	}
+	path, _, err := i.table.tree.descend(key)
+	if err != nil {
+		i.set(nil, 0, err)
+		return
+	}
+	leaf := path[len(path)-1]
+	idx, _ := leaf.search(key)
+	i.forward(leaf, idx)
+}
+
+// 从叶子的第index个位置开始 超出之后移动到下一个叶子
+func (i *DiskBTreeMemTableIter) forward(leaf *diskNode, index int) {
+	if index < len(leaf.keys) {
+		i.set(leaf, index, nil)
+		return
+	}
+	if leaf.next == 0 {
+		i.set(nil, 0, nil)
+		return
+	}
+	next, err := i.table.tree.node(leaf.next)
+	i.set(next, 0, err)
+}
+
+// 调用方需要持有锁
+func (i *DiskBTreeMemTableIter) set(leaf *diskNode, index int, err error) {
+	i.table.setErr(err)
+	i.version = i.table.tree.version
+	if err != nil || leaf == nil {
+		i.leaf, i.index, i.valid, i.key, i.value = 0, 0, false, nil, nil
+		return
+	}
+	i.leaf, i.index, i.valid = leaf.id, index, true
+	i.key, i.value = leaf.keys[index], i.table.tree.opts.Codec.Decode(leaf.values[index])
+}
@@ -0,0 +1,175 @@
+package memtable
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xia-Sang/bitcask/utils"
+)
+
+// 测试使用的value编码
+type intCodec struct{}
+
+func (intCodec) Encode(value interface{}) []byte {
+	if value == nil {
+		return nil
+	}
+	return binary.AppendVarint(nil, int64(value.(int)))
+}
+func (intCodec) Decode(buf []byte) interface{} {
+	if len(buf) == 0 {
+		return nil
+	}
+	v, _ := binary.Varint(buf)
+	return int(v)
+}
+
+func openTestDiskBTree(t *testing.T, path string, cacheSize int) *DiskBTreeMemTable {
+	t.Helper()
+	d, err := OpenDiskBTreeMemTable(path, DiskBTreeOptions{Codec: intCodec{}, CacheSize: cacheSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// 随机写入和删除 每一步之后检查b+树的性质
+func TestDiskBTreeRandomOps(t *testing.T) {
+	d := openTestDiskBTree(t, filepath.Join(t.TempDir(), "index"), 8)
+	expect := map[int]int{}
+	for idx, i := range utils.RandomIntsInRange(5000, 0, 2000) {
+		key := append(utils.GenerateKey(i), utils.GenerateRandomBytes(i%200)...)
+		if idx%3 == 0 {
+			d.Delete(key)
+			delete(expect, i)
+		} else {
+			d.Put(key, idx)
+			expect[i] = idx
+		}
+		if idx%100 == 0 {
+			if err := d.Validate(); err != nil {
+				t.Fatalf("step %d: %v", idx, err)
+			}
+		}
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for it := d.Iterator(); it.Valid(); it.Next() {
+		d.Delete(func() []byte { key, _ := it.Curr(); return key }())
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if d.tree.root != 0 || len(d.tree.free) != int(d.tree.pageCount)-1 {
+		t.Fatalf("root %d free %d pages %d", d.tree.root, len(d.tree.free), d.tree.pageCount)
+	}
+}
+
+// Flush 之后重新打开 数据和检查点都在
+func TestDiskBTreeReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	d := openTestDiskBTree(t, path, 16)
+	if d.Checkpoint() != nil {
+		t.Fatal("new index should not have a checkpoint")
+	}
+	for i := range 3000 {
+		d.Put(utils.GenerateKey(i), i)
+	}
+	for i := 0; i < 3000; i += 3 {
+		d.Delete(utils.GenerateKey(i))
+	}
+	if err := d.Flush([]byte("cp-1")); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = openTestDiskBTree(t, path, 16)
+	if string(d.Checkpoint()) != "cp-1" {
+		t.Fatalf("checkpoint %q", d.Checkpoint())
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3000 {
+		val, ok := d.Get(utils.GenerateKey(i))
+		if ok != (i%3 != 0) || (ok && val.(int) != i) {
+			t.Fatalf("key %d: %v,%v", i, val, ok)
+		}
+	}
+	// 空闲页在重新打开之后可以继续使用
+	pages := d.tree.pageCount
+	for i := 0; i < 3000; i += 3 {
+		d.Put(utils.GenerateKey(i), i)
+	}
+	if d.tree.pageCount > pages+1 {
+		t.Fatalf("free pages not reused: %d -> %d", pages, d.tree.pageCount)
+	}
+
+	// 缓存淘汰时写回脏页 检查点随之失效
+	for i := range 3000 {
+		d.Put(utils.GenerateKey(i), -i)
+	}
+	if d.Checkpoint() != nil {
+		t.Fatal("checkpoint should be invalid after evicting dirty pages")
+	}
+	d.Close()
+	d = openTestDiskBTree(t, path, 16)
+	if d.Checkpoint() != nil {
+		t.Fatal("checkpoint should be invalid after reopen")
+	}
+	if err := d.MarkDirty(); err != nil {
+		t.Fatal(err)
+	}
+	d.Clear()
+	if err := d.Validate(); err != nil || d.Iterator().Valid() {
+		t.Fatal("index not empty after clear", err)
+	}
+}
+
+// 页被破坏之后返回 ErrIndexCorrupted
+func TestDiskBTreeCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index")
+	d := openTestDiskBTree(t, path, 4)
+	for i := range 1000 {
+		d.Put(utils.GenerateKey(i), i)
+	}
+	if err := d.Flush(nil); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("broken"), diskPageSize+100); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	d = openTestDiskBTree(t, path, 4)
+	for i := range 1000 {
+		d.Get(utils.GenerateKey(i))
+	}
+	if !errors.Is(d.Err(), ErrIndexCorrupted) {
+		t.Fatal(d.Err())
+	}
+	if !errors.Is(d.Flush(nil), ErrIndexCorrupted) {
+		t.Fatal("flush should fail after an error")
+	}
+
+	// 元数据页损坏时无法打开
+	if err := os.WriteFile(path, make([]byte, diskPageSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDiskBTreeMemTable(path, DiskBTreeOptions{Codec: intCodec{}}); !errors.Is(err, ErrIndexCorrupted) {
+		t.Fatal(err)
+	}
+}
@@ -1,12 +1,57 @@
 package memtable
 
 import (
-	"bytes"
-	"sort"
+	"errors"
+	"fmt"
 )
 
 type Constructor func() MemTable
 
+// IndexType 索引的实现方式
+type IndexType int8
+
+const (
+	BTreeIndex     IndexType = iota //b树 默认
+	SkipListIndex                   //跳表
+	ArtIndex                        //自适应基数树
+	DiskBTreeIndex                  //磁盘b+树 保存在数据目录中 需要通过 OpenDiskBTreeMemTable 打开
+)
+
+var ErrUnknownIndexType = errors.New("unknown index type")
+
+var constructors = map[IndexType]Constructor{
+	BTreeIndex:    NewBTreeMemTable,
+	SkipListIndex: NewSkipListMemTable,
+	ArtIndex:      NewArtMemTable,
+}
+
+// Constructor 返回索引类型对应的构造函数 持久化的索引需要单独打开
+func (t IndexType) Constructor() (Constructor, error) {
+	c, ok := constructors[t]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownIndexType, t)
+	}
+	return c, nil
+}
+
+// Persistent 索引是否保存在磁盘上
+func (t IndexType) Persistent() bool {
+	return t == DiskBTreeIndex
+}
+func (t IndexType) String() string {
+	switch t {
+	case BTreeIndex:
+		return "btree"
+	case SkipListIndex:
+		return "skiplist"
+	case ArtIndex:
+		return "art"
+	case DiskBTreeIndex:
+		return "diskbtree"
+	}
+	return fmt.Sprintf("IndexType(%d)", t)
+}
+
 type MemTable interface {
 	Put(key []byte, value interface{})  //存放数据
 	Get(key []byte) (interface{}, bool) //获取数据
@@ -21,35 +66,23 @@ type BTreeMemTable struct {
 }
 
 func (b *BTreeMemTable) Clear() {
-	b.btree.mu = nil
+	b.btree.mu.Lock()
+	defer b.btree.mu.Unlock()
 	b.btree.root = nil
 	b.btree.size = 0
+	b.btree.version++
 }
 
+// NewBTreeMemTableIter 与 Iterator 相同 保留用于兼容
 func (b *BTreeMemTable) NewBTreeMemTableIter() Iterator {
-	ans := []*data{}
-	b.btree.InOrderTraversal(func(d *data) {
-		ans = append(ans, d)
-	})
-	return &BTreeMemTableIter{
-		list:     ans,
-		length:   len(ans),
-		curIndex: 0,
-	}
+	return b.Iterator()
 }
 
+// Iterator 直接在树上遍历 不会拷贝数据
 func (b *BTreeMemTable) Iterator() Iterator {
-	ans := []*data{}
-	b.btree.InOrderTraversal(func(d *data) {
-		if !d.deleted {
-			ans = append(ans, d)
-		}
-	})
-	return &BTreeMemTableIter{
-		list:     ans,
-		curIndex: 0,
-		length:   len(ans),
-	}
+	iter := &BTreeMemTableIter{tree: b.btree}
+	iter.SeekToFirst()
+	return iter
 }
 
 func (b *BTreeMemTable) Put(key []byte, value interface{}) {
@@ -65,6 +98,11 @@ func (b *BTreeMemTable) Get(key []byte) (interface{}, bool) {
 func (b *BTreeMemTable) Delete(key []byte) {
 	b.btree.Remove(newData(key, nil))
 }
+
+// Validate 检查b树的性质 供测试使用
+func (b *BTreeMemTable) Validate() error {
+	return b.btree.validate()
+}
 func (b *BTreeMemTable) Show() {
 	b.btree.PrintTree()
 }
@@ -72,34 +110,16 @@ func NewBTreeMemTable() MemTable {
 	return &BTreeMemTable{btree: NewBTree(9)}
 }
 
+// Iterator 有序迭代器
+// 迭代过程中如果数据被修改 Next/Prev 会从当前key的位置重新定位
+// 因此之后的遍历能看到最新的数据 并且同一个方向上不会重复返回同一个key
+// 迭代器失效之后 Next/Prev 不再移动 需要使用 Seek 系列方法重新定位
 type Iterator interface {
 	Prev()
 	Next()
 	Valid() bool
-	Seek([]byte)
+	Seek([]byte)  //定位到第一个大于等于key的位置
+	SeekToFirst() //定位到第一个key
+	SeekToLast()  //定位到最后一个key
 	Curr() ([]byte, interface{})
 }
-type BTreeMemTableIter struct {
-	list     []*data
-	curIndex int
-	length   int
-}
-
-func (i *BTreeMemTableIter) Prev() {
-	i.curIndex--
-}
-
-func (i *BTreeMemTableIter) Next() {
-	i.curIndex++
-}
-func (i *BTreeMemTableIter) Valid() bool {
-	return i.curIndex >= 0 && i.curIndex < i.length
-}
-func (i *BTreeMemTableIter) Seek(key []byte) {
-	i.curIndex = sort.Search(len(i.list), func(j int) bool {
-		return bytes.Compare(i.list[j].key, key) >= 0
-	})
-}
-func (i *BTreeMemTableIter) Curr() ([]byte, interface{}) {
-	return i.list[i.curIndex].key, i.list[i.curIndex].value
-}
@@ -2,6 +2,7 @@ package memtable
 
 import (
 	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/xia-Sang/bitcask/utils"
@@ -93,3 +94,155 @@ func TestMemTableDelete(t *testing.T) {
 	}
 	t.Log(deletedKey)
 }
+
+// 随机写入之后所有数据都可以读取
+func TestMemTableRandomPut(t *testing.T) {
+	memTable := NewBTreeMemTable()
+	expect := map[int]int{}
+	for idx, i := range utils.RandomIntsInRange(2000, 0, 500) {
+		memTable.Put(utils.GenerateKey(i), idx)
+		expect[i] = idx
+	}
+	for i, want := range expect {
+		val, ok := memTable.Get(utils.GenerateKey(i))
+		if !ok || val.(int) != want {
+			t.Fatalf("key %d: %v,%v want %d", i, val, ok, want)
+		}
+	}
+}
+
+// 随机写入和删除 每一步之后检查b树的性质
+func TestBTreeRandomOps(t *testing.T) {
+	for _, order := range []int{3, 4, 5, 9} {
+		bt := &BTreeMemTable{btree: NewBTree(order)}
+		expect := map[int]int{}
+		for idx, i := range utils.RandomIntsInRange(3000, 0, 300) {
+			key := utils.GenerateKey(i)
+			if idx%3 == 0 {
+				bt.Delete(key)
+				delete(expect, i)
+			} else {
+				bt.Put(key, idx)
+				expect[i] = idx
+			}
+			if err := bt.Validate(); err != nil {
+				t.Fatalf("order %d step %d: %v", order, idx, err)
+			}
+		}
+		for i := range 300 {
+			val, ok := bt.Get(utils.GenerateKey(i))
+			want, exist := expect[i]
+			if ok != exist || (ok && val.(int) != want) {
+				t.Fatalf("order %d key %d: %v,%v want %v,%v", order, i, val, ok, want, exist)
+			}
+		}
+		// 全部删除之后树为空
+		for i := range 300 {
+			bt.Delete(utils.GenerateKey(i))
+			if err := bt.Validate(); err != nil {
+				t.Fatalf("order %d delete %d: %v", order, i, err)
+			}
+		}
+		if bt.btree.root != nil || bt.btree.size != 0 {
+			t.Fatalf("order %d: tree not empty", order)
+		}
+	}
+}
+
+// 迭代器与有序数组的结果一致
+func TestBTreeIterator(t *testing.T) {
+	for _, order := range []int{3, 4, 9} {
+		bt := &BTreeMemTable{btree: NewBTree(order)}
+		set := map[int]bool{}
+		for _, i := range utils.RandomIntsInRange(500, 0, 1000) {
+			bt.Put(utils.GenerateKey(i), i)
+			set[i] = true
+		}
+		var keys []int
+		for i := range 1000 {
+			if set[i] {
+				keys = append(keys, i)
+			}
+		}
+
+		iter := bt.Iterator()
+		for _, want := range keys {
+			if _, val := iter.Curr(); !iter.Valid() || val.(int) != want {
+				t.Fatalf("order %d: %v want %d", order, val, want)
+			}
+			iter.Next()
+		}
+		if iter.Valid() {
+			t.Fatal("iterator valid after the last key")
+		}
+		iter.SeekToLast()
+		for idx := len(keys) - 1; idx >= 0; idx-- {
+			if _, val := iter.Curr(); !iter.Valid() || val.(int) != keys[idx] {
+				t.Fatalf("order %d: %v want %d", order, val, keys[idx])
+			}
+			iter.Prev()
+		}
+		if iter.Valid() {
+			t.Fatal("iterator valid before the first key")
+		}
+		// 随机定位之后前后移动
+		for _, target := range utils.RandomIntsInRange(200, 0, 1001) {
+			iter.Seek(utils.GenerateKey(target))
+			idx := sort.SearchInts(keys, target)
+			if idx == len(keys) {
+				if iter.Valid() {
+					t.Fatalf("seek %d should be invalid", target)
+				}
+				continue
+			}
+			if _, val := iter.Curr(); val.(int) != keys[idx] {
+				t.Fatalf("seek %d: %v want %d", target, val, keys[idx])
+			}
+			iter.Prev()
+			if idx == 0 {
+				if iter.Valid() {
+					t.Fatal("prev of the first key should be invalid")
+				}
+				continue
+			}
+			if _, val := iter.Curr(); val.(int) != keys[idx-1] {
+				t.Fatalf("prev of %d: %v want %d", target, val, keys[idx-1])
+			}
+			iter.Next()
+			if _, val := iter.Curr(); val.(int) != keys[idx] {
+				t.Fatalf("next of %d: %v want %d", target, val, keys[idx])
+			}
+		}
+	}
+}
+
+// 遍历过程中修改数据 之后的遍历能看到最新的数据
+func TestBTreeIteratorModify(t *testing.T) {
+	bt := NewBTreeMemTable()
+	for i := 0; i < 100; i += 2 {
+		bt.Put(utils.GenerateKey(i), i)
+	}
+	iter := bt.Iterator()
+	iter.Seek(utils.GenerateKey(10))
+	// 删除当前key和后继 插入新的key
+	bt.Delete(utils.GenerateKey(10))
+	bt.Delete(utils.GenerateKey(12))
+	bt.Put(utils.GenerateKey(13), 13)
+	iter.Next()
+	if _, val := iter.Curr(); val.(int) != 13 {
+		t.Fatalf("next after modify: %v", val)
+	}
+	bt.Put(utils.GenerateKey(11), 11)
+	iter.Prev()
+	if _, val := iter.Curr(); val.(int) != 11 {
+		t.Fatalf("prev after modify: %v", val)
+	}
+	// 遍历时删除全部数据
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key, _ := iter.Curr()
+		bt.Delete(key)
+	}
+	if iter := bt.Iterator(); iter.Valid() {
+		t.Fatal("tree should be empty")
+	}
+}
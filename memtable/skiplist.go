@@ -0,0 +1,252 @@
+package memtable
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+const (
+	skipListMaxLevel = 20 //最大层数
+	skipListP        = 4  //每一层晋升的概率为 1/skipListP
+)
+
+type skipNode struct {
+	key   []byte
+	value interface{}
+	next  []*skipNode
+}
+
+// 跳表 写入和删除只修改前驱节点的指针
+type skipList struct {
+	head    *skipNode
+	level   int
+	size    int
+	version uint64 // 每次修改递增 迭代器据此发现修改
+	rand    *rand.Rand
+	mu      sync.RWMutex
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+		rand:  rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// 调用方需要持有写锁
+func (sl *skipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.rand.Intn(skipListP) == 0 {
+		level++
+	}
+	return level
+}
+
+// 返回第一个大于等于key的节点 update 记录每一层的前驱
+func (sl *skipList) findGE(key []byte, update []*skipNode) *skipNode {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// 返回最后一个小于key的节点 不存在时返回nil
+func (sl *skipList) findLT(key []byte) *skipNode {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+	}
+	if x == sl.head {
+		return nil
+	}
+	return x
+}
+
+// 返回第一个大于key的节点
+func (sl *skipList) findGT(key []byte) *skipNode {
+	x := sl.findGE(key, nil)
+	if x != nil && bytes.Equal(x.key, key) {
+		x = x.next[0]
+	}
+	return x
+}
+func (sl *skipList) findLast() *skipNode {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil {
+			x = x.next[i]
+		}
+	}
+	if x == sl.head {
+		return nil
+	}
+	return x
+}
+
+func (sl *skipList) put(key []byte, value interface{}) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	update := make([]*skipNode, skipListMaxLevel)
+	if x := sl.findGE(key, update); x != nil && bytes.Equal(x.key, key) {
+		x.value = value
+		sl.version++
+		return
+	}
+	level := sl.randomLevel()
+	for i := sl.level; i < level; i++ {
+		update[i] = sl.head
+	}
+	if level > sl.level {
+		sl.level = level
+	}
+	x := &skipNode{key: key, value: value, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+	sl.size++
+	sl.version++
+}
+func (sl *skipList) get(key []byte) (interface{}, bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	x := sl.findGE(key, nil)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return nil, false
+	}
+	return x.value, true
+}
+func (sl *skipList) remove(key []byte) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	update := make([]*skipNode, skipListMaxLevel)
+	x := sl.findGE(key, update)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return
+	}
+	for i := range x.next {
+		update[i].next[i] = x.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.size--
+	sl.version++
+}
+
+type SkipListMemTable struct {
+	list *skipList
+}
+
+func NewSkipListMemTable() MemTable {
+	return &SkipListMemTable{list: newSkipList()}
+}
+func (s *SkipListMemTable) Put(key []byte, value interface{}) {
+	s.list.put(key, value)
+}
+func (s *SkipListMemTable) Get(key []byte) (interface{}, bool) {
+	val, ok := s.list.get(key)
+	return val, ok && val != nil
+}
+func (s *SkipListMemTable) Delete(key []byte) {
+	s.list.remove(key)
+}
+func (s *SkipListMemTable) Show() {
+	s.list.mu.RLock()
+	defer s.list.mu.RUnlock()
+	for x := s.list.head.next[0]; x != nil; x = x.next[0] {
+		fmt.Printf("level:%d (%s:%v)\n", len(x.next), x.key, x.value)
+	}
+}
+func (s *SkipListMemTable) Iterator() Iterator {
+	iter := &SkipListMemTableIter{list: s.list}
+	iter.SeekToFirst()
+	return iter
+}
+func (s *SkipListMemTable) Clear() {
+	s.list.mu.Lock()
+	defer s.list.mu.Unlock()
+	s.list.head = &skipNode{next: make([]*skipNode, skipListMaxLevel)}
+	s.list.level = 1
+	s.list.size = 0
+	s.list.version++
+}
+
+// SkipListMemTableIter 跳表迭代器
+// 只有后继指针 Prev 需要从头查找前驱 复杂度为 O(log n)
+type SkipListMemTableIter struct {
+	list    *skipList
+	node    *skipNode
+	version uint64 //定位时跳表的版本
+	key     []byte
+	value   interface{}
+}
+
+func (i *SkipListMemTableIter) Valid() bool {
+	return i.node != nil
+}
+func (i *SkipListMemTableIter) Curr() ([]byte, interface{}) {
+	return i.key, i.value
+}
+func (i *SkipListMemTableIter) SeekToFirst() {
+	i.list.mu.RLock()
+	defer i.list.mu.RUnlock()
+	i.set(i.list.head.next[0])
+}
+func (i *SkipListMemTableIter) SeekToLast() {
+	i.list.mu.RLock()
+	defer i.list.mu.RUnlock()
+	i.set(i.list.findLast())
+}
+func (i *SkipListMemTableIter) Seek(key []byte) {
+	i.list.mu.RLock()
+	defer i.list.mu.RUnlock()
+	i.set(i.list.findGE(key, nil))
+}
+func (i *SkipListMemTableIter) Next() {
+	if i.node == nil {
+		return
+	}
+	i.list.mu.RLock()
+	defer i.list.mu.RUnlock()
+
+	if i.version != i.list.version {
+		// 当前节点可能已经被删除 从当前key重新定位
+		i.set(i.list.findGT(i.key))
+		return
+	}
+	i.set(i.node.next[0])
+}
+func (i *SkipListMemTableIter) Prev() {
+	if i.node == nil {
+		return
+	}
+	i.list.mu.RLock()
+	defer i.list.mu.RUnlock()
+	i.set(i.list.findLT(i.key))
+}
+
+// 调用方需要持有读锁 value 可能被原地更新 因此在这里拷贝出来
+func (i *SkipListMemTableIter) set(node *skipNode) {
+	i.node = node
+	i.version = i.list.version
+	if node == nil {
+		i.key, i.value = nil, nil
+		return
+	}
+	i.key, i.value = node.key, node.value
+}
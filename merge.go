@@ -0,0 +1,354 @@
+package bitcask
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+const (
+	mergeDirName = "merge"     //合并过程中使用的目录
+	mergeFinName = "MERGE_FIN" //合并完成标记
+)
+
+var ErrMergeInProgress = errors.New("merge is in progress")
+
+// 合并过程中移动过的key 用于替换内存表中的位置
+// newPos 为空表示已经过期 直接从内存表中删除
+type movedKey struct {
+	bucket uint32
+	key    []byte
+	oldPos *wal.Pos
+	newPos *wal.Pos
+}
+
+// 合并任务
+// 小于等于 mergeUpTo 的文件会被重写到合并目录中 文件编号从 mergeUpTo+1 开始
+// 这些编号在开始合并时预留 不会和旧文件重复 旧的位置不会指向合并之后的文件
+// 预留的数量等于合并之前的文件数量 重写之后的数据更大时(关闭压缩 开启加密) 最后一个文件超过 MaxFileSize
+type mergeTask struct {
+	mergeUpTo int
+	files     []*wal.Wal
+	merged    int //合并之后的文件数量
+	moved     []movedKey
+}
+
+// 合并之后第 i 个文件的编号 i 从 1 开始
+func (t *mergeTask) fileId(i int) int {
+	return t.mergeUpTo + i
+}
+
+func (db *Db) mergePath() string {
+	return filepath.Join(db.opts.DirPath, mergeDirName)
+}
+
+// Merge 在线合并
+// 只在开始和结束时短暂持有锁 重写数据期间读写可以继续进行
+// 合并期间调用 Close 会等待合并结束 合并结果不再替换数据文件 返回 ErrClosed
+func (db *Db) Merge() error {
+	task, err := db.prepareMerge()
+	if err != nil {
+		return err
+	}
+	defer db.mergeWg.Done()
+	if err := db.rewriteMerge(task); err != nil {
+		db.abortMerge()
+		return err
+	}
+	return db.installMerge(task)
+}
+
+// 丢弃合并目录
+func (db *Db) abortMerge() {
+	_ = os.RemoveAll(db.mergePath())
+	db.mu.Lock()
+	db.merging = false
+	db.mu.Unlock()
+}
+
+// 封存活跃文件 记录需要合并的文件
+func (db *Db) prepareMerge() (*mergeTask, error) {
+	if db.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if db.merging {
+		return nil, ErrMergeInProgress
+	}
+	// 之后的写入都会落在新的活跃文件中 在两者之间为合并之后的文件预留编号
+	task := &mergeTask{mergeUpTo: db.activeFiles.FileId}
+	if err := db.rotateActiveFile(len(db.olderFiles) + 1); err != nil {
+		return nil, err
+	}
+	for _, w := range db.olderFiles {
+		task.files = append(task.files, w)
+	}
+	sort.Slice(task.files, func(i, j int) bool {
+		return task.files[i].FileId < task.files[j].FileId
+	})
+	db.merging = true
+	db.mergeWg.Add(1)
+	return task, nil
+}
+
+// 将仍然有效的数据重写到合并目录 最后写入完成标记
+func (db *Db) rewriteMerge(task *mergeTask) error {
+	mergePath := db.mergePath()
+	if err := os.RemoveAll(mergePath); err != nil {
+		return err
+	}
+	if err := mkdirPath(mergePath); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	var out *wal.Wal
+	var hints []*wal.Hint //写入时记录索引项 不需要重新扫描输出文件
+	seal := func() error {
+		if out == nil {
+			return nil
+		}
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		if err := wal.WriteHintFile(mergePath, out.FileId, hints, db.keyring); err != nil {
+			return err
+		}
+		hints = nil
+		return out.Close()
+	}
+	for _, w := range task.files {
+		// 跳过模式打开时 封存文件中可能留有已经报告过的损坏区域
+		_, err := w.Scan(0, db.opts.RecoveryMode.scanMode(false), func(r *wal.Record, pos *wal.Pos) error {
+			if r.Type == wal.RecordDelete {
+				return nil
+			}
+			// 只保留内存表中仍然指向这里的记录 已经删除的 bucket 直接丢弃
+			db.mu.RLock()
+			table, filter := db.table(r.Bucket), db.mergeFilters[r.Bucket]
+			db.mu.RUnlock()
+			if table == nil {
+				return nil
+			}
+			cur, ok := table.Get(r.Key)
+			if !ok || !samePos(cur.(*wal.Pos), pos) {
+				return nil
+			}
+			// 过期的数据和过滤函数丢弃的数据不再重写
+			if pos.Expired(now) || filter != nil && filter(r.Key) {
+				task.moved = append(task.moved, movedKey{bucket: r.Bucket, key: r.Key, oldPos: pos})
+				return nil
+			}
+			// 预留的编号用完之后继续写入最后一个文件 合并不会因为数据变大而失败
+			if out == nil || db.opts.MaxFileSize <= out.Size() && task.merged < len(task.files) {
+				if err := seal(); err != nil {
+					return err
+				}
+				task.merged++
+				var err error
+				if out, err = wal.NewEncryptedWal(mergePath, task.fileId(task.merged), db.keyring); err != nil {
+					return err
+				}
+			}
+			// 按照当前的配置重新压缩 旧的数据也会换成新的压缩算法
+			newPos, err := out.WriteRecord(&wal.Record{Type: wal.RecordPut, Codec: db.opts.Compression.codec(r.Value), Key: r.Key, Value: r.Value, ExpireAt: r.ExpireAt, Bucket: r.Bucket})
+			if err != nil {
+				return err
+			}
+			// 重写没有改变数据 索引文件中保留原来的序号
+			newPos.Seq = cur.(*wal.Pos).Seq
+			hints = append(hints, &wal.Hint{Key: r.Key, Pos: newPos, Bucket: r.Bucket})
+			task.moved = append(task.moved, movedKey{bucket: r.Bucket, key: r.Key, oldPos: pos, newPos: newPos})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := seal(); err != nil {
+		return err
+	}
+	return writeMergeFin(mergePath, task)
+}
+
+// 替换数据文件并更新内存表
+// 存在未释放的快照时延迟到快照全部释放之后再替换 旧文件在此之前不会被删除
+func (db *Db) installMerge(task *mergeTask) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 已经关闭时数据目录不再属于当前进程 丢弃合并结果
+	if db.closed {
+		_ = os.RemoveAll(db.mergePath())
+		db.merging = false
+		return ErrClosed
+	}
+	if len(db.snapshots) > 0 {
+		db.pendingMerge = task
+		return nil
+	}
+	return db.applyMerge(task)
+}
+
+// 调用方需要持有写锁
+func (db *Db) applyMerge(task *mergeTask) error {
+	defer func() {
+		db.merging = false
+		db.pendingMerge = nil
+	}()
+
+	// 替换文件之后 索引中旧文件的位置不再有效
+	if err := db.invalidateIndex(); err != nil {
+		return err
+	}
+	for _, w := range task.files {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		delete(db.olderFiles, w.FileId)
+	}
+	if err := finishMerge(db.opts.DirPath, db.mergePath()); err != nil {
+		return err
+	}
+	for i := 1; i <= task.merged; i++ {
+		w, err := wal.NewEncryptedWal(db.opts.DirPath, task.fileId(i), db.keyring)
+		if err != nil {
+			return err
+		}
+		if err := db.addOlderFile(w); err != nil {
+			return err
+		}
+	}
+	// 合并期间被覆盖或者删除的key 保持最新的位置
+	for _, m := range task.moved {
+		table := db.table(m.bucket)
+		if table == nil {
+			continue
+		}
+		cur, ok := table.Get(m.key)
+		if !ok || !samePos(cur.(*wal.Pos), m.oldPos) {
+			continue
+		}
+		if m.newPos == nil {
+			table.Delete(m.key)
+		} else {
+			table.Put(m.key, m.newPos)
+		}
+	}
+	if err := db.indexErr(); err != nil {
+		return err
+	}
+	return db.flushIndex()
+}
+
+func samePos(a, b *wal.Pos) bool {
+	return a.FileId == b.FileId && a.Offset == b.Offset
+}
+
+// 完成标记的内容为 mergeUpTo 合并之后的文件数量 第一个文件的编号
+func writeMergeFin(mergePath string, task *mergeTask) error {
+	finPath := filepath.Join(mergePath, mergeFinName)
+	tmpPath := finPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(fmt.Sprintf("%d %d %d", task.mergeUpTo, task.merged, task.fileId(1))), os.ModePerm); err != nil {
+		return err
+	}
+	fp, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, finPath)
+}
+
+// 将合并目录中的文件移动到数据目录
+// 过程是幂等的 崩溃之后重新执行即可
+func finishMerge(dirPath, mergePath string) error {
+	content, err := os.ReadFile(filepath.Join(mergePath, mergeFinName))
+	if err != nil {
+		return err
+	}
+	var mergeUpTo, merged, first int
+	if _, err := fmt.Sscanf(string(content), "%d %d %d", &mergeUpTo, &merged, &first); err != nil {
+		return err
+	}
+	// 删除已经被合并的旧文件 和合并之后的文件编号相同的由重命名覆盖
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fileId, ok := dataFileId(entry.Name())
+		if !ok || fileId > mergeUpTo || first <= fileId && fileId < first+merged {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dirPath, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for fileId := first; fileId < first+merged; fileId++ {
+		for _, name := range []string{wal.GetHintPath(fileId), wal.GetWalPath(fileId)} {
+			err := os.Rename(filepath.Join(mergePath, name), filepath.Join(dirPath, name))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(mergePath)
+}
+
+// 启动时处理上一次未完成的合并 返回是否替换了数据文件
+// 有完成标记则继续移动文件 否则直接丢弃合并目录
+// 只读模式下不能修改数据目录 未完成替换的合并直接报错
+func recoverMerge(dirPath string, readOnly bool) (bool, error) {
+	mergePath := filepath.Join(dirPath, mergeDirName)
+	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+		return false, nil
+	}
+	if _, err := os.Stat(filepath.Join(mergePath, mergeFinName)); err != nil {
+		if os.IsNotExist(err) {
+			if readOnly {
+				return false, nil
+			}
+			return false, os.RemoveAll(mergePath)
+		}
+		return false, err
+	}
+	if readOnly {
+		return false, errors.New("unfinished merge, open in read-write mode first")
+	}
+	return true, finishMerge(dirPath, mergePath)
+}
+
+// 数据文件和索引文件名中的编号
+func dataFileId(name string) (int, bool) {
+	if fileId, ok := walFileMemTableIndex(name); ok {
+		return fileId, true
+	}
+	id, ok := strings.CutSuffix(name, wal.HintFileName)
+	if !ok {
+		return 0, false
+	}
+	fileId, err := strconv.Atoi(id)
+	if err != nil || fileId <= 0 || wal.GetHintPath(fileId) != name {
+		return 0, false
+	}
+	return fileId, true
+}
@@ -1,10 +1,70 @@
 package bitcask
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xia-Sang/bitcask/memtable"
+	"github.com/xia-Sang/bitcask/wal"
+)
 
 type Options struct {
 	DirPath     string //文件地址
 	MaxFileSize int64  //单个文件最大容量
+	ReadOnly    bool   //只读模式 使用共享锁打开
+	MmapSealed  bool   //只读映射封存的文件 读取时不再调用pread
+
+	IndexType memtable.IndexType //内存索引的实现 默认为b树
+
+	ExpireSweepInterval time.Duration //后台清理过期key的间隔 0表示不开启
+
+	SyncPolicy   SyncPolicy   //落盘策略 默认只在切换文件和关闭时落盘
+	RecoveryMode RecoveryMode //打开时如何处理损坏的数据文件 默认截断活跃文件末尾不完整的记录
+	Compression  Compression  //value 的压缩算法 默认不压缩
+
+	// EncryptionKey AES-GCM 密钥 长度为16 24或者32字节 为空时不加密
+	// OldEncryptionKeys 只用于读取旧文件 合并之后所有文件都换成 EncryptionKey
+	EncryptionKey     []byte
+	OldEncryptionKeys [][]byte
+}
+
+// Compression value 的压缩配置
+// 小于 MinSize 的 value 不压缩 压缩之后没有变小的 value 按照原样存储
+type Compression struct {
+	Codec   wal.Codec
+	MinSize int
+}
+
+func (c Compression) validate() error {
+	if !c.Codec.Valid() {
+		return errors.New("unknown compression codec")
+	}
+	if c.MinSize < 0 {
+		return errors.New("compression min size must not be negative")
+	}
+	return nil
+}
+
+// 写入 value 时使用的压缩算法
+func (c Compression) codec(value []byte) wal.Codec {
+	if len(value) < c.MinSize {
+		return wal.CodecNone
+	}
+	return c.Codec
+}
+
+func (opts *Options) encrypted() bool {
+	return opts.EncryptionKey != nil || len(opts.OldEncryptionKeys) > 0
+}
+
+// 没有配置密钥时返回 nil 所有文件都不加密
+func (opts *Options) keyring() (*wal.Keyring, error) {
+	if !opts.encrypted() {
+		return nil, nil
+	}
+	return wal.NewKeyring(opts.EncryptionKey, opts.OldEncryptionKeys...)
 }
 
 func mkdirPath(dirPath string) error {
@@ -16,13 +76,48 @@ func mkdirPath(dirPath string) error {
 	return nil
 }
 func (opts *Options) check() error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	// 只读模式不创建数据目录
+	if opts.ReadOnly {
+		stat, err := os.Stat(opts.DirPath)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", opts.DirPath)
+		}
+		return nil
+	}
 	if err := mkdirPath(opts.DirPath); err != nil {
 		return err
 	}
 	return nil
 }
 
-// NewOptions 配置文件构造器
+// 检查索引 落盘和恢复相关的配置
+func (opts *Options) validate() error {
+	if _, err := opts.IndexType.Constructor(); err != nil && !opts.IndexType.Persistent() {
+		return err
+	}
+	if opts.RecoveryMode < RecoveryTruncate || opts.RecoveryMode > RecoveryStrict {
+		return errors.New("unknown recovery mode")
+	}
+	if err := opts.Compression.validate(); err != nil {
+		return err
+	}
+	if _, err := opts.keyring(); err != nil {
+		return err
+	}
+	// 持久化索引中保存的是明文的 key
+	if opts.encrypted() && opts.IndexType.Persistent() {
+		return errors.New("persistent index can not be encrypted")
+	}
+	return opts.SyncPolicy.validate()
+}
+
+// NewOptions 配置文件构造器 配置在 Open 时检查
 func NewOptions(dirPath string, opts ...ConfigOptions) *Options {
 	op := Options{
 		DirPath: dirPath,
@@ -32,9 +127,6 @@ func NewOptions(dirPath string, opts ...ConfigOptions) *Options {
 	}
 
 	defaultOptions(&op)
-	if err := op.check(); err != nil {
-		panic(err)
-	}
 	return &op
 }
 
@@ -51,6 +143,52 @@ func WithSSTSize(sstSize uint64) ConfigOptions {
 		o.MaxFileSize = 1024
 	}
 }
+func WithMaxFileSize(size int64) ConfigOptions {
+	return func(o *Options) {
+		o.MaxFileSize = size
+	}
+}
+func WithReadOnly() ConfigOptions {
+	return func(o *Options) {
+		o.ReadOnly = true
+	}
+}
+func WithMmapSealed() ConfigOptions {
+	return func(o *Options) {
+		o.MmapSealed = true
+	}
+}
+func WithIndexType(typ memtable.IndexType) ConfigOptions {
+	return func(o *Options) {
+		o.IndexType = typ
+	}
+}
+func WithExpireSweepInterval(interval time.Duration) ConfigOptions {
+	return func(o *Options) {
+		o.ExpireSweepInterval = interval
+	}
+}
+func WithSyncPolicy(policy SyncPolicy) ConfigOptions {
+	return func(o *Options) {
+		o.SyncPolicy = policy
+	}
+}
+func WithRecoveryMode(mode RecoveryMode) ConfigOptions {
+	return func(o *Options) {
+		o.RecoveryMode = mode
+	}
+}
+func WithCompression(codec wal.Codec, minSize int) ConfigOptions {
+	return func(o *Options) {
+		o.Compression = Compression{Codec: codec, MinSize: minSize}
+	}
+}
+func WithEncryptionKey(key []byte, oldKeys ...[]byte) ConfigOptions {
+	return func(o *Options) {
+		o.EncryptionKey = key
+		o.OldEncryptionKeys = oldKeys
+	}
+}
 func defaultOptions(opts *Options) {
 	if opts.MaxFileSize == 0 {
 		opts.MaxFileSize = 1024
@@ -0,0 +1,101 @@
+package bitcask
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+// RecoveryMode 打开时如何处理损坏的数据文件
+type RecoveryMode int
+
+const (
+	RecoveryTruncate RecoveryMode = iota //只截断活跃文件末尾没有写完的记录 其他损坏都会导致打开失败
+	RecoverySkip                         //同时跳过封存文件中损坏的记录
+	RecoveryStrict                       //任何损坏都会导致打开失败
+)
+
+func (m RecoveryMode) scanMode(active bool) wal.ScanMode {
+	switch {
+	case m == RecoveryStrict:
+		return wal.ScanStrict
+	case m == RecoverySkip:
+		return wal.ScanSkip
+	case active:
+		return wal.ScanTruncate
+	default:
+		return wal.ScanStrict
+	}
+}
+
+// Corruptions 打开时发现并跳过或者截断的损坏区域
+func (db *Db) Corruptions() []wal.Corruption {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return slices.Clone(db.corruptions)
+}
+
+func (db *Db) reportCorruptions(corruptions ...wal.Corruption) {
+	for _, c := range corruptions {
+		log.Printf("recovered from corrupt data: %v\n", c)
+	}
+	db.corruptions = append(db.corruptions, corruptions...)
+}
+
+// 打开数据文件 活跃文件的文件头没有写完时截断为空文件
+// 完整的文件头校验失败时打开失败 文件头之后可能还有数据
+// 只读模式下以只读方式打开 不会创建或者修改文件
+func (db *Db) openWal(fileId int, active bool) (*wal.Wal, error) {
+	if db.opts.ReadOnly {
+		return wal.OpenReadOnlyWal(db.opts.DirPath, fileId, db.keyring)
+	}
+	w, err := wal.NewEncryptedWal(db.opts.DirPath, fileId, db.keyring)
+	if !errors.Is(err, wal.ErrBadFileHeader) || !active || db.opts.RecoveryMode == RecoveryStrict {
+		return w, err
+	}
+	path := filepath.Join(db.opts.DirPath, wal.GetWalPath(fileId))
+	stat, serr := os.Stat(path)
+	if serr != nil {
+		return nil, serr
+	}
+	if stat.Size() >= wal.FileHeaderSize {
+		return nil, err
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		return nil, err
+	}
+	db.reportCorruptions(wal.Corruption{FileId: fileId, Length: int(stat.Size()), Err: wal.ErrBadFileHeader})
+	return wal.NewEncryptedWal(db.opts.DirPath, fileId, db.keyring)
+}
+
+// 从 offset 开始回放数据文件 按照恢复模式处理损坏的记录
+// 活跃文件中延伸到文件末尾的损坏是崩溃时没有写完的记录 直接截断
+// 截断模式下损坏之后还有完整的记录时 Scan 返回错误 不会丢弃这些记录
+// 完整回放活跃文件时同时记录索引项 封存时不需要重新扫描
+func (db *Db) replayFile(w *wal.Wal, offset int, active bool) error {
+	var hints []*wal.Hint
+	corruptions, err := w.Scan(offset, db.opts.RecoveryMode.scanMode(active), func(r *wal.Record, pos *wal.Pos) error {
+		wal.ApplyRecord(db.replayTable(r.Bucket), r, pos)
+		if active {
+			hints = append(hints, &wal.Hint{Key: r.Key, Pos: pos, Deleted: r.Type == wal.RecordDelete, Bucket: r.Bucket})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if active {
+		db.hints, db.hintsValid = hints, offset == 0
+	}
+	db.reportCorruptions(corruptions...)
+	if n := len(corruptions); n > 0 && active && !db.opts.ReadOnly {
+		if last := corruptions[n-1]; last.Offset+last.Length == w.Offset {
+			return w.Truncate(last.Offset)
+		}
+	}
+	return nil
+}
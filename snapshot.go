@@ -0,0 +1,292 @@
+package bitcask
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/xia-Sang/bitcask/memtable"
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+// Snapshot 只读快照 固定在创建时的序号
+// 创建时只记录序号 读取时通过索引中的 Pos.Seq 判断可见性
+// 之后的写入覆盖或者删除了快照可见的版本时 旧的位置保存在 db.versions 中
+// 快照释放之前合并不会替换数据文件 旧的位置一直有效
+type Snapshot struct {
+	db       *Db
+	seq      uint64
+	now      int64 //判断过期使用创建时的时间
+	released bool
+}
+
+// 被覆盖的版本 seq 是覆盖它的写入的序号 pos 为覆盖之前的位置
+type version struct {
+	seq uint64
+	pos *wal.Pos
+}
+
+// NewSnapshot 创建快照 使用完毕之后需要调用 Release
+func (db *Db) NewSnapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.snapshots == nil {
+		db.snapshots = map[uint64]int{}
+		db.versions = memtable.NewBTreeMemTable()
+	}
+	db.snapshots[db.seq]++
+	db.lastSnapshot = db.seq
+	return &Snapshot{db: db, seq: db.seq, now: time.Now().UnixNano()}
+}
+
+// 修改默认 bucket 的索引之前调用 调用方需要持有写锁
+// 当前版本对某个快照可见时保存下来 seq 是这次写入的序号
+func (db *Db) saveVersion(key []byte, seq uint64) {
+	if len(db.snapshots) == 0 {
+		return
+	}
+	// 不存在的key和快照之后写入的版本 通过 Pos.Seq 就能判断
+	cur, ok := db.memTable.Get(key)
+	if !ok || cur.(*wal.Pos).Seq > db.lastSnapshot {
+		return
+	}
+	var versions []version
+	if v, ok := db.versions.Get(key); ok {
+		versions = v.([]version)
+	}
+	db.versions.Put(bytes.Clone(key), append(versions, version{seq: seq, pos: cur.(*wal.Pos)}))
+}
+
+// 快照中key的位置 不可见时返回 nil 调用方需要持有读锁
+// 快照之后的第一次覆盖保存了快照可见的版本 没有覆盖时当前版本在快照之前写入才可见
+func (s *Snapshot) lookup(key []byte) *wal.Pos {
+	db := s.db
+	if s.released || db.closed {
+		return nil
+	}
+	if v, ok := db.versions.Get(key); ok {
+		for _, ver := range v.([]version) {
+			if ver.seq > s.seq {
+				return ver.pos
+			}
+		}
+	}
+	cur, ok := db.memTable.Get(key)
+	if !ok || cur.(*wal.Pos).Seq > s.seq {
+		return nil
+	}
+	return cur.(*wal.Pos)
+}
+
+// Seq 快照对应的序号
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// Get 读取快照中的数据 不存在或者已经过期时返回 ErrKeyNotFound
+// 快照已经释放或者数据库已经关闭时返回 ErrClosed
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	db := s.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if s.released || db.closed {
+		return nil, ErrClosed
+	}
+	pos := s.lookup(key)
+	if pos == nil || pos.Expired(s.now) {
+		return nil, ErrKeyNotFound
+	}
+	return db.getValueByPos(pos)
+}
+
+// Iterator 遍历快照中的全部数据
+func (s *Snapshot) Iterator() *Iterator {
+	return s.NewIterator(IteratorOptions{})
+}
+
+// NewIterator 按照配置遍历快照中的数据
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	db := s.db
+	db.mu.RLock()
+	iter := &snapshotIter{s: s}
+	if !s.released {
+		iter.sources = []memtable.Iterator{db.memTable.Iterator(), db.versions.Iterator()}
+	}
+	db.mu.RUnlock()
+	readValue := func(_ []byte, pos *wal.Pos) ([]byte, error) {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if s.released {
+			return nil, ErrClosed
+		}
+		return db.getValueByPos(pos)
+	}
+	return newIterator(iter, readValue, s.now, opts)
+}
+func (s *Snapshot) Fold(fn func(key, value []byte) bool) error {
+	for iter := s.Iterator(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iter.Key(), val) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照 最后一个快照释放时丢弃保存的版本 并替换等待中的合并结果
+func (s *Snapshot) Release() error {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if s.released {
+		return nil
+	}
+	s.released = true
+	if db.snapshots[s.seq]--; db.snapshots[s.seq] == 0 {
+		delete(db.snapshots, s.seq)
+	}
+	if len(db.snapshots) > 0 {
+		db.pruneVersions()
+		return nil
+	}
+	db.snapshots = nil
+	db.versions = nil
+	db.lastSnapshot = 0
+	if db.pendingMerge != nil && !db.closed {
+		return db.applyMerge(db.pendingMerge)
+	}
+	return nil
+}
+
+// 丢弃所有快照都不再需要的版本 调用方需要持有写锁
+// 在最早的快照之前发生的覆盖不会再被读取
+func (db *Db) pruneVersions() {
+	oldest := db.lastSnapshot
+	for seq := range db.snapshots {
+		oldest = min(oldest, seq)
+	}
+	var keys [][]byte
+	for iter := db.versions.Iterator(); iter.Valid(); iter.Next() {
+		key, v := iter.Curr()
+		if v.([]version)[0].seq <= oldest {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		v, _ := db.versions.Get(key)
+		versions := v.([]version)
+		i := 0
+		for i < len(versions) && versions[i].seq <= oldest {
+			i++
+		}
+		if i == len(versions) {
+			db.versions.Delete(key)
+		} else {
+			db.versions.Put(key, versions[i:])
+		}
+	}
+}
+
+// 快照迭代器 合并遍历当前的索引和保存的版本 只返回对快照可见的key
+// 每一步都重新定位各个来源 遍历期间的写入不会影响结果
+type snapshotIter struct {
+	s       *Snapshot
+	sources []memtable.Iterator
+	key     []byte
+	pos     *wal.Pos
+	valid   bool
+}
+
+func (i *snapshotIter) Valid() bool {
+	return i.valid
+}
+func (i *snapshotIter) Curr() ([]byte, interface{}) {
+	return i.key, i.pos
+}
+func (i *snapshotIter) SeekToFirst() {
+	for _, src := range i.sources {
+		src.SeekToFirst()
+	}
+	i.find(false)
+}
+func (i *snapshotIter) SeekToLast() {
+	for _, src := range i.sources {
+		src.SeekToLast()
+	}
+	i.find(true)
+}
+func (i *snapshotIter) Seek(key []byte) {
+	for _, src := range i.sources {
+		src.Seek(key)
+	}
+	i.find(false)
+}
+func (i *snapshotIter) Next() {
+	if !i.valid {
+		return
+	}
+	for _, src := range i.sources {
+		src.Seek(i.key)
+		if k, _ := src.Curr(); src.Valid() && bytes.Equal(k, i.key) {
+			src.Next()
+		}
+	}
+	i.find(false)
+}
+func (i *snapshotIter) Prev() {
+	if !i.valid {
+		return
+	}
+	for _, src := range i.sources {
+		src.Seek(i.key)
+		if src.Valid() {
+			src.Prev()
+		} else {
+			src.SeekToLast()
+		}
+	}
+	i.find(true)
+}
+
+// 正序取各个来源中最小的key 逆序取最大的key 不可见时继续移动
+func (i *snapshotIter) find(reverse bool) {
+	for {
+		var key []byte
+		found := false
+		for _, src := range i.sources {
+			if !src.Valid() {
+				continue
+			}
+			k, _ := src.Curr()
+			cmp := bytes.Compare(k, key)
+			if !found || !reverse && cmp < 0 || reverse && cmp > 0 {
+				key, found = k, true
+			}
+		}
+		i.valid = false
+		if !found {
+			return
+		}
+		db := i.s.db
+		db.mu.RLock()
+		pos := i.s.lookup(key)
+		db.mu.RUnlock()
+		if pos != nil {
+			i.key, i.pos, i.valid = key, pos, true
+			return
+		}
+		for _, src := range i.sources {
+			if k, _ := src.Curr(); src.Valid() && bytes.Equal(k, key) {
+				if reverse {
+					src.Prev()
+				} else {
+					src.Next()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package structures
+
+import (
+	"errors"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+// 哈希的成员 key 的 sub 是字段名 value 是字段的值
+
+// HSet 设置字段的值 返回字段是否是新增的
+func (s *Structures) HSet(key, field, value []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.meta(key, Hash)
+	if err != nil {
+		return false, err
+	}
+	batch := bitcask.NewWriteBatch()
+	if m == nil {
+		if m, err = s.newMeta(Hash); err != nil {
+			return false, err
+		}
+	}
+	dk := dataKey(key, m.version, field)
+	exists, err := s.exists(dk)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		m.size++
+	}
+	batch.Put(dk, value)
+	return !exists, s.commit(batch, key, m)
+}
+
+// HGet 读取字段的值 不存在时返回 bitcask.ErrKeyNotFound
+func (s *Structures) HGet(key, field []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, Hash)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, bitcask.ErrKeyNotFound
+	}
+	return s.b.Get(dataKey(key, m.version, field))
+}
+
+// HDel 删除字段 返回实际删除的数量 最后一个字段删除之后哈希也被删除
+func (s *Structures) HDel(key []byte, fields ...[]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(key, Hash, fields)
+}
+
+// HExists 字段是否存在
+func (s *Structures) HExists(key, field []byte) (bool, error) {
+	_, err := s.HGet(key, field)
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// HLen 字段的数量
+func (s *Structures) HLen(key []byte) (int, error) {
+	return s.size(key, Hash)
+}
+
+// HGetAll 读取所有的字段
+func (s *Structures) HGetAll(key []byte) (map[string][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, Hash)
+	if err != nil || m == nil {
+		return map[string][]byte{}, err
+	}
+	fields := make(map[string][]byte, m.size)
+	err = s.scan(key, m, bitcask.IteratorOptions{}, true, func(sub, value []byte) bool {
+		fields[string(sub)] = value
+		return true
+	})
+	return fields, err
+}
+
+// 删除哈希的字段或者集合的成员 调用方需要持有写锁
+func (s *Structures) remove(key []byte, typ Type, subs [][]byte) (int, error) {
+	m, err := s.meta(key, typ)
+	if err != nil || m == nil {
+		return 0, err
+	}
+	batch := bitcask.NewWriteBatch()
+	seen := map[string]bool{}
+	n := 0
+	for _, sub := range subs {
+		if seen[string(sub)] {
+			continue
+		}
+		seen[string(sub)] = true
+		dk := dataKey(key, m.version, sub)
+		exists, err := s.exists(dk)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			batch.Delete(dk)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	m.size -= uint64(n)
+	return n, s.commit(batch, key, m)
+}
+
+// 结构中元素的数量 不存在时为 0
+func (s *Structures) size(key []byte, typ Type) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, typ)
+	if err != nil || m == nil {
+		return 0, err
+	}
+	return int(m.size), nil
+}
@@ -0,0 +1,134 @@
+package structures
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+// 列表的成员 key 的 sub 是大端序的下标 元素位于 [head, tail)
+// 下标从中间开始 两端都可以插入
+const initialIndex = math.MaxUint64 / 2
+
+func listKey(key []byte, m *meta, index uint64) []byte {
+	return binary.BigEndian.AppendUint64(dataPrefix(key, m.version), index)
+}
+
+// LPush 依次插入到列表头部 返回插入之后的长度
+func (s *Structures) LPush(key []byte, values ...[]byte) (int, error) {
+	return s.push(key, values, true)
+}
+
+// RPush 依次插入到列表尾部 返回插入之后的长度
+func (s *Structures) RPush(key []byte, values ...[]byte) (int, error) {
+	return s.push(key, values, false)
+}
+
+func (s *Structures) push(key []byte, values [][]byte, left bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.meta(key, List)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		if m == nil {
+			return 0, nil
+		}
+		return int(m.size), nil
+	}
+	batch := bitcask.NewWriteBatch()
+	if m == nil {
+		if m, err = s.newMeta(List); err != nil {
+			return 0, err
+		}
+		m.head, m.tail = initialIndex, initialIndex
+	}
+	for _, value := range values {
+		if left {
+			m.head--
+			batch.Put(listKey(key, m, m.head), value)
+		} else {
+			batch.Put(listKey(key, m, m.tail), value)
+			m.tail++
+		}
+	}
+	m.size += uint64(len(values))
+	return int(m.size), s.commit(batch, key, m)
+}
+
+// LPop 删除并返回头部的元素 列表为空时返回 bitcask.ErrKeyNotFound
+func (s *Structures) LPop(key []byte) ([]byte, error) {
+	return s.pop(key, true)
+}
+
+// RPop 删除并返回尾部的元素 列表为空时返回 bitcask.ErrKeyNotFound
+func (s *Structures) RPop(key []byte) ([]byte, error) {
+	return s.pop(key, false)
+}
+
+func (s *Structures) pop(key []byte, left bool) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.meta(key, List)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, bitcask.ErrKeyNotFound
+	}
+	index := m.tail - 1
+	if left {
+		index = m.head
+	}
+	lk := listKey(key, m, index)
+	value, err := s.b.Get(lk)
+	if err != nil {
+		return nil, err
+	}
+	if left {
+		m.head++
+	} else {
+		m.tail--
+	}
+	m.size--
+	batch := bitcask.NewWriteBatch()
+	batch.Delete(lk)
+	return value, s.commit(batch, key, m)
+}
+
+// LLen 列表的长度
+func (s *Structures) LLen(key []byte) (int, error) {
+	return s.size(key, List)
+}
+
+// LRange 返回 [start, stop] 范围内的元素 负数表示从尾部开始计算
+func (s *Structures) LRange(key []byte, start, stop int) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, List)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	size := int(m.size)
+	if start < 0 {
+		start = max(start+size, 0)
+	}
+	if stop < 0 {
+		stop += size
+	}
+	stop = min(stop, size-1)
+	if start > stop {
+		return nil, nil
+	}
+	values := make([][]byte, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		value, err := s.b.Get(listKey(key, m, m.head+uint64(i)))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,83 @@
+package structures
+
+import "github.com/xia-Sang/bitcask"
+
+// 集合的成员 key 的 sub 是成员 value 为空
+
+// SAdd 添加成员 返回新增的数量
+func (s *Structures) SAdd(key []byte, members ...[]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.meta(key, Set)
+	if err != nil {
+		return 0, err
+	}
+	batch := bitcask.NewWriteBatch()
+	if m == nil {
+		if m, err = s.newMeta(Set); err != nil {
+			return 0, err
+		}
+	}
+	seen := map[string]bool{}
+	n := 0
+	for _, member := range members {
+		if seen[string(member)] {
+			continue
+		}
+		dk := dataKey(key, m.version, member)
+		exists, err := s.exists(dk)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+		seen[string(member)] = true
+		batch.Put(dk, []byte{})
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	m.size += uint64(n)
+	return n, s.commit(batch, key, m)
+}
+
+// SRem 删除成员 返回实际删除的数量 最后一个成员删除之后集合也被删除
+func (s *Structures) SRem(key []byte, members ...[]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(key, Set, members)
+}
+
+// SIsMember 成员是否存在
+func (s *Structures) SIsMember(key, member []byte) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, Set)
+	if err != nil || m == nil {
+		return false, err
+	}
+	return s.exists(dataKey(key, m.version, member))
+}
+
+// SCard 成员的数量
+func (s *Structures) SCard(key []byte) (int, error) {
+	return s.size(key, Set)
+}
+
+// SMembers 按照字节序返回所有的成员
+func (s *Structures) SMembers(key []byte) ([][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, Set)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	members := make([][]byte, 0, m.size)
+	err = s.scan(key, m, bitcask.IteratorOptions{}, false, func(sub, _ []byte) bool {
+		members = append(members, sub)
+		return true
+	})
+	return members, err
+}
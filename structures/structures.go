@@ -0,0 +1,295 @@
+// Package structures 在 bitcask.Db 上实现 redis 风格的哈希、列表、集合和有序集合
+//
+// 每个结构由一个元数据 key 和若干成员 key 组成 成员 key 中带有元数据的版本号
+// 删除整个结构只需要删除元数据 旧版本的成员 key 不再可见 合并时统一回收
+//
+// 所有 key 都保存在名为 BucketName 的 bucket 中 不会出现在默认 bucket 的遍历结果里
+//
+//	计数器 v                                  -> 最后分配的版本号
+//	元数据 m key                              -> type|version|size|head|tail
+//	成员   d uvarint(len(key)) key version sub -> value
+package structures
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+var (
+	ErrWrongType   = errors.New("operation against a key holding the wrong kind of value")
+	ErrCorruptMeta = errors.New("corrupt structure metadata")
+)
+
+// Type 结构的类型 0 表示不存在
+type Type byte
+
+const (
+	Hash Type = iota + 1
+	List
+	Set
+	ZSet
+)
+
+func (t Type) String() string {
+	switch t {
+	case Hash:
+		return "hash"
+	case List:
+		return "list"
+	case Set:
+		return "set"
+	case ZSet:
+		return "zset"
+	}
+	return "none"
+}
+
+// BucketName 保存所有结构的 bucket
+const BucketName = "structures"
+
+var counterKey = []byte("v")
+
+// Structures 写操作串行执行 一次操作的所有修改作为一个批次原子地写入
+// 读操作持有读锁 看到的元数据和成员是一致的
+// 锁只属于当前实例 同一个 Db 上应该只使用一个实例 版本号在多个实例之间也不会重复
+type Structures struct {
+	b  *bitcask.Bucket
+	mu sync.RWMutex
+}
+
+// New 打开 bucket 同时设置合并时回收旧版本成员的过滤函数
+// 持久化索引不支持 bucket 此时返回 ErrBucketUnsupported
+func New(db *bitcask.Db) (*Structures, error) {
+	b, err := db.Bucket(BucketName)
+	if errors.Is(err, bitcask.ErrBucketUnsupported) {
+		return nil, fmt.Errorf("structures need an in-memory index: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &Structures{b: b}
+	b.SetMergeFilter(s.stale)
+	return s, nil
+}
+
+// 元数据 列表的元素位于 [head, tail) 其他类型不使用 head 和 tail
+type meta struct {
+	typ     Type
+	version uint64
+	size    uint64
+	head    uint64
+	tail    uint64
+}
+
+func (m *meta) encode() []byte {
+	buf := []byte{byte(m.typ)}
+	buf = binary.AppendUvarint(buf, m.version)
+	buf = binary.AppendUvarint(buf, m.size)
+	if m.typ == List {
+		buf = binary.AppendUvarint(buf, m.head)
+		buf = binary.AppendUvarint(buf, m.tail)
+	}
+	return buf
+}
+
+func decodeMeta(buf []byte) (*meta, error) {
+	if len(buf) == 0 {
+		return nil, ErrCorruptMeta
+	}
+	m := &meta{typ: Type(buf[0])}
+	fields := []*uint64{&m.version, &m.size}
+	if m.typ == List {
+		fields = append(fields, &m.head, &m.tail)
+	}
+	buf = buf[1:]
+	for _, f := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, ErrCorruptMeta
+		}
+		*f, buf = v, buf[n:]
+	}
+	if m.typ < Hash || m.typ > ZSet || len(buf) != 0 {
+		return nil, ErrCorruptMeta
+	}
+	return m, nil
+}
+
+func metaKey(key []byte) []byte {
+	buf := make([]byte, 0, 1+len(key))
+	buf = append(buf, 'm')
+	return append(buf, key...)
+}
+
+// 一个版本的所有成员 key 的公共前缀
+func dataPrefix(key []byte, version uint64) []byte {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(key)+8)
+	buf = append(buf, 'd')
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	return binary.BigEndian.AppendUint64(buf, version)
+}
+
+func dataKey(key []byte, version uint64, sub []byte) []byte {
+	return append(dataPrefix(key, version), sub...)
+}
+
+// 从成员 key 中解析出结构的 key 和版本号
+func parseDataKey(dk []byte) (key []byte, version uint64, ok bool) {
+	if len(dk) == 0 || dk[0] != 'd' {
+		return nil, 0, false
+	}
+	buf := dk[1:]
+	n, m := binary.Uvarint(buf)
+	if m <= 0 || uint64(len(buf)-m) < n+8 {
+		return nil, 0, false
+	}
+	buf = buf[m:]
+	return buf[:n], binary.BigEndian.Uint64(buf[n:]), true
+}
+
+// 读取元数据 不存在时返回 nil 类型不同时返回 ErrWrongType
+func (s *Structures) meta(key []byte, typ Type) (*meta, error) {
+	buf, err := s.b.Get(metaKey(key))
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := decodeMeta(buf)
+	if err != nil {
+		return nil, err
+	}
+	if m.typ != typ {
+		return nil, ErrWrongType
+	}
+	return m, nil
+}
+
+// 创建新的结构 分配一个没有使用过的版本号
+// 计数器在数据库的写锁内比较之后写入 其他实例同时分配时重试
+// 计数器先于元数据写入 中间崩溃只会跳过一个版本号
+func (s *Structures) newMeta(typ Type) (*meta, error) {
+	for {
+		buf, err := s.b.Get(counterKey)
+		var version uint64
+		switch {
+		case errors.Is(err, bitcask.ErrKeyNotFound):
+			buf = nil
+		case err != nil:
+			return nil, err
+		case len(buf) != 8:
+			return nil, ErrCorruptMeta
+		default:
+			version = binary.BigEndian.Uint64(buf)
+		}
+		version++
+		err = s.b.CompareAndSwap(counterKey, buf, binary.BigEndian.AppendUint64(nil, version))
+		if err == nil {
+			return &meta{typ: typ, version: version}, nil
+		}
+		if !errors.Is(err, bitcask.ErrConditionFailed) {
+			return nil, err
+		}
+	}
+}
+
+// 写入批次 结构为空时删除元数据
+func (s *Structures) commit(batch *bitcask.WriteBatch, key []byte, m *meta) error {
+	if m.size == 0 {
+		batch.Delete(metaKey(key))
+	} else {
+		batch.Put(metaKey(key), m.encode())
+	}
+	return s.b.Write(batch)
+}
+
+// 只查询索引 不读取 value
+func (s *Structures) exists(key []byte) (bool, error) {
+	_, err := s.b.TTL(key)
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 按照顺序遍历一个结构的成员 sub 是去掉公共前缀之后的部分
+func (s *Structures) scan(key []byte, m *meta, opts bitcask.IteratorOptions, withValue bool, fn func(sub, value []byte) bool) error {
+	prefix := dataPrefix(key, m.version)
+	opts.Prefix = append(prefix, opts.Prefix...)
+	if opts.Start != nil {
+		opts.Start = append(bytes.Clone(prefix), opts.Start...)
+	}
+	if opts.End != nil {
+		opts.End = append(bytes.Clone(prefix), opts.End...)
+	}
+	it, err := s.b.NewIterator(opts)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		var value []byte
+		if withValue {
+			if value, err = it.Value(); err != nil {
+				return err
+			}
+		}
+		if !fn(bytes.Clone(it.Key()[len(prefix):]), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Type 返回结构的类型 不存在时返回 0
+func (s *Structures) Type(key []byte) (Type, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	buf, err := s.b.Get(metaKey(key))
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	m, err := decodeMeta(buf)
+	if err != nil {
+		return 0, err
+	}
+	return m.typ, nil
+}
+
+// Del 删除整个结构 只删除元数据 成员在合并时回收
+func (s *Structures) Del(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok, err := s.exists(metaKey(key)); !ok {
+		return false, err
+	}
+	return true, s.b.Delete(metaKey(key))
+}
+
+// 合并时调用 成员 key 的版本号和元数据中的不同时已经不可见 可以丢弃
+// 版本号只会递增 不可见的版本不会再次变为可见 不需要持有 s.mu
+func (s *Structures) stale(dk []byte) bool {
+	key, version, ok := parseDataKey(dk)
+	if !ok {
+		return false
+	}
+	buf, err := s.b.Get(metaKey(key))
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	m, err := decodeMeta(buf)
+	return err == nil && m.version != version
+}
@@ -0,0 +1,384 @@
+package structures
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/xia-Sang/bitcask"
+	"github.com/xia-Sang/bitcask/memtable"
+)
+
+func open(t *testing.T, dir string) (*bitcask.Db, *Structures) {
+	t.Helper()
+	db, err := bitcask.Open(bitcask.NewOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, s
+}
+
+// 出错时直接 panic 便于在表达式中使用
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func bs(ss ...string) [][]byte {
+	b := make([][]byte, len(ss))
+	for i, s := range ss {
+		b[i] = []byte(s)
+	}
+	return b
+}
+
+func TestHash(t *testing.T) {
+	db, s := open(t, t.TempDir())
+	defer db.Close()
+	key := []byte("h")
+
+	if !must(s.HSet(key, []byte("a"), []byte("1"))) || !must(s.HSet(key, []byte("b"), []byte("2"))) {
+		t.Fatal("field not added")
+	}
+	if must(s.HSet(key, []byte("a"), []byte("3"))) {
+		t.Fatal("existing field added")
+	}
+	if v := must(s.HGet(key, []byte("a"))); string(v) != "3" {
+		t.Fatalf("%s", v)
+	}
+	if _, err := s.HGet(key, []byte("x")); !errors.Is(err, bitcask.ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	if _, err := s.HGet([]byte("missing"), []byte("a")); !errors.Is(err, bitcask.ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	if !must(s.HExists(key, []byte("b"))) || must(s.HExists(key, []byte("x"))) {
+		t.Fatal("exists")
+	}
+	all := must(s.HGetAll(key))
+	if !reflect.DeepEqual(all, map[string][]byte{"a": []byte("3"), "b": []byte("2")}) || must(s.HLen(key)) != 2 {
+		t.Fatalf("%q", all)
+	}
+	if n := must(s.HDel(key, bs("a", "a", "x")...)); n != 1 || must(s.HLen(key)) != 1 {
+		t.Fatal(n)
+	}
+	// 最后一个字段删除之后哈希也被删除
+	must(s.HDel(key, []byte("b")))
+	if typ := must(s.Type(key)); typ != 0 {
+		t.Fatal(typ)
+	}
+	if all := must(s.HGetAll(key)); len(all) != 0 {
+		t.Fatalf("%q", all)
+	}
+}
+
+func TestList(t *testing.T) {
+	db, s := open(t, t.TempDir())
+	defer db.Close()
+	key := []byte("l")
+
+	if n := must(s.RPush(key, bs("c", "d")...)); n != 2 {
+		t.Fatal(n)
+	}
+	if n := must(s.LPush(key, bs("b", "a")...)); n != 4 {
+		t.Fatal(n)
+	}
+	// LPush 依次插入头部 b a 的结果是 a b
+	tests := []struct {
+		start, stop int
+		want        string
+	}{
+		{0, -1, "abcd"},
+		{1, 2, "bc"},
+		{-2, -1, "cd"},
+		{-100, 100, "abcd"},
+		{3, 1, ""},
+		{4, 10, ""},
+		{0, -5, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		for _, v := range must(s.LRange(key, tt.start, tt.stop)) {
+			got += string(v)
+		}
+		if got != tt.want {
+			t.Fatalf("LRange(%d, %d) = %q want %q", tt.start, tt.stop, got, tt.want)
+		}
+	}
+	if v := must(s.LPop(key)); string(v) != "a" {
+		t.Fatalf("%s", v)
+	}
+	if v := must(s.RPop(key)); string(v) != "d" {
+		t.Fatalf("%s", v)
+	}
+	if n := must(s.LLen(key)); n != 2 {
+		t.Fatal(n)
+	}
+	must(s.RPop(key))
+	must(s.RPop(key))
+	if _, err := s.LPop(key); !errors.Is(err, bitcask.ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	if typ := must(s.Type(key)); typ != 0 {
+		t.Fatal(typ)
+	}
+}
+
+func TestSet(t *testing.T) {
+	db, s := open(t, t.TempDir())
+	defer db.Close()
+	key := []byte("s")
+
+	if n := must(s.SAdd(key, bs("b", "a", "b", "c")...)); n != 3 {
+		t.Fatal(n)
+	}
+	if n := must(s.SAdd(key, bs("a", "d")...)); n != 1 {
+		t.Fatal(n)
+	}
+	if members := must(s.SMembers(key)); !reflect.DeepEqual(members, bs("a", "b", "c", "d")) {
+		t.Fatalf("%q", members)
+	}
+	if !must(s.SIsMember(key, []byte("a"))) || must(s.SIsMember(key, []byte("x"))) {
+		t.Fatal("ismember")
+	}
+	if n := must(s.SRem(key, bs("a", "x")...)); n != 1 || must(s.SCard(key)) != 3 {
+		t.Fatal(n)
+	}
+	if must(s.SIsMember([]byte("missing"), []byte("a"))) {
+		t.Fatal("missing set")
+	}
+}
+
+func TestZSet(t *testing.T) {
+	db, s := open(t, t.TempDir())
+	defer db.Close()
+	key := []byte("z")
+
+	n := must(s.ZAdd(key,
+		ZMember{[]byte("a"), 1},
+		ZMember{[]byte("b"), -2.5},
+		ZMember{[]byte("c"), 1},
+		ZMember{[]byte("d"), math.Inf(1)},
+		ZMember{[]byte("e"), math.Inf(-1)},
+		ZMember{[]byte("f"), 0},
+		ZMember{[]byte("g"), math.Copysign(0, -1)},
+		ZMember{[]byte("a"), 3},
+	))
+	if n != 7 || must(s.ZCard(key)) != 7 {
+		t.Fatal(n)
+	}
+	if score := must(s.ZScore(key, []byte("a"))); score != 3 {
+		t.Fatal(score)
+	}
+	members := func(min, max float64) string {
+		got := ""
+		for _, zm := range must(s.ZRangeByScore(key, min, max)) {
+			got += fmt.Sprintf("%s:%v ", zm.Member, zm.Score)
+		}
+		return got
+	}
+	if got := members(math.Inf(-1), math.Inf(1)); got != "e:-Inf b:-2.5 f:0 g:0 c:1 a:3 d:+Inf " {
+		t.Fatal(got)
+	}
+	if got := members(0, 1); got != "f:0 g:0 c:1 " {
+		t.Fatal(got)
+	}
+	if got := members(-3, -1); got != "b:-2.5 " {
+		t.Fatal(got)
+	}
+	if got := members(2, 1); got != "" {
+		t.Fatal(got)
+	}
+
+	// 更新分数时删除旧的排序 key
+	if n := must(s.ZAdd(key, ZMember{[]byte("c"), -10})); n != 0 {
+		t.Fatal(n)
+	}
+	if got := members(-20, 1); got != "c:-10 b:-2.5 f:0 g:0 " {
+		t.Fatal(got)
+	}
+	if n := must(s.ZRem(key, bs("c", "x", "c")...)); n != 1 || must(s.ZCard(key)) != 6 {
+		t.Fatal(n)
+	}
+	if _, err := s.ZScore(key, []byte("c")); !errors.Is(err, bitcask.ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	if _, err := s.ZAdd(key, ZMember{[]byte("n"), math.NaN()}); !errors.Is(err, ErrNaNScore) {
+		t.Fatal(err)
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	db, s := open(t, t.TempDir())
+	defer db.Close()
+	key := []byte("k")
+	must(s.SAdd(key, []byte("a")))
+	if _, err := s.HSet(key, []byte("a"), []byte("1")); !errors.Is(err, ErrWrongType) {
+		t.Fatal(err)
+	}
+	if _, err := s.LPush(key, []byte("a")); !errors.Is(err, ErrWrongType) {
+		t.Fatal(err)
+	}
+	if _, err := s.ZRangeByScore(key, 0, 1); !errors.Is(err, ErrWrongType) {
+		t.Fatal(err)
+	}
+	if typ := must(s.Type(key)); typ != Set || typ.String() != "set" {
+		t.Fatal(typ)
+	}
+	// 删除之后可以作为其他类型使用
+	if !must(s.Del(key)) || must(s.Del(key)) {
+		t.Fatal("del")
+	}
+	must(s.HSet(key, []byte("a"), []byte("1")))
+}
+
+// bucket 中 key 的数量
+func countKeys(t *testing.T, db *bitcask.Db) int {
+	t.Helper()
+	b := must(db.Bucket(BucketName))
+	n := 0
+	if err := b.Fold(func(key, value []byte) bool {
+		n++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// 删除只写入一条记录 旧的成员不可见 合并时回收
+func TestDelAndMerge(t *testing.T) {
+	dir := t.TempDir()
+	db, s := open(t, dir)
+	key := []byte("big")
+	for i := range 1000 {
+		must(s.HSet(key, []byte(fmt.Sprint(i)), []byte("v")))
+	}
+	must(s.SAdd([]byte("keep"), bs("a", "b")...))
+	// 结构的 key 不在默认的 bucket 中
+	if keys := must(db.ListKeys()); len(keys) != 0 {
+		t.Fatalf("%d keys in default bucket", len(keys))
+	}
+	before := countKeys(t, db)
+	if !must(s.Del(key)) {
+		t.Fatal("del")
+	}
+	if after := countKeys(t, db); after != before-1 {
+		t.Fatalf("%d keys before %d after", before, after)
+	}
+	must(s.HSet(key, []byte("new"), []byte("v")))
+	if all := must(s.HGetAll(key)); len(all) != 1 || must(s.HLen(key)) != 1 {
+		t.Fatalf("%d fields", len(all))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开之后版本号继续递增 不会看到旧的成员
+	db, s = open(t, dir)
+	defer db.Close()
+	must(s.Del(key))
+	must(s.HSet(key, []byte("0"), []byte("v")))
+	if all := must(s.HGetAll(key)); len(all) != 1 {
+		t.Fatalf("%d fields", len(all))
+	}
+	if err := db.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	// 计数器 两个元数据 三个成员
+	if n := countKeys(t, db); n != 6 {
+		t.Fatal(n)
+	}
+	if all := must(s.HGetAll(key)); len(all) != 1 {
+		t.Fatalf("%d fields", len(all))
+	}
+	if members := must(s.SMembers([]byte("keep"))); len(members) != 2 {
+		t.Fatalf("%q", members)
+	}
+}
+
+// 并发写入同一个结构 元数据中的数量保持一致
+func TestConcurrent(t *testing.T) {
+	db, s := open(t, t.TempDir())
+	defer db.Close()
+	key := []byte("l")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				if _, err := s.RPush(key, []byte(fmt.Sprint(i, j))); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.SAdd([]byte("s"), []byte(fmt.Sprint(j))); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := must(s.LLen(key)); n != 400 || len(must(s.LRange(key, 0, -1))) != 400 {
+		t.Fatal(n)
+	}
+	if n := must(s.SCard([]byte("s"))); n != 50 {
+		t.Fatal(n)
+	}
+}
+
+// 同一个 Db 上的多个实例分配的版本号不会重复
+func TestVersionAcrossInstances(t *testing.T) {
+	db, s1 := open(t, t.TempDir())
+	defer db.Close()
+	s2, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i, s := range []*Structures{s1, s2} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				if _, err := s.HSet([]byte(fmt.Sprint(i, "-", j)), []byte("f"), []byte("v")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	seen := map[uint64]bool{}
+	for i := range 2 {
+		for j := range 50 {
+			m, err := s1.meta([]byte(fmt.Sprint(i, "-", j)), Hash)
+			if err != nil || m == nil {
+				t.Fatal(m, err)
+			}
+			if seen[m.version] {
+				t.Fatalf("version %d allocated twice", m.version)
+			}
+			seen[m.version] = true
+		}
+	}
+}
+
+// 持久化索引不支持 bucket
+func TestPersistentIndex(t *testing.T) {
+	db, err := bitcask.Open(bitcask.NewOptions(t.TempDir(), bitcask.WithIndexType(memtable.DiskBTreeIndex)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := New(db); !errors.Is(err, bitcask.ErrBucketUnsupported) {
+		t.Fatal(err)
+	}
+}
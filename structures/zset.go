@@ -0,0 +1,210 @@
+package structures
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/xia-Sang/bitcask"
+)
+
+var ErrNaNScore = errors.New("score is not a number")
+
+// 有序集合的每个成员有两个 key
+//
+//	m member       -> score 成员到分数
+//	s score member -> 空    按照分数排序 分数编码之后字节序和数值顺序一致
+const (
+	zsetMember = 'm'
+	zsetScore  = 's'
+)
+
+// ZMember 有序集合的成员和分数
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+// 负数翻转所有位 非负数翻转符号位 -0 和 0 使用相同的编码
+func encodeScore(score float64) []byte {
+	if score == 0 {
+		score = 0
+	}
+	bits := math.Float64bits(score)
+	if bits>>63 == 1 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+func decodeScore(buf []byte) float64 {
+	bits := binary.BigEndian.Uint64(buf)
+	if bits>>63 == 1 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func zsetMemberSub(member []byte) []byte {
+	return append([]byte{zsetMember}, member...)
+}
+
+func zsetScoreSub(score float64, member []byte) []byte {
+	return append(append([]byte{zsetScore}, encodeScore(score)...), member...)
+}
+
+// ZAdd 添加成员或者更新分数 返回新增的数量 同一个成员出现多次时使用最后的分数
+func (s *Structures) ZAdd(key []byte, members ...ZMember) (int, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	for _, zm := range members {
+		if math.IsNaN(zm.Score) {
+			return 0, ErrNaNScore
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.meta(key, ZSet)
+	if err != nil {
+		return 0, err
+	}
+	batch := bitcask.NewWriteBatch()
+	if m == nil {
+		if m, err = s.newMeta(ZSet); err != nil {
+			return 0, err
+		}
+	}
+	last := map[string]int{}
+	for i, zm := range members {
+		last[string(zm.Member)] = i
+	}
+	n := 0
+	for i, zm := range members {
+		if last[string(zm.Member)] != i {
+			continue
+		}
+		old, ok, err := s.score(key, m, zm.Member)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			if old == zm.Score {
+				continue
+			}
+			batch.Delete(dataKey(key, m.version, zsetScoreSub(old, zm.Member)))
+		} else {
+			n++
+		}
+		batch.Put(dataKey(key, m.version, zsetMemberSub(zm.Member)), encodeScore(zm.Score))
+		batch.Put(dataKey(key, m.version, zsetScoreSub(zm.Score, zm.Member)), []byte{})
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	m.size += uint64(n)
+	return n, s.commit(batch, key, m)
+}
+
+// 读取成员的分数 调用方需要持有锁
+func (s *Structures) score(key []byte, m *meta, member []byte) (float64, bool, error) {
+	buf, err := s.b.Get(dataKey(key, m.version, zsetMemberSub(member)))
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(buf) != 8 {
+		return 0, false, ErrCorruptMeta
+	}
+	return decodeScore(buf), true, nil
+}
+
+// ZScore 成员的分数 不存在时返回 bitcask.ErrKeyNotFound
+func (s *Structures) ZScore(key, member []byte) (float64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, ZSet)
+	if err != nil {
+		return 0, err
+	}
+	if m == nil {
+		return 0, bitcask.ErrKeyNotFound
+	}
+	score, ok, err := s.score(key, m, member)
+	if err == nil && !ok {
+		err = bitcask.ErrKeyNotFound
+	}
+	return score, err
+}
+
+// ZRem 删除成员 返回实际删除的数量 最后一个成员删除之后有序集合也被删除
+func (s *Structures) ZRem(key []byte, members ...[]byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.meta(key, ZSet)
+	if err != nil || m == nil {
+		return 0, err
+	}
+	batch := bitcask.NewWriteBatch()
+	seen := map[string]bool{}
+	n := 0
+	for _, member := range members {
+		if seen[string(member)] {
+			continue
+		}
+		seen[string(member)] = true
+		score, ok, err := s.score(key, m, member)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			batch.Delete(dataKey(key, m.version, zsetMemberSub(member)))
+			batch.Delete(dataKey(key, m.version, zsetScoreSub(score, member)))
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	m.size -= uint64(n)
+	return n, s.commit(batch, key, m)
+}
+
+// ZCard 成员的数量
+func (s *Structures) ZCard(key []byte) (int, error) {
+	return s.size(key, ZSet)
+}
+
+// ZRangeByScore 按照分数从小到大返回 [min, max] 范围内的成员 分数相同时按照成员的字节序
+func (s *Structures) ZRangeByScore(key []byte, min, max float64) ([]ZMember, error) {
+	if math.IsNaN(min) || math.IsNaN(max) {
+		return nil, ErrNaNScore
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, err := s.meta(key, ZSet)
+	if err != nil || m == nil || min > max {
+		return nil, err
+	}
+	opts := bitcask.IteratorOptions{
+		Prefix: []byte{zsetScore},
+		Start:  zsetScoreSub(min, nil),
+	}
+	// 分数等于 max 的成员都包含在内
+	if end := encodeScore(max); binary.BigEndian.Uint64(end) != math.MaxUint64 {
+		opts.End = zsetScoreSub(0, nil)
+		binary.BigEndian.PutUint64(opts.End[1:], binary.BigEndian.Uint64(end)+1)
+	}
+	var members []ZMember
+	err = s.scan(key, m, opts, false, func(sub, _ []byte) bool {
+		members = append(members, ZMember{Member: sub[9:], Score: decodeScore(sub[1:9])})
+		return true
+	})
+	return members, err
+}
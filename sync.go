@@ -0,0 +1,186 @@
+package bitcask
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+// SyncMode 写入之后何时落盘
+type SyncMode int
+
+const (
+	SyncNever    SyncMode = iota //只在切换文件和关闭时落盘
+	SyncAlways                   //每次写入都等待落盘
+	SyncBytes                    //未落盘的数据超过 SyncPolicy.Bytes 时落盘
+	SyncInterval                 //后台每隔 SyncPolicy.Interval 落盘一次
+)
+
+// SyncPolicy 落盘策略
+type SyncPolicy struct {
+	Mode     SyncMode
+	Bytes    int64
+	Interval time.Duration
+}
+
+func (p SyncPolicy) validate() error {
+	switch p.Mode {
+	case SyncNever, SyncAlways:
+	case SyncBytes:
+		if p.Bytes <= 0 {
+			return errors.New("sync bytes must be positive")
+		}
+	case SyncInterval:
+		if p.Interval <= 0 {
+			return errors.New("sync interval must be positive")
+		}
+	default:
+		return errors.New("unknown sync mode")
+	}
+	return nil
+}
+
+// WriteOptions 单次写入的选项
+type WriteOptions struct {
+	Sync bool //等待落盘之后再返回 不受 SyncPolicy 的影响
+}
+
+// 组提交 同时等待落盘的写入共享一次 fsync
+// 每次写入领取一个递增的编号 落盘时覆盖所有已经领取的编号
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written atomic.Uint64 //已经写入的最大编号
+	synced  uint64        //已经落盘的最大编号
+	syncing bool          //是否有写入正在执行落盘
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// 写入之后领取编号 调用方需要持有写锁 保证编号和写入的顺序一致
+func (g *groupCommit) issue() uint64 {
+	return g.written.Add(1)
+}
+
+// 等待编号为 ticket 的写入落盘
+// 没有正在进行的落盘时 当前写入成为领导者 一次落盘覆盖其他等待者
+func (g *groupCommit) wait(ticket uint64, sync func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < ticket {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		target := g.written.Load()
+		g.mu.Unlock()
+		err := sync()
+		g.mu.Lock()
+		g.syncing = false
+		if err == nil {
+			g.synced = max(g.synced, target)
+		}
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 在写锁内执行写入 之后按照同步策略等待落盘
+func (db *Db) update(wo *WriteOptions, fn func() error) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	if err := fn(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	ticket := db.commit.issue()
+	sync := db.needSync(wo)
+	db.mu.Unlock()
+	if !sync {
+		return nil
+	}
+	return db.commit.wait(ticket, db.syncActive)
+}
+
+func (db *Db) needSync(wo *WriteOptions) bool {
+	if wo != nil && wo.Sync {
+		return true
+	}
+	switch db.opts.SyncPolicy.Mode {
+	case SyncAlways:
+		return true
+	case SyncBytes:
+		return db.unsynced.Load() >= db.opts.SyncPolicy.Bytes
+	}
+	return false
+}
+
+// 活跃文件落盘 不持有写锁 落盘期间写入可以继续进行
+// 之前的文件在切换时已经落盘 被关闭的文件关闭前同样已经落盘
+func (db *Db) syncActive() error {
+	db.mu.RLock()
+	w := db.activeFiles
+	db.mu.RUnlock()
+	if w == nil {
+		return nil
+	}
+	n := db.unsynced.Load()
+	if err := w.Sync(); err != nil && !errors.Is(err, wal.ErrClosed) {
+		return err
+	}
+	db.unsynced.Add(-n)
+	return nil
+}
+
+// Sync 将所有已经写入的数据落盘
+func (db *Db) Sync() error {
+	if db.opts.ReadOnly {
+		return nil
+	}
+	return db.commit.wait(db.commit.written.Load(), db.syncActive)
+}
+
+// 后台定期落盘
+func (db *Db) startSyncer(interval time.Duration) {
+	db.syncStop = make(chan struct{})
+	db.syncDone = make(chan struct{})
+	go func() {
+		defer close(db.syncDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.syncStop:
+				return
+			case <-ticker.C:
+				if err := db.Sync(); err != nil {
+					log.Printf("failed to sync: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+func (db *Db) stopSyncer() {
+	if db.syncStop == nil {
+		return
+	}
+	close(db.syncStop)
+	<-db.syncDone
+	db.syncStop = nil
+}
@@ -0,0 +1,159 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// PutWithTTL 写入数据 超过ttl之后自动过期
+func (db *Db) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return db.Put(key, value)
+	}
+	return db.put(key, value, time.Now().Add(ttl).UnixNano(), nil)
+}
+
+// TTL 返回剩余的存活时间 0表示永不过期
+// 不存在或者已经过期时返回 ErrKeyNotFound 只查询索引 不读取 value
+func (db *Db) TTL(key []byte) (time.Duration, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	now := time.Now().UnixNano()
+	pos, ok := db.livePos(key, now)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if pos.ExpireAt == 0 {
+		return 0, nil
+	}
+	return time.Duration(pos.ExpireAt - now), nil
+}
+
+// Persist 移除过期时间 重新写入一条不过期的记录
+func (db *Db) Persist(key []byte) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return db.update(nil, func() error {
+		pos, ok := db.livePos(key, time.Now().UnixNano())
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if pos.ExpireAt == 0 {
+			return nil
+		}
+		val, err := db.getValueByPos(pos)
+		if err != nil {
+			return err
+		}
+		return db.putLocked(key, val, 0)
+	})
+}
+
+// 返回没有过期的位置信息 调用方需要持有锁
+func (db *Db) livePos(key []byte, now int64) (*wal.Pos, bool) {
+	pos, ok := db.memTable.Get(key)
+	if !ok || pos.(*wal.Pos).Expired(now) {
+		return nil, false
+	}
+	return pos.(*wal.Pos), true
+}
+
+// 每次持有写锁清理的key数量 避免长时间阻塞写入
+const sweepChunk = 256
+
+// 写入墓碑 清理已经过期的key
+// 在读锁下收集过期的key 再分批持有写锁写入墓碑
+func (db *Db) sweepExpired() error {
+	now := time.Now().UnixNano()
+	keys, err := db.expiredKeys(now)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		n := min(len(keys), sweepChunk)
+		if err := db.sweepKeys(keys[:n], now); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// 已经关闭时返回 ErrClosed
+func (db *Db) expiredKeys(now int64) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	var keys [][]byte
+	for iter := db.memTable.Iterator(); iter.Valid(); iter.Next() {
+		key, pos := iter.Curr()
+		if pos.(*wal.Pos).Expired(now) {
+			keys = append(keys, bytes.Clone(key))
+		}
+	}
+	return keys, nil
+}
+
+func (db *Db) sweepKeys(keys [][]byte, now int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	for _, key := range keys {
+		// 扫描之后可能已经被重新写入
+		pos, ok := db.memTable.Get(key)
+		if !ok || !pos.(*wal.Pos).Expired(now) {
+			continue
+		}
+		tomb, err := db.appendRecord(&wal.Record{Type: wal.RecordDelete, Key: key})
+		if err != nil {
+			return err
+		}
+		db.saveVersion(key, tomb.Seq)
+		db.memTable.Delete(key)
+	}
+	return db.indexErr()
+}
+
+// 后台定期清理过期的key
+func (db *Db) startSweeper(interval time.Duration) {
+	db.sweepStop = make(chan struct{})
+	db.sweepDone = make(chan struct{})
+	go func() {
+		defer close(db.sweepDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-db.sweepStop:
+				return
+			case <-ticker.C:
+				if err := db.sweepExpired(); err != nil {
+					log.Printf("failed to sweep expired keys: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+func (db *Db) stopSweeper() {
+	if db.sweepStop == nil {
+		return
+	}
+	close(db.sweepStop)
+	<-db.sweepDone
+	db.sweepStop = nil
+}
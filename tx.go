@@ -0,0 +1,137 @@
+package bitcask
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/xia-Sang/bitcask/wal"
+)
+
+var (
+	ErrTxConflict = errors.New("transaction conflict") //读取过的key在事务开始之后被其他写入修改
+	ErrTxClosed   = errors.New("transaction is closed")
+)
+
+// Tx 乐观事务 写入先缓存在事务中 提交时作为一个批次原子地写入
+// 提交时检查读取过的key在事务开始之后有没有被修改 有修改时返回 ErrTxConflict
+type Tx struct {
+	db     *Db
+	seq    uint64          //开始时的序号
+	reads  map[string]bool //读取过的key 以及读取时是否存在
+	writes map[string]int  //key在 ops 中的下标 同一个key只保留最后一次写入
+	ops    []batchOp
+	closed bool
+}
+
+// Begin 开始一个事务 事务不能在多个协程中同时使用
+func (db *Db) Begin() *Tx {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return &Tx{
+		db:     db,
+		seq:    db.seq,
+		reads:  map[string]bool{},
+		writes: map[string]int{},
+	}
+}
+
+// Get 读取数据 可以读到事务自己的写入 不存在时返回 ErrKeyNotFound
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if tx.closed {
+		return nil, ErrTxClosed
+	}
+	if i, ok := tx.writes[string(key)]; ok {
+		if tx.ops[i].typ == wal.RecordDelete {
+			return nil, ErrKeyNotFound
+		}
+		return bytes.Clone(tx.ops[i].value), nil
+	}
+	db := tx.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	pos, ok := db.livePos(key, time.Now().UnixNano())
+	if _, read := tx.reads[string(key)]; !read {
+		tx.reads[string(key)] = ok
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return db.getValueByPos(pos)
+}
+
+// Put 在事务中写入数据 提交之前对其他读取不可见
+func (tx *Tx) Put(key, value []byte) error {
+	return tx.write(batchOp{typ: wal.RecordPut, key: bytes.Clone(key), value: bytes.Clone(value)})
+}
+
+// Delete 在事务中删除数据
+func (tx *Tx) Delete(key []byte) error {
+	return tx.write(batchOp{typ: wal.RecordDelete, key: bytes.Clone(key)})
+}
+func (tx *Tx) write(op batchOp) error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if tx.db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if bytes.Equal(op.key, wal.BatchFinKey) {
+		return ErrReservedKey
+	}
+	if err := tx.db.checkKey(op.key); err != nil {
+		return err
+	}
+	if i, ok := tx.writes[string(op.key)]; ok {
+		tx.ops[i] = op
+		return nil
+	}
+	tx.writes[string(op.key)] = len(tx.ops)
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// Commit 检查冲突并提交写入 之后事务不能再使用
+// 读取过的key在事务开始之后被修改或者删除时返回 ErrTxConflict 写入全部不生效
+func (tx *Tx) Commit() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.closed = true
+	db := tx.db
+	if len(tx.ops) == 0 {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if db.closed {
+			return ErrClosed
+		}
+		return tx.validate()
+	}
+	return db.update(nil, func() error {
+		if err := tx.validate(); err != nil {
+			return err
+		}
+		return db.writeBatch(defaultBucket, &WriteBatch{ops: tx.ops})
+	})
+}
+
+// Rollback 丢弃事务中的写入
+func (tx *Tx) Rollback() {
+	tx.closed = true
+}
+
+// 调用方需要持有锁
+func (tx *Tx) validate() error {
+	now := time.Now().UnixNano()
+	for key, existed := range tx.reads {
+		pos, ok := tx.db.livePos([]byte(key), now)
+		// 被删除的key不在索引中 只能和读取时的状态比较
+		if ok && pos.Seq > tx.seq || !ok && existed {
+			return ErrTxConflict
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec value 的压缩算法 编号写在记录头部
+type Codec byte
+
+const (
+	CodecNone   Codec = iota //不压缩
+	CodecFlate               //标准库 flate
+	CodecSnappy              //snappy 块格式 速度快 压缩率较低
+)
+
+func (c Codec) Valid() bool {
+	return c <= CodecSnappy
+}
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	case CodecSnappy:
+		return "snappy"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+var errCorruptValue = fmt.Errorf("%w: failed to decompress value", ErrCorruptRecord)
+
+// 压缩 value 结果追加到 dst 之后
+func (c Codec) encode(dst, src []byte) []byte {
+	switch c {
+	case CodecFlate:
+		return flateEncode(dst, src)
+	case CodecSnappy:
+		return snappyEncode(dst, src)
+	}
+	return append(dst, src...)
+}
+
+// 解压 value 返回新分配的内存
+func (c Codec) decode(src []byte) ([]byte, error) {
+	switch c {
+	case CodecFlate:
+		return flateDecode(src)
+	case CodecSnappy:
+		return snappyDecode(src)
+	}
+	return src, nil
+}
+
+// flate 编码格式 uvarint(原始长度)+flate数据
+var (
+	flateWriters = sync.Pool{New: func() any {
+		fw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return fw
+	}}
+	flateReaders = sync.Pool{New: func() any {
+		return flate.NewReader(nil)
+	}}
+)
+
+func flateEncode(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(binary.AppendUvarint(dst, uint64(len(src))))
+	fw := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(fw)
+	fw.Reset(buf)
+	// 写入内存不会失败
+	_, _ = fw.Write(src)
+	_ = fw.Close()
+	return buf.Bytes()
+}
+
+func flateDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, errCorruptValue
+	}
+	fr := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(fr)
+	if err := fr.(flate.Resetter).Reset(bytes.NewReader(src[k:]), nil); err != nil {
+		return nil, errCorruptValue
+	}
+	// flate 的压缩率不超过1032 长度字段损坏时最多读取到这个上限
+	dst, err := io.ReadAll(io.LimitReader(fr, int64(min(n, uint64(len(src))*1100))+1))
+	if err != nil || uint64(len(dst)) != n {
+		return nil, errCorruptValue
+	}
+	return dst, nil
+}
+
+// snappy 块格式 uvarint(原始长度)+若干元素
+// 元素的标签低两位为类型 0:字面量 1:1字节偏移的复制 2:2字节偏移的复制 3:4字节偏移的复制
+const (
+	snappyMaxOffset = 1<<16 - 1 //只生成2字节偏移以内的复制
+	snappyMinMatch  = 4
+)
+
+func snappyEncode(dst, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	if len(src) < snappyMinMatch {
+		return snappyLiteral(dst, src)
+	}
+	// 哈希表记录每个4字节序列最近出现的位置+1
+	tableSize := 256
+	for tableSize < 1<<14 && tableSize < len(src) {
+		tableSize <<= 1
+	}
+	table := make([]int32, tableSize)
+	hash := func(u uint32) int {
+		return int((u * 0x1e35a7bd) >> 18 & uint32(tableSize-1))
+	}
+
+	lit := 0
+	for s := 0; s+snappyMinMatch <= len(src); {
+		u := binary.LittleEndian.Uint32(src[s:])
+		h := hash(u)
+		cand := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if cand < 0 || s-cand > snappyMaxOffset || binary.LittleEndian.Uint32(src[cand:]) != u {
+			s++
+			continue
+		}
+		dst = snappyLiteral(dst, src[lit:s])
+		n := snappyMinMatch
+		for s+n < len(src) && src[cand+n] == src[s+n] {
+			n++
+		}
+		dst = snappyCopy(dst, s-cand, n)
+		s += n
+		lit = s
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// 长度至少为4 超过64的复制拆成多个元素
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
+
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	// 每个元素至少占用1字节 最多展开为64字节
+	if k <= 0 || n > uint64(len(src))*64 {
+		return nil, errCorruptValue
+	}
+	dst := make([]byte, n)
+	d := 0
+	for s := k; s < len(src); {
+		tag := src[s]
+		var offset, length int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				nb := length - 59
+				if s+nb > len(src) {
+					return nil, errCorruptValue
+				}
+				length = 0
+				for i := range nb {
+					length |= int(src[s+i]) << (8 * i)
+				}
+				s += nb
+			}
+			length++
+			if length > len(src)-s || length > len(dst)-d {
+				return nil, errCorruptValue
+			}
+			d += copy(dst[d:], src[s:s+length])
+			s += length
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return nil, errCorruptValue
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return nil, errCorruptValue
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return nil, errCorruptValue
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > d || length > len(dst)-d {
+			return nil, errCorruptValue
+		}
+		if offset >= length {
+			d += copy(dst[d:d+length], dst[d-offset:])
+			continue
+		}
+		// 偏移小于长度时源和目标重叠 需要逐字节复制
+		for i := range length {
+			dst[d+i] = dst[d-offset+i]
+		}
+		d += length
+	}
+	if d != len(dst) {
+		return nil, errCorruptValue
+	}
+	return dst, nil
+}
@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/xia-Sang/bitcask/utils"
+)
+
+// 类似业务中的 json 数据 压缩率较高
+func testJSON(i int) []byte {
+	items := make([]map[string]any, 16)
+	for j := range items {
+		items[j] = map[string]any{
+			"id":     i*100 + j,
+			"name":   fmt.Sprintf("user-%d-%d", i, j),
+			"email":  fmt.Sprintf("user-%d-%d@example.com", i, j),
+			"tags":   []string{"alpha", "beta", "gamma"},
+			"status": "active",
+			"score":  (i + j) % 17,
+		}
+	}
+	buf, _ := json.Marshal(map[string]any{"page": i, "items": items})
+	return buf
+}
+
+func TestCodec(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcd"),
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("abc"), 100000),
+		utils.GenerateRandomBytes(5000),
+		testJSON(1),
+	}
+	// 随机字母表较小的数据 产生大量长短不一的匹配
+	for _, n := range []int{10, 100, 3000, 70000} {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = "abcdefgh"[r.Intn(4)]
+		}
+		inputs = append(inputs, buf)
+	}
+	for _, codec := range []Codec{CodecFlate, CodecSnappy} {
+		for i, src := range inputs {
+			enc := codec.encode(nil, src)
+			dec, err := codec.decode(enc)
+			if err != nil || !bytes.Equal(dec, src) {
+				t.Fatalf("%v %d: %v", codec, i, err)
+			}
+			// 截断的数据不能解压成功 也不能 panic
+			for _, n := range []int{0, 1, len(enc) / 2, len(enc) - 1} {
+				if n >= len(enc) {
+					continue
+				}
+				if dec, err := codec.decode(enc[:n]); err == nil && !bytes.Equal(dec, src) {
+					t.Fatalf("%v %d: truncated to %d decoded", codec, i, n)
+				}
+			}
+		}
+		if enc := codec.encode(nil, testJSON(1)); len(enc) >= len(testJSON(1)) {
+			t.Fatalf("%v: %d >= %d", codec, len(enc), len(testJSON(1)))
+		}
+	}
+	// 随机的数据不能让解码器 panic
+	for range 1000 {
+		buf := utils.GenerateRandomBytes(1 + r.Intn(64))
+		_, _ = CodecSnappy.decode(buf)
+		_, _ = CodecFlate.decode(buf)
+	}
+}
+
+// 压缩过的记录读取时透明解压 没有变小的 value 按照原样存储
+func TestCompressedRecord(t *testing.T) {
+	for _, codec := range []Codec{CodecFlate, CodecSnappy} {
+		t.Run(codec.String(), func(t *testing.T) {
+			w, err := NewWal(t.TempDir(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			values := [][]byte{testJSON(1), utils.GenerateRandomBytes(64), {}, testJSON(2)}
+			var pos []*Pos
+			for i, v := range values {
+				p, err := w.WriteRecord(&Record{Type: RecordPut, Codec: codec, Key: utils.GenerateKey(i), Value: v})
+				if err != nil {
+					t.Fatal(err)
+				}
+				pos = append(pos, p)
+			}
+			if pos[0].Length >= len(values[0]) {
+				t.Fatalf("record not compressed: %d", pos[0].Length)
+			}
+			if _, err := w.WriteRecord(&Record{Type: RecordDelete, Codec: codec, Key: utils.GenerateKey(0)}); err != nil {
+				t.Fatal(err)
+			}
+
+			var codecs []Codec
+			if err := w.Fold(func(r *Record, p *Pos) error {
+				codecs = append(codecs, r.Codec)
+				if r.Type == RecordPut && !bytes.Equal(r.Value, values[len(codecs)-1]) {
+					t.Fatalf("%s: %s", r.Key, r.Value)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			want := []Codec{codec, CodecNone, CodecNone, codec, CodecNone}
+			if fmt.Sprint(codecs) != fmt.Sprint(want) {
+				t.Fatalf("codecs %v want %v", codecs, want)
+			}
+
+			check := func() {
+				for i, p := range pos {
+					_, value, err := w.ReadBuf(p.Offset, p.Length)
+					if err != nil || !bytes.Equal(value, values[i]) || value == nil {
+						t.Fatalf("%d: %s %v", i, value, err)
+					}
+				}
+			}
+			check()
+			if err := w.Mmap(); err != nil && !errors.Is(err, ErrMmapUnsupported) {
+				t.Fatal(err)
+			}
+			check()
+		})
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	src := testJSON(1)
+	for _, codec := range []Codec{CodecFlate, CodecSnappy} {
+		enc := codec.encode(nil, src)
+		b.Run(codec.String()+"/encode", func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			for range b.N {
+				codec.encode(nil, src)
+			}
+		})
+		b.Run(codec.String()+"/decode", func(b *testing.B) {
+			b.SetBytes(int64(len(src)))
+			b.ReportMetric(float64(len(src))/float64(len(enc)), "ratio")
+			for range b.N {
+				if _, err := codec.decode(enc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrWrongKey 文件使用的密钥不在密钥环中
+var ErrWrongKey = errors.New("wrong encryption key")
+
+const nonceSize = 12 //AES-GCM 的随机数长度
+
+// KeyId 密钥的编号 写在文件头中 用于选择解密使用的密钥
+// 使用以密钥为键的 HMAC 计算 文件头中的编号不能用来比对密钥的摘要
+func KeyId(key []byte) uint32 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bitcask key id"))
+	// 0 表示不加密
+	return max(binary.BigEndian.Uint32(mac.Sum(nil)), 1)
+}
+
+// Keyring 加密数据文件和索引文件的密钥
+// 新文件使用当前密钥 旧的密钥只用于读取 合并之后旧的文件都会换成当前密钥
+type Keyring struct {
+	current uint32 //0 表示新文件不加密
+	aeads   map[uint32]cipher.AEAD
+}
+
+// NewKeyring 创建密钥环 current 为空时新文件不加密
+// 密钥的长度为 16 24 或者 32 字节 分别对应 AES-128 AES-192 AES-256
+func NewKeyring(current []byte, old ...[]byte) (*Keyring, error) {
+	kr := &Keyring{aeads: map[uint32]cipher.AEAD{}}
+	for i, key := range append([][]byte{current}, old...) {
+		if i == 0 && key == nil {
+			continue
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := KeyId(key)
+		if i == 0 {
+			kr.current = id
+		}
+		kr.aeads[id] = aead
+	}
+	return kr, nil
+}
+
+// KeyId 新文件使用的密钥编号 0 表示不加密
+func (kr *Keyring) KeyId() uint32 {
+	if kr == nil {
+		return 0
+	}
+	return kr.current
+}
+
+// 文件的编码格式 由文件头决定
+type fileFormat struct {
+	version uint32
+	keyId   uint32
+	aead    cipher.AEAD //为空表示不加密
+}
+
+// 新文件使用当前版本和当前密钥
+func (kr *Keyring) newFormat() fileFormat {
+	f := fileFormat{version: FormatVersion}
+	if kr != nil && kr.current != 0 {
+		f.keyId, f.aead = kr.current, kr.aeads[kr.current]
+	}
+	return f
+}
+
+// 按照文件头中的密钥编号选择密钥 没有对应的密钥时返回 ErrWrongKey
+func (kr *Keyring) format(h fileHeader, name string) (fileFormat, error) {
+	f := fileFormat{version: h.version, keyId: h.keyId}
+	if h.keyId == 0 {
+		return f, nil
+	}
+	if kr != nil {
+		f.aead = kr.aeads[h.keyId]
+	}
+	if f.aead == nil {
+		return f, fmt.Errorf("%w: %s is encrypted with key %08x", ErrWrongKey, name, h.keyId)
+	}
+	return f, nil
+}
+
+// 加密之后每条记录增加的长度 随机数+认证标签
+func (f *fileFormat) overhead() int {
+	if f.aead == nil {
+		return 0
+	}
+	return nonceSize + f.aead.Overhead()
+}
+
+// 原地加密 buf 开头预留随机数的位置 之后是明文 容量需要包含认证标签
+// 记录头部作为附加数据 一起被认证
+func (f *fileFormat) seal(buf []byte, header []byte) []byte {
+	nonce := buf[:nonceSize]
+	// 系统的随机数不可用时无法安全地加密
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	plain := buf[nonceSize:]
+	return f.aead.Seal(buf[:nonceSize], nonce, plain, header)
+}
+
+// 解密 payload 返回新分配的明文
+func (f *fileFormat) open(payload []byte, header []byte) ([]byte, error) {
+	if len(payload) < f.overhead() {
+		return nil, errTornRecord
+	}
+	plain, err := f.aead.Open(nil, payload[:nonceSize], payload[nonceSize:], header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt record", ErrCorruptRecord)
+	}
+	return plain, nil
+}
@@ -0,0 +1,168 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestKeyring(t *testing.T) {
+	if _, err := NewKeyring([]byte("short")); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+	if _, err := NewKeyring(testKey1, []byte("short")); err == nil {
+		t.Fatal("invalid old key accepted")
+	}
+	kr, err := NewKeyring(nil, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kr.KeyId() != 0 || (*Keyring)(nil).KeyId() != 0 {
+		t.Fatal("plaintext keyring has key id")
+	}
+	if KeyId(testKey1) == KeyId(testKey2) || KeyId(testKey1) == 0 {
+		t.Fatal("bad key id")
+	}
+}
+
+// 加密之后文件中没有明文 密钥错误时返回 ErrWrongKey 而不是校验错误
+func TestEncryptedWal(t *testing.T) {
+	dir := t.TempDir()
+	kr1, err := NewKeyring(testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewEncryptedWal(dir, 1, kr1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []*Record{
+		{Type: RecordPut, Key: []byte("secret-key-1"), Value: []byte("secret-value-1")},
+		{Type: RecordPut, Key: []byte("secret-key-2"), Value: testJSON(1), Codec: CodecSnappy},
+		{Type: RecordPut, Key: []byte("secret-key-3"), Value: []byte{}},
+		{Type: RecordDelete, Key: []byte("secret-key-1")},
+	}
+	var pos []*Pos
+	for _, r := range records {
+		p, err := w.WriteRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos = append(pos, p)
+	}
+	if err := w.WriteHint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{GetWalPath(1), GetHintPath(1)} {
+		buf, err := os.ReadFile(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(buf, []byte("secret")) {
+			t.Fatalf("%s contains plaintext", name)
+		}
+	}
+
+	// 没有密钥或者密钥错误
+	kr2, err := NewKeyring(testKey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kr := range []*Keyring{nil, kr2} {
+		if _, err := NewEncryptedWal(dir, 1, kr); !errors.Is(err, ErrWrongKey) {
+			t.Fatal(err)
+		}
+		if _, err := ReadHintFile(dir, 1, kr, func(h *Hint) {}); !errors.Is(err, ErrWrongKey) {
+			t.Fatal(err)
+		}
+	}
+
+	// 旧的密钥可以读取 新文件使用当前密钥
+	kr, err := NewKeyring(testKey2, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewEncryptedWal(dir, 1, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.KeyId() != KeyId(testKey1) {
+		t.Fatalf("key id %08x", w.KeyId())
+	}
+	var got []*Record
+	if err := w.Fold(func(r *Record, p *Pos) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d records", len(got))
+	}
+	for i, r := range got {
+		if r.Type != records[i].Type || !bytes.Equal(r.Key, records[i].Key) || !bytes.Equal(r.Value, records[i].Value) {
+			t.Fatalf("%d: %+v", i, r)
+		}
+	}
+	var hints []*Hint
+	if _, err := ReadHintFile(dir, 1, kr, func(h *Hint) { hints = append(hints, h) }); err != nil || len(hints) != len(records) {
+		t.Fatalf("%d hints: %v", len(hints), err)
+	}
+	check := func() {
+		for i, p := range pos[:3] {
+			_, value, err := w.ReadBuf(p.Offset, p.Length)
+			if err != nil || !bytes.Equal(value, records[i].Value) || value == nil {
+				t.Fatalf("%d: %s %v", i, value, err)
+			}
+		}
+	}
+	check()
+	if err := w.Mmap(); err != nil && !errors.Is(err, ErrMmapUnsupported) {
+		t.Fatal(err)
+	}
+	check()
+
+	w2, err := NewEncryptedWal(dir, 2, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if w2.KeyId() != KeyId(testKey2) {
+		t.Fatalf("key id %08x", w2.KeyId())
+	}
+
+	// 篡改密文 认证失败
+	fp, err := os.OpenFile(path.Join(dir, GetWalPath(1)), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	last := int64(pos[0].Offset + pos[0].Length - 1)
+	if _, err := fp.ReadAt(b, last); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := fp.WriteAt(b, last); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	w3, err := NewEncryptedWal(dir, 1, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w3.Close()
+	if _, _, err := w3.ReadBuf(pos[0].Offset, pos[0].Length); !errors.Is(err, ErrCorruptRecord) {
+		t.Fatal(err)
+	}
+}
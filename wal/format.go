@@ -0,0 +1,121 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// 文件头 magic(8)+version(4)+createdAt(8)+keyId(4)+crc(4)
+// 数据文件和索引文件都以文件头开始 没有文件头的是最初版本的数据文件
+const (
+	FileHeaderSize = 28
+	FormatVersion  = 1 //当前的格式版本
+
+	legacyVersion = 0 //没有文件头的旧格式 记录为 crc+keySize+valueSize+key+value
+)
+
+var fileMagic = []byte("BCASKWAL")
+
+var (
+	ErrBadFileHeader      = errors.New("bad file header")
+	ErrUnsupportedVersion = errors.New("unsupported format version")
+)
+
+// 没有文件头的文件必须以一条完整的旧格式记录开始
+// 第一条记录不能解析时返回错误 不能按照旧格式继续回放或者截断文件
+func checkLegacy(r io.ReaderAt, f *fileFormat, size int) error {
+	if f.version != legacyVersion || size == 0 {
+		return nil
+	}
+	if _, _, err := readData(r, 0, f, size); err != nil {
+		return fmt.Errorf("unrecognized legacy file: %w", err)
+	}
+	return nil
+}
+
+// RecordType 记录类型
+type RecordType byte
+
+const (
+	RecordPut      RecordType = iota + 1 //写入
+	RecordDelete                         //删除
+	RecordBatchFin                       //批次提交
+)
+
+func (t RecordType) valid() bool {
+	return t >= RecordPut && t <= RecordBatchFin
+}
+
+// 没有指定类型的记录 按照旧格式的规则推断
+func inferType(r *Record) RecordType {
+	switch {
+	case r.Seq != 0 && bytes.Equal(r.Key, BatchFinKey):
+		return RecordBatchFin
+	case len(r.Value) == 0:
+		return RecordDelete
+	default:
+		return RecordPut
+	}
+}
+
+// 文件头中的信息
+type fileHeader struct {
+	version   uint32
+	createdAt time.Time
+	keyId     uint32 //加密使用的密钥编号 0表示不加密
+}
+
+func appendFileHeader(dst []byte, createdAt time.Time, keyId uint32) []byte {
+	var buf [FileHeaderSize]byte
+	copy(buf[:], fileMagic)
+	binary.BigEndian.PutUint32(buf[8:], FormatVersion)
+	binary.BigEndian.PutUint64(buf[12:], uint64(createdAt.UnixNano()))
+	binary.BigEndian.PutUint32(buf[20:], keyId)
+	binary.BigEndian.PutUint32(buf[24:], crc32.ChecksumIEEE(buf[:24]))
+	return append(dst, buf[:]...)
+}
+
+// 读取文件头 开头不是 magic 的文件按照旧格式读取
+func readFileHeader(r io.ReaderAt) (fileHeader, error) {
+	var buf [FileHeaderSize]byte
+	n, err := r.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return fileHeader{}, err
+	}
+	// 写入文件头时崩溃 只留下了一部分
+	if n > 0 && n < len(fileMagic) && bytes.HasPrefix(fileMagic, buf[:n]) {
+		return fileHeader{}, ErrBadFileHeader
+	}
+	if n < len(fileMagic) || !bytes.Equal(buf[:len(fileMagic)], fileMagic) {
+		return fileHeader{version: legacyVersion}, nil
+	}
+	if n < len(fileMagic)+4 {
+		return fileHeader{}, ErrBadFileHeader
+	}
+	h := fileHeader{version: binary.BigEndian.Uint32(buf[8:])}
+	if h.version == legacyVersion {
+		return fileHeader{}, ErrBadFileHeader
+	}
+	if h.version > FormatVersion {
+		return fileHeader{}, ErrUnsupportedVersion
+	}
+	if n < FileHeaderSize || crc32.ChecksumIEEE(buf[:FileHeaderSize-4]) != binary.BigEndian.Uint32(buf[FileHeaderSize-4:]) {
+		return fileHeader{}, ErrBadFileHeader
+	}
+	h.createdAt = time.Unix(0, int64(binary.BigEndian.Uint64(buf[12:])))
+	h.keyId = binary.BigEndian.Uint32(buf[20:])
+	return h, nil
+}
+
+// 第一条记录的偏移
+func dataStart(version uint32) int {
+	if version == legacyVersion {
+		return 0
+	}
+	return FileHeaderSize
+}
@@ -0,0 +1,196 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/xia-Sang/bitcask/memtable"
+)
+
+const HintFileName = ".hint"
+
+// Hint 索引文件中的一项 记录key在数据文件中的位置
+// 启动时直接读取索引文件 无需解码每一个value
+type Hint struct {
+	Key     []byte
+	Pos     *Pos
+	Deleted bool   //墓碑标记
+	Bucket  uint32 //所属的 bucket 写在索引文件记录的头部
+}
+
+func GetHintPath(fileId int) string {
+	return fmt.Sprintf("%08d%s", fileId, HintFileName)
+}
+
+// 编码格式 fileId+offset+length+expireAt+seq+deleted 作为记录的value
+// 旧的索引文件没有 seq 读取时为 0
+func encodeHint(h *Hint) []byte {
+	buf := make([]byte, 5*binary.MaxVarintLen64+1)
+	index := binary.PutUvarint(buf, uint64(h.Pos.FileId))
+	index += binary.PutUvarint(buf[index:], uint64(h.Pos.Offset))
+	index += binary.PutUvarint(buf[index:], uint64(h.Pos.Length))
+	index += binary.PutVarint(buf[index:], h.Pos.ExpireAt)
+	index += binary.PutUvarint(buf[index:], h.Pos.Seq)
+	if h.Deleted {
+		buf[index] = 1
+	}
+	return buf[:index+1]
+}
+func decodeHint(r *Record) (*Hint, error) {
+	buf := r.Value
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("failed to decode hint")
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	expireAt, n := binary.Varint(buf)
+	if n <= 0 || len(buf) < n+1 {
+		return nil, fmt.Errorf("failed to decode hint")
+	}
+	buf = buf[n:]
+	var seq uint64
+	if len(buf) > 1 {
+		if seq, n = binary.Uvarint(buf); n <= 0 || len(buf) != n+1 {
+			return nil, fmt.Errorf("failed to decode hint")
+		}
+		buf = buf[n:]
+	}
+	return &Hint{
+		Key: r.Key,
+		Pos: &Pos{
+			FileId:   int(fields[0]),
+			Offset:   int(fields[1]),
+			Length:   int(fields[2]),
+			ExpireAt: expireAt,
+			Seq:      seq,
+		},
+		Deleted: buf[0] == 1,
+		Bucket:  r.Bucket,
+	}, nil
+}
+
+// Hints 扫描整个数据文件 生成对应的索引项
+func (w *Wal) Hints() ([]*Hint, error) {
+	hints, _, err := w.ScanHints(ScanStrict)
+	return hints, err
+}
+
+// ScanHints 按照 mode 处理损坏的记录 同时返回遇到的损坏区域
+func (w *Wal) ScanHints(mode ScanMode) ([]*Hint, []Corruption, error) {
+	var hints []*Hint
+	corruptions, err := w.Scan(0, mode, func(r *Record, pos *Pos) error {
+		hints = append(hints, &Hint{Key: r.Key, Pos: pos, Deleted: r.Type == RecordDelete, Bucket: r.Bucket})
+		return nil
+	})
+	return hints, corruptions, err
+}
+
+// WriteHint 为当前数据文件生成索引文件 在文件封存时调用
+func (w *Wal) WriteHint() error {
+	hints, err := w.Hints()
+	if err != nil {
+		return err
+	}
+	return WriteHintFile(w.dirPath, w.FileId, hints, w.keyring)
+}
+
+// WriteHintFile 写入索引文件 使用 kr 的当前密钥加密
+// 先写入临时文件再重命名 避免留下写了一半的索引文件
+func WriteHintFile(dirPath string, fileId int, hints []*Hint, kr *Keyring) error {
+	hintPath := path.Join(dirPath, GetHintPath(fileId))
+	tmpPath := hintPath + ".tmp"
+	fp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	f := kr.newFormat()
+	buf := appendFileHeader(nil, time.Now(), f.keyId)
+	for _, h := range hints {
+		buf = appendRecord(buf, &Record{Type: RecordPut, Key: h.Key, Value: encodeHint(h), Bucket: h.Bucket}, &f)
+	}
+	if _, err := fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, hintPath)
+}
+
+// ReadHintFile 读取索引文件 按顺序回调
+// 索引文件不存在时返回 false kr 中没有对应的密钥时返回 ErrWrongKey
+func ReadHintFile(dirPath string, fileId int, kr *Keyring, fn func(h *Hint)) (bool, error) {
+	fp, err := os.Open(path.Join(dirPath, GetHintPath(fileId)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer fp.Close()
+
+	stat, err := fp.Stat()
+	if err != nil {
+		return true, err
+	}
+	// 索引文件总是带有文件头
+	h, err := readFileHeader(fp)
+	if err == nil && h.version == legacyVersion {
+		err = ErrBadFileHeader
+	}
+	if err != nil {
+		return true, err
+	}
+	f, err := kr.format(h, GetHintPath(fileId))
+	if err != nil {
+		return true, err
+	}
+	offset := FileHeaderSize
+	for {
+		r, length, err := readData(fp, offset, &f, int(stat.Size()))
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return true, err
+		}
+		h, err := decodeHint(r)
+		if err != nil {
+			return true, err
+		}
+		fn(h)
+		offset += length
+	}
+	return true, nil
+}
+
+// ApplyHint 将索引项应用到内存表
+func ApplyHint(table memtable.MemTable, h *Hint) {
+	if h.Deleted {
+		table.Delete(h.Key)
+	} else {
+		table.Put(h.Key, h.Pos)
+	}
+}
+
+// RemoveHintFile 删除索引文件
+func RemoveHintFile(dirPath string, fileId int) error {
+	err := os.Remove(path.Join(dirPath, GetHintPath(fileId)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrMmapUnsupported 当前平台不支持内存映射
+var ErrMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// Mmap 将封存的文件只读映射到内存 之后 ReadBuf 直接从映射中读取
+// 映射之后文件不能再写入 空文件不做映射
+func (w *Wal) Mmap() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.data != nil {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	stat, err := w.wal.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		return nil
+	}
+	data, err := mmap(w.wal, int(stat.Size()))
+	if err != nil {
+		return err
+	}
+	w.data = data
+	return nil
+}
+
+// Munmap 解除映射 会等待正在进行的读取结束
+func (w *Wal) Munmap() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.data == nil {
+		return nil
+	}
+	data := w.data
+	w.data = nil
+	return munmap(data)
+}
+
+// Mapped 文件是否已经映射
+func (w *Wal) Mapped() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.data != nil
+}
+
+// 从映射中读取记录 key 和 value 会被复制出来 解除映射之后仍然可以使用
+// 文件没有映射时 ok 为 false
+func (w *Wal) readMapped(off, length int) (key, value []byte, ok bool, err error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.data == nil {
+		return nil, nil, false, nil
+	}
+	if off < 0 || length <= 0 || off+length > len(w.data) {
+		return nil, nil, true, fmt.Errorf("read out of mapped range")
+	}
+	r, err := decodeRecord(w.data[off:off+length], &w.format)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	// 解密或者解压之后的数据已经不在映射中
+	if w.format.aead != nil {
+		return r.Key, r.Value, true, nil
+	}
+	if r.Codec == CodecNone {
+		r.Value = bytes.Clone(r.Value)
+	}
+	return bytes.Clone(r.Key), r.Value, true, nil
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package wal
+
+import "os"
+
+// 其他平台暂不支持内存映射 读取仍然走文件
+func mmap(fp *os.File, size int) ([]byte, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
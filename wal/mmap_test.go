@@ -0,0 +1,117 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/xia-Sang/bitcask/utils"
+)
+
+func writeTestRecords(t testing.TB, w *Wal, n, size int) ([]*Pos, [][]byte) {
+	pos, values := make([]*Pos, n), make([][]byte, n)
+	for i := range n {
+		values[i] = utils.GenerateRandomBytes(size)
+		if i%10 == 9 {
+			values[i] = nil
+		}
+		p, err := w.Write(utils.GenerateKey(i), values[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos[i] = p
+	}
+	return pos, values
+}
+
+// 映射之后的读取结果和直接读取一致 解除映射之后回到直接读取
+func TestMmap(t *testing.T) {
+	w, err := NewWal(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	pos, values := writeTestRecords(t, w, 100, 32)
+	if err := w.Mmap(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Mapped() {
+		t.Fatal("not mapped")
+	}
+	check := func() {
+		for i, p := range pos {
+			key, value, err := w.ReadBuf(p.Offset, p.Length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key, utils.GenerateKey(i)) || !bytes.Equal(value, values[i]) || (value == nil) != (values[i] == nil) {
+				t.Fatalf("%d: %s=%s", i, key, value)
+			}
+		}
+	}
+	check()
+	if _, _, err := w.ReadBuf(pos[len(pos)-1].Offset, pos[len(pos)-1].Length+1); err == nil {
+		t.Fatal("read out of range")
+	}
+
+	// 解除映射的同时读取 读取到的值不受影响
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, p := range pos {
+				_, value, err := w.ReadBuf(p.Offset, p.Length)
+				if err != nil || !bytes.Equal(value, values[i]) {
+					t.Errorf("%d: %s %v", i, value, err)
+					return
+				}
+			}
+		}()
+	}
+	if err := w.Munmap(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if w.Mapped() {
+		t.Fatal("still mapped")
+	}
+	check()
+
+	// 空文件不做映射
+	empty, err := NewWal(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if err := empty.Mmap(); err != nil || empty.Mapped() {
+		t.Fatal("empty file mapped", err)
+	}
+}
+
+// 对比直接读取和映射读取
+func BenchmarkReadBuf(b *testing.B) {
+	for _, size := range []int{16, 256, 4096} {
+		w, err := NewWal(b.TempDir(), 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		pos, _ := writeTestRecords(b, w, 1000, size)
+		run := func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := pos[i%len(pos)]
+				if _, _, err := w.ReadBuf(p.Offset, p.Length); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.Run(fmt.Sprintf("pread/%d", size), run)
+		if err := w.Mmap(); err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("mmap/%d", size), run)
+		w.Close()
+	}
+}
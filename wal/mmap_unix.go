@@ -0,0 +1,16 @@
+//go:build unix
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmap(fp *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(fp.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
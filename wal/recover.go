@@ -0,0 +1,126 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ScanMode 遍历时如何处理损坏的记录
+type ScanMode int
+
+const (
+	ScanStrict   ScanMode = iota //遇到损坏的记录直接返回错误
+	ScanTruncate                 //只处理末尾没有写完的记录 损坏之后还有完整的记录时返回错误
+	ScanSkip                     //跳过损坏的区域 从下一条完整的记录继续
+)
+
+// Corruption 文件中一段无法解析的区域
+type Corruption struct {
+	FileId int
+	Offset int   //损坏开始的位置
+	Length int   //损坏区域的长度
+	Err    error //解析时的错误
+}
+
+func (c Corruption) String() string {
+	return fmt.Sprintf("file %d offset %d length %d: %v", c.FileId, c.Offset, c.Length, c.Err)
+}
+
+// Scan 从指定的位置开始遍历已经提交的记录 按照 mode 处理损坏的记录
+// 返回遇到的损坏区域 读取文件失败时返回错误
+func (w *Wal) Scan(offset int, mode ScanMode, fn func(r *Record, pos *Pos) error) ([]Corruption, error) {
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	type pending struct {
+		record *Record
+		pos    *Pos
+	}
+	var corruptions []Corruption
+	batches := map[uint64][]pending{}
+	offset = max(offset, dataStart(w.format.version))
+	for {
+		r, length, err := readData(w.wal, offset, &w.format, w.Offset)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrCorruptRecord) && mode != ScanStrict {
+			next, rerr := w.resync(offset + 1)
+			if rerr != nil {
+				return corruptions, rerr
+			}
+			// 之后还有完整的记录 说明不是崩溃时没有写完的末尾 不能丢弃
+			if mode == ScanTruncate && next < w.Offset {
+				return corruptions, fmt.Errorf("file %d offset %d: %w", w.FileId, offset, err)
+			}
+			corruptions = append(corruptions, Corruption{FileId: w.FileId, Offset: offset, Length: next - offset, Err: err})
+			offset = next
+			continue
+		}
+		if err != nil {
+			return corruptions, fmt.Errorf("file %d offset %d: %w", w.FileId, offset, err)
+		}
+		pos := &Pos{
+			FileId:   w.FileId,
+			Offset:   offset,
+			Length:   length,
+			ExpireAt: r.ExpireAt,
+			Seq:      r.Seq,
+		}
+		offset += length
+		w.MaxSeq = max(w.MaxSeq, r.Seq)
+
+		switch {
+		case r.Seq == 0:
+			if err := fn(r, pos); err != nil {
+				return corruptions, err
+			}
+		case r.Type == RecordBatchFin:
+			for _, p := range batches[r.Seq] {
+				if err := fn(p.record, p.pos); err != nil {
+					return corruptions, err
+				}
+			}
+			delete(batches, r.Seq)
+		default:
+			batches[r.Seq] = append(batches[r.Seq], pending{r, pos})
+		}
+	}
+	return corruptions, nil
+}
+
+// 从 offset 开始寻找下一条完整的记录 找不到时返回文件末尾
+func (w *Wal) resync(offset int) (int, error) {
+	if offset >= w.Offset {
+		return w.Offset, nil
+	}
+	buf := make([]byte, w.Offset-offset)
+	if _, err := w.wal.ReadAt(buf, int64(offset)); err != nil && err != io.EOF {
+		return 0, err
+	}
+	for i := range buf {
+		if _, _, err := decodeRecordPrefix(buf[i:], &w.format); err == nil {
+			return offset + i, nil
+		}
+	}
+	return w.Offset, nil
+}
+
+// Truncate 丢弃 size 之后的内容 用于截断末尾不完整的记录
+func (w *Wal) Truncate(size int) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	if err := w.wal.Truncate(int64(size)); err != nil {
+		return err
+	}
+	w.Offset = size
+	w.flushed.Store(int64(size))
+	return w.wal.Sync()
+}
@@ -2,50 +2,210 @@ package wal
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"path"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/xia-Sang/bitcask/memtable"
 )
 
 const (
-	BufferSize  = 4 + 2*binary.MaxVarintLen64
-	WalFileName = ".wal"
+	BufferSize      = 6 + 4*binary.MaxVarintLen64 + binary.MaxVarintLen32 //记录头部的最大长度
+	WalFileName     = ".wal"
+	WriteBufferSize = 64 << 10 //写缓冲区 超过之后写入文件
 )
 
+var (
+	ErrClosed = errors.New("wal is closed") //文件已经关闭
+	// ErrCorruptRecord 记录不完整或者校验失败
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrLegacyFormat 旧格式的文件只能读取 不能继续追加
+	ErrLegacyFormat = errors.New("can not append to legacy wal file")
+)
+
+var (
+	errTornRecord = fmt.Errorf("%w: %w", ErrCorruptRecord, io.ErrUnexpectedEOF) //记录不完整
+	errChecksum   = fmt.Errorf("%w: crc check err", ErrCorruptRecord)
+)
+
+// BatchFinKey 批次提交记录使用的key
+// 只有 seq 不为 0 的记录才会被当作提交标记
+var BatchFinKey = []byte("bitcask-batch-fin")
+
 // Wal 这个里面是不断地进行追加写操作
 type Wal struct {
 	dirPath string
-	FileId  int //file_id
-	Offset  int //写指针
+	FileId  int    //file_id
+	Offset  int    //写指针
+	MaxSeq  uint64 //出现过的最大批次序号
 	wal     *os.File
+
+	format    fileFormat //文件格式版本和密钥
+	createdAt time.Time  //文件创建时间 旧格式的文件为零值
+	keyring   *Keyring   //索引文件使用的密钥
+
+	mu   sync.RWMutex //保护 data 解除映射时等待正在进行的读取
+	data []byte       //封存文件的只读映射
+
+	wmu     sync.Mutex   //保护写缓冲区 同步时不阻塞追加写
+	buf     []byte       //还没有写入文件的记录
+	flushed atomic.Int64 //已经写入文件的偏移 之前的记录可以直接从文件读取
+	closed  bool
+}
+
+func newWal(dirPath string, fileId int, fp *os.File, kr *Keyring) (*Wal, error) {
+	stat, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	// 重新打开时 写指针需要指向文件末尾
+	w := &Wal{FileId: fileId, wal: fp, dirPath: dirPath, Offset: int(stat.Size()), format: kr.newFormat(), keyring: kr}
+	w.flushed.Store(stat.Size())
+	// 空文件在第一次写入时写入文件头
+	if stat.Size() > 0 {
+		h, err := readFileHeader(fp)
+		if err == nil {
+			w.format, err = kr.format(h, GetWalPath(fileId))
+		}
+		if err == nil {
+			err = checkLegacy(fp, &w.format, w.Offset)
+		}
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		w.createdAt = h.createdAt
+	}
+	return w, nil
+}
+
+// Version 文件格式版本 0 表示没有文件头的旧格式
+func (w *Wal) Version() uint32 {
+	return w.format.version
+}
+
+// KeyId 文件使用的密钥编号 0 表示没有加密
+func (w *Wal) KeyId() uint32 {
+	return w.format.keyId
+}
+
+// CreatedAt 文件创建时间 旧格式的文件返回零值
+func (w *Wal) CreatedAt() time.Time {
+	return w.createdAt
 }
+
 type Pos struct {
-	FileId int
-	Offset int
-	Length int
+	FileId   int
+	Offset   int
+	Length   int
+	ExpireAt int64  //过期时间 0表示不过期
+	Seq      uint64 //写入时的序号 用于事务的冲突检测 由调用方设置 写入索引文件 扫描数据文件时只能恢复批次的序号
+}
+
+// Record 日志中的一条记录
+// Seq 为 0 表示普通写入 否则属于对应的批次
+// Type 为 0 时按照 value 是否为空推断写入还是删除
+// Codec 写入时指定 value 的压缩算法 读取时为 value 实际使用的算法 Value 总是解压之后的数据
+type Record struct {
+	Type     RecordType
+	Codec    Codec
+	Key      []byte
+	Value    []byte
+	Seq      uint64
+	ExpireAt int64  //过期时间 unix纳秒 0表示不过期
+	Bucket   uint32 //所属的 bucket 0表示默认的 bucket
+}
+
+// Expired 判断是否已经过期
+func (p *Pos) Expired(now int64) bool {
+	return p.ExpireAt != 0 && p.ExpireAt <= now
+}
+
+// PosCodec 位置信息的编码 用于磁盘索引
+// 格式为 fileId+offset+length+expireAt+seq 旧的编码没有 seq
+type PosCodec struct{}
+
+func (PosCodec) Encode(value interface{}) []byte {
+	p, ok := value.(*Pos)
+	if !ok || p == nil {
+		return nil
+	}
+	buf := make([]byte, 0, 5*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, uint64(p.FileId))
+	buf = binary.AppendUvarint(buf, uint64(p.Offset))
+	buf = binary.AppendUvarint(buf, uint64(p.Length))
+	buf = binary.AppendVarint(buf, p.ExpireAt)
+	return binary.AppendUvarint(buf, p.Seq)
+}
+func (PosCodec) Decode(buf []byte) interface{} {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil
+		}
+		fields[i] = v
+		buf = buf[n:]
+	}
+	expireAt, n := binary.Varint(buf)
+	if n <= 0 {
+		return nil
+	}
+	p := &Pos{FileId: int(fields[0]), Offset: int(fields[1]), Length: int(fields[2]), ExpireAt: expireAt}
+	if buf = buf[n:]; len(buf) > 0 {
+		if p.Seq, n = binary.Uvarint(buf); n <= 0 {
+			return nil
+		}
+	}
+	return p
 }
 
 func (w *Wal) CloseAndDelete() error {
-	if err := w.wal.Close(); err != nil {
+	if err := w.Close(); err != nil {
 		return err
 	}
-	return os.Remove(path.Join(w.dirPath, GetWalPath(w.FileId)))
+	if err := os.Remove(path.Join(w.dirPath, GetWalPath(w.FileId))); err != nil {
+		return err
+	}
+	return RemoveHintFile(w.dirPath, w.FileId)
 }
 func GetWalPath(fileId int) string {
 	return fmt.Sprintf("%08d%s", fileId, WalFileName)
 }
 func NewWal(dirPath string, fileId int) (*Wal, error) {
+	return NewEncryptedWal(dirPath, fileId, nil)
+}
+
+// NewEncryptedWal 打开数据文件 新文件使用 kr 的当前密钥加密
+// 已有的文件按照文件头中的密钥编号解密 kr 中没有对应的密钥时返回 ErrWrongKey
+func NewEncryptedWal(dirPath string, fileId int, kr *Keyring) (*Wal, error) {
 	filePath := GetWalPath(fileId)
 	fp, err := os.OpenFile(path.Join(dirPath, filePath), os.O_CREATE|os.O_APPEND|os.O_RDWR, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
-	return &Wal{FileId: fileId, wal: fp, dirPath: dirPath}, nil
+	return newWal(dirPath, fileId, fp, kr)
+}
+
+// OpenReadOnlyWal 以只读方式打开已有的数据文件 文件不存在时返回错误
+// 写入会失败 只用于只读模式
+func OpenReadOnlyWal(dirPath string, fileId int, kr *Keyring) (*Wal, error) {
+	fp, err := os.Open(path.Join(dirPath, GetWalPath(fileId)))
+	if err != nil {
+		return nil, err
+	}
+	return newWal(dirPath, fileId, fp, kr)
 }
+
 func TestWal() (*Wal, error) {
 	dirPath := "./test"
 	fileId := 1
@@ -59,34 +219,120 @@ func TestWal() (*Wal, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Wal{FileId: fileId, wal: fp, dirPath: dirPath}, nil
+	return newWal(dirPath, fileId, fp, nil)
 }
 
 func (w *Wal) Write(key, value []byte) (*Pos, error) {
-	length, err := write(w.wal, key, value)
+	return w.WriteRecord(&Record{Key: key, Value: value})
+}
+
+// WriteRecord 写入一条记录 批次记录需要携带 seq
+// 记录先写入缓冲区 缓冲区满了或者调用 Flush Sync 时才写入文件
+func (w *Wal) WriteRecord(r *Record) (*Pos, error) {
+	if r.Type == 0 {
+		r.Type = inferType(r)
+	}
+	w.wmu.Lock()
+	if w.closed {
+		w.wmu.Unlock()
+		return nil, ErrClosed
+	}
+	if w.format.version != FormatVersion {
+		w.wmu.Unlock()
+		return nil, ErrLegacyFormat
+	}
+	if w.Offset == 0 {
+		w.createdAt = time.Now()
+		w.buf = appendFileHeader(w.buf, w.createdAt, w.format.keyId)
+		w.Offset = FileHeaderSize
+	}
+	n := len(w.buf)
+	w.buf = appendRecord(w.buf, r, &w.format)
+	length := len(w.buf) - n
+	var err error
+	if len(w.buf) >= WriteBufferSize {
+		start := w.flushed.Load() + int64(n)
+		if err = w.flushLocked(); err != nil {
+			err = errors.Join(err, w.discardLocked(start, length))
+		}
+	}
+	w.wmu.Unlock()
 	if err != nil {
 		return nil, err
 	}
 	pos := &Pos{
-		FileId: w.FileId,
-		Offset: w.Offset,
-		Length: length,
+		FileId:   w.FileId,
+		Offset:   w.Offset,
+		Length:   length,
+		ExpireAt: r.ExpireAt,
 	}
 	// 更新offset
 	w.Offset += length
+	w.MaxSeq = max(w.MaxSeq, r.Seq)
 	return pos, nil
 }
+
+// Flush 将缓冲区中的记录写入文件 不保证落盘
+func (w *Wal) Flush() error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.flushLocked()
+}
+func (w *Wal) flushLocked() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.wal.Write(w.buf)
+	w.flushed.Add(int64(n))
+	// 写入一部分失败时 剩下的部分保留在缓冲区中
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	return err
+}
+
+// 写入失败时丢弃最后一条记录 之前的记录仍然保留在缓冲区中
+// 记录已经有一部分写入文件时 将文件截断到记录开始的位置
+func (w *Wal) discardLocked(start int64, length int) error {
+	if len(w.buf) >= length {
+		w.buf = w.buf[:len(w.buf)-length]
+		return nil
+	}
+	w.buf = w.buf[:0]
+	if err := w.wal.Truncate(start); err != nil {
+		return err
+	}
+	w.flushed.Store(start)
+	return nil
+}
+
+// Sync 写入缓冲区并落盘 落盘期间可以继续追加写
 func (w *Wal) Sync() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
 	return w.wal.Sync()
 }
+
+// Close 写入缓冲区之后关闭文件
 func (w *Wal) Close() error {
-	return w.wal.Close()
+	if err := w.Munmap(); err != nil {
+		return err
+	}
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return errors.Join(w.flushLocked(), w.wal.Close())
 }
 func (w *Wal) WriteAt(offset int, key, value []byte) (int, error) {
-	return writeAt(w.wal, offset, key, value)
+	return writeAt(w.wal, offset, &Record{Key: key, Value: value})
 }
-func writeAt(w io.WriterAt, offset int, key, value []byte) (int, error) {
-	buf := buff(key, value)
+func writeAt(w io.WriterAt, offset int, r *Record) (int, error) {
+	buf := buff(r, &fileFormat{version: FormatVersion})
 	// 写入缓冲区到写入器
 	if _, err := w.WriteAt(buf, int64(offset)); err != nil {
 		return 0, err
@@ -95,181 +341,341 @@ func writeAt(w io.WriterAt, offset int, key, value []byte) (int, error) {
 	return len(buf), nil
 }
 
-// 顺序写入
-func write(w io.Writer, key, value []byte) (int, error) {
-	buf := buff(key, value)
-	// 写入缓冲区到写入器
-	if _, err := w.Write(buf); err != nil {
-		return 0, err
-	}
-
-	return len(buf), nil
+// 编码格式 crc+type+codec+keySize+valueSize+seq+expireAt+key+value
+// valueSize 是压缩之后的长度 加密的文件中 key+value 替换为 nonce+密文+认证标签
+func buff(r *Record, f *fileFormat) []byte {
+	return appendRecord(nil, r, f)
 }
-func buff(key, value []byte) []byte {
-	keySize := len(key)
+
+// 将编码之后的记录追加到 dst 之后
+// 压缩之后没有变小的 value 按照原样存储 先压缩再加密
+func appendRecord(dst []byte, r *Record, f *fileFormat) []byte {
+	typ := r.Type
+	if typ == 0 {
+		typ = inferType(r)
+	}
+	codec, value := CodecNone, r.Value
+	if r.Codec != CodecNone && typ == RecordPut {
+		if enc := r.Codec.encode(nil, r.Value); len(enc) < len(r.Value) {
+			codec, value = r.Codec, enc
+		}
+	}
+	keySize := len(r.Key)
 	valueSize := len(value)
-	totalSize := BufferSize + keySize + valueSize
+	totalSize := BufferSize + keySize + valueSize + f.overhead()
 
-	buf := make([]byte, totalSize)
+	start := len(dst)
+	dst = slices.Grow(dst, totalSize)
+	buf := dst[start : start+totalSize]
 	index := crc32.Size
 
+	// 存储记录类型和压缩算法
+	buf[index] = byte(typ)
+	buf[index+1] = byte(codec)
+	index += 2
+
 	// 存储键值对大小
 	index += binary.PutVarint(buf[index:], int64(keySize))
 	index += binary.PutVarint(buf[index:], int64(valueSize))
+	// 存储批次序号和过期时间
+	index += binary.PutUvarint(buf[index:], r.Seq)
+	index += binary.PutVarint(buf[index:], r.ExpireAt)
+	index += binary.PutUvarint(buf[index:], uint64(r.Bucket))
 
 	// 存储键和值
-	copy(buf[index:], key)
-	index += keySize
-	copy(buf[index:], value)
-	index += valueSize
+	if f.aead != nil {
+		headerEnd := index
+		index += nonceSize
+		copy(buf[index:], r.Key)
+		copy(buf[index+keySize:], value)
+		sealed := f.seal(buf[headerEnd:index+keySize+valueSize], buf[crc32.Size:headerEnd])
+		index = headerEnd + len(sealed)
+	} else {
+		copy(buf[index:], r.Key)
+		index += keySize
+		copy(buf[index:], value)
+		index += valueSize
+	}
 	// 计算并存储 CRC 校验码
 	crc := crc32.ChecksumIEEE(buf[crc32.Size:index])
 
 	binary.BigEndian.PutUint32(buf[:crc32.Size], crc)
-	return buf[:index]
+	return dst[:start+index]
 }
+
+// Read 回放日志到内存表中
+// 批次中的记录只有读到对应的提交记录之后才会生效 未提交的批次直接丢弃
 func (w *Wal) Read(table memtable.MemTable) error {
-	offset := 0
-	for {
-		key, value, length, err := w.ReadAt(offset)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
-		}
-		if value != nil {
-			table.Put(key, &Pos{
-				FileId: w.FileId,
-				Offset: offset,
-				Length: length,
-			})
-		} else {
-			table.Delete(key)
-		}
-		offset += length
+	return w.ReadFrom(table, 0)
+}
+
+// ReadFrom 从指定的位置开始回放到内存表
+func (w *Wal) ReadFrom(table memtable.MemTable, offset int) error {
+	return w.FoldFrom(offset, func(r *Record, pos *Pos) error {
+		ApplyRecord(table, r, pos)
+		return nil
+	})
+}
+
+// ApplyRecord 将一条已经提交的记录应用到内存表
+func ApplyRecord(table memtable.MemTable, r *Record, pos *Pos) {
+	if r.Type == RecordDelete {
+		table.Delete(r.Key)
+	} else {
+		table.Put(r.Key, pos)
 	}
-	return nil
 }
 
-// 读取时候我们只需要给出readat 和 offset即可
-// 并不需要长度信息的
-func readData(r io.ReaderAt, offset int) ([]byte, []byte, int, error) {
-	// var headerSize = BufferSize
-	// if size < BufferSize+Offset {
-	// 	headerSize = size - Offset //最后的剩余容量 go语言的特性是 完全不需要这样来实现的
-	// }
-	buf := make([]byte, BufferSize)
-	cnt, err := r.ReadAt(buf, int64(offset))
-	if err != nil {
-		return nil, nil, 0, err
+// Fold 按顺序遍历已经提交的记录
+func (w *Wal) Fold(fn func(r *Record, pos *Pos) error) error {
+	return w.FoldFrom(0, fn)
+}
+
+// FoldFrom 从指定的位置开始遍历 位置必须是一条记录的起点
+// 遇到损坏的记录时返回错误
+func (w *Wal) FoldFrom(offset int, fn func(r *Record, pos *Pos) error) error {
+	_, err := w.Scan(offset, ScanStrict, fn)
+	return err
+}
+
+// 记录的头部信息
+type header struct {
+	crc       uint32
+	typ       RecordType
+	codec     Codec
+	keySize   int64
+	valueSize int64
+	seq       uint64
+	expireAt  int64
+	bucket    uint32
+	size      int //头部长度
+}
+
+// 解析头部信息 旧格式的记录只有 crc 和键值的大小
+func decodeHeader(buf []byte, f *fileFormat) (*header, error) {
+	legacy := f.version == legacyVersion
+	if len(buf) < crc32.Size {
+		return nil, errTornRecord
 	}
-	if cnt == 0 {
-		return nil, nil, 0, io.EOF
+	h := &header{size: crc32.Size}
+	// 读取 CRC 校验码
+	h.crc = binary.BigEndian.Uint32(buf[:h.size])
+	// 读取记录类型和压缩算法
+	if !legacy {
+		if len(buf) <= h.size+1 {
+			return nil, errTornRecord
+		}
+		h.typ = RecordType(buf[h.size])
+		if !h.typ.valid() {
+			return nil, fmt.Errorf("%w: invalid record type %d", ErrCorruptRecord, h.typ)
+		}
+		h.size++
+		h.codec = Codec(buf[h.size])
+		if !h.codec.Valid() || (h.codec != CodecNone && h.typ != RecordPut) {
+			return nil, fmt.Errorf("%w: invalid codec %d", ErrCorruptRecord, h.codec)
+		}
+		h.size++
 	}
-	index := crc32.Size
-	// 读取并忽略 CRC 校验码
-	expectCrc32 := binary.BigEndian.Uint32(buf[:index])
 	// 解码键的大小
-	keySize, n := binary.Varint(buf[index:])
+	keySize, n := binary.Varint(buf[h.size:])
 	if n <= 0 {
-		return nil, nil, 0, fmt.Errorf("failed to decode key size")
-	}
-	index += n
-	// 确保读取的字节数足够处理 keySize
-	if index >= len(buf) {
-		return nil, nil, 0, fmt.Errorf("buffer too small to contain key size")
+		return nil, fmt.Errorf("%w: failed to decode key size", ErrCorruptRecord)
 	}
+	h.keySize = keySize
+	h.size += n
 	// 解码值的大小
-	valueSize, n := binary.Varint(buf[index:])
+	valueSize, n := binary.Varint(buf[h.size:])
 	if n <= 0 {
-		return nil, nil, 0, fmt.Errorf("failed to decode value size")
+		return nil, fmt.Errorf("%w: failed to decode value size", ErrCorruptRecord)
 	}
-	index += n
+	h.valueSize = valueSize
+	h.size += n
+	// 解码批次序号 过期时间和 bucket 编号 旧格式的记录没有这些字段
+	if !legacy {
+		seq, n := binary.Uvarint(buf[h.size:])
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: failed to decode seq", ErrCorruptRecord)
+		}
+		h.seq = seq
+		h.size += n
+		expireAt, n := binary.Varint(buf[h.size:])
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: failed to decode expire time", ErrCorruptRecord)
+		}
+		h.expireAt = expireAt
+		h.size += n
+		bucket, n := binary.Uvarint(buf[h.size:])
+		if n <= 0 || bucket > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: failed to decode bucket", ErrCorruptRecord)
+		}
+		h.bucket = uint32(bucket)
+		h.size += n
+	}
+	if h.keySize < 0 || h.valueSize < 0 {
+		return nil, fmt.Errorf("%w: invalid kv size", ErrCorruptRecord)
+	}
+	return h, nil
+}
 
-	kvSize := int(keySize + valueSize)
+// 读取时候我们只需要给出readat 和 offset即可
+// 并不需要长度信息的 limit 是文件的大小 记录不能超出文件末尾
+func readData(r io.ReaderAt, offset int, f *fileFormat, limit int) (*Record, int, error) {
+	if offset >= limit {
+		return nil, 0, io.EOF
+	}
+	buf := make([]byte, min(BufferSize, limit-offset))
+	cnt, err := r.ReadAt(buf, int64(offset))
+	// 文件末尾的记录可能不足 BufferSize
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if cnt == 0 {
+		return nil, 0, io.EOF
+	}
+	h, err := decodeHeader(buf[:cnt], f)
+	if err != nil {
+		return nil, 0, err
+	}
+	// 长度字段损坏时不能按照它分配内存
+	if h.keySize > int64(limit) || h.valueSize > int64(limit) || offset+h.size+h.payloadSize(f) > limit {
+		return nil, 0, errTornRecord
+	}
 
-	kvBuf := make([]byte, kvSize)
+	payload := make([]byte, h.payloadSize(f))
 
 	// 读取键值对数据 并进行错误处理
-	cnt, err = r.ReadAt(kvBuf, int64(index+offset))
-	if err != nil {
-		return nil, nil, 0, err
-	}
-	if cnt == 0 {
-		return nil, nil, 0, io.EOF
+	if _, err = r.ReadAt(payload, int64(h.size+offset)); err != nil {
+		if err == io.EOF {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, err
 	}
-	// 读取key和value
-	key, value := kvBuf[:keySize], kvBuf[keySize:]
-	buf = buf[:index]
-	buf = append(buf, key...)
-	buf = append(buf, value...)
 	// 校验crc32
-	realCrc32 := crc32.ChecksumIEEE(buf[crc32.Size:])
-	if realCrc32 != expectCrc32 {
-		return nil, nil, 0, fmt.Errorf("crc check err")
+	buf = append(buf[:h.size], payload...)
+	if crc32.ChecksumIEEE(buf[crc32.Size:]) != h.crc {
+		return nil, 0, errChecksum
 	}
-	return kvBuf[:keySize], kvBuf[keySize:], index + kvSize, nil
+	record, err := newRecord(buf[crc32.Size:h.size], payload, h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return record, h.size + len(payload), nil
 }
 
 // 直接是定长读取
-func readDataWithLength(r io.ReaderAt, offset int, length int) ([]byte, []byte, error) {
+func readDataWithLength(r io.ReaderAt, offset int, length int, f *fileFormat) (*Record, error) {
 	buf := make([]byte, length)
 	cnt, err := r.ReadAt(buf, int64(offset))
 	if err != nil {
-		return nil, nil, err
+		if err == io.EOF {
+			return nil, errTornRecord
+		}
+		return nil, err
 	}
 	if cnt == 0 {
-		return nil, nil, io.EOF
+		return nil, io.EOF
 	}
-	index := crc32.Size
-	// 读取并忽略 CRC 校验码
-	expectCrc32 := binary.BigEndian.Uint32(buf[:index])
-	// 解码键的大小
-	keySize, n := binary.Varint(buf[index:])
-	if n <= 0 {
-		return nil, nil, fmt.Errorf("failed to decode key size")
-	}
-	index += n
-	// 确保读取的字节数足够处理 keySize
-	if index >= len(buf) {
-		return nil, nil, fmt.Errorf("buffer too small to contain key size")
+	return decodeRecord(buf, f)
+}
+
+// 解析一条完整的记录 buf 的长度就是记录的长度
+func decodeRecord(buf []byte, f *fileFormat) (*Record, error) {
+	r, n, err := decodeRecordPrefix(buf, f)
+	if err != nil {
+		return nil, err
 	}
-	// 解码值的大小
-	valueSize, n := binary.Varint(buf[index:])
-	if n <= 0 {
-		return nil, nil, fmt.Errorf("failed to decode value size")
+	if n != len(buf) {
+		return nil, fmt.Errorf("%w: record length mismatch", ErrCorruptRecord)
 	}
-	index += n
+	return r, nil
+}
 
-	//fmt.Println("index", index, keySize, valueSize, length)
-	// 读取key和value
-	key, value := buf[index:index+int(keySize)], buf[index+int(keySize):index+int(keySize+valueSize)]
-	buf = buf[:index]
-	buf = append(buf, key...)
-	buf = append(buf, value...)
+// 解析 buf 开头的一条记录 返回记录的长度
+func decodeRecordPrefix(buf []byte, f *fileFormat) (*Record, int, error) {
+	h, err := decodeHeader(buf, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	if h.keySize > int64(len(buf)) || h.valueSize > int64(len(buf)) || h.size+h.payloadSize(f) > len(buf) {
+		return nil, 0, errTornRecord
+	}
+	n := h.size + h.payloadSize(f)
 	// 校验crc32
-	realCrc32 := crc32.ChecksumIEEE(buf[crc32.Size:])
-	if realCrc32 != expectCrc32 {
-		return nil, nil, fmt.Errorf("crc check err")
+	if crc32.ChecksumIEEE(buf[crc32.Size:n]) != h.crc {
+		return nil, 0, errChecksum
 	}
-	return key, value, nil
+	record, err := newRecord(buf[crc32.Size:h.size], buf[h.size:n], h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return record, n, nil
 }
 
-func (w *Wal) Size() int64 {
-	stat, err := w.wal.Stat()
+// 头部之后的数据长度 加密的文件需要加上随机数和认证标签
+func (h *header) payloadSize(f *fileFormat) int {
+	return int(h.keySize+h.valueSize) + f.overhead()
+}
+
+// 只有写入记录才有 value 长度为 0 的写入返回空的切片而不是 nil
+// 旧格式的记录没有类型 value 长度为 0 时表示删除
+// 加密的记录解密到新分配的内存中 压缩过的 value 同样解压到新分配的内存中
+func newRecord(hdr, payload []byte, h *header, f *fileFormat) (*Record, error) {
+	kvBuf := payload
+	if f.aead != nil {
+		var err error
+		if kvBuf, err = f.open(payload, hdr); err != nil {
+			return nil, err
+		}
+	}
+	r := &Record{Type: h.typ, Codec: h.codec, Key: kvBuf[:h.keySize], Seq: h.seq, ExpireAt: h.expireAt, Bucket: h.bucket}
+	if r.Type == 0 {
+		r.Value = kvBuf[h.keySize : h.keySize+h.valueSize]
+		r.Type = inferType(r)
+	}
+	if r.Type != RecordPut {
+		r.Value = nil
+		return r, nil
+	}
+	value, err := r.Codec.decode(kvBuf[h.keySize : h.keySize+h.valueSize])
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return stat.Size()
+	r.Value = value
+	return r, nil
+}
+
+// Size 文件的逻辑大小 包含缓冲区中的记录
+func (w *Wal) Size() int64 {
+	return int64(w.Offset)
+}
+
+// 读取的范围还在缓冲区中时 先写入文件
+func (w *Wal) flushTo(end int) error {
+	if int64(end) <= w.flushed.Load() {
+		return nil
+	}
+	return w.Flush()
 }
 
 // ReadAt 直接读取即可
-func (w *Wal) ReadAt(off int) ([]byte, []byte, int, error) {
-	return readData(w.wal, off)
+func (w *Wal) ReadAt(off int) (*Record, int, error) {
+	if err := w.flushTo(off + 1); err != nil {
+		return nil, 0, err
+	}
+	return readData(w.wal, off, &w.format, w.Offset)
 }
 
-// ReadBuf 按照指定长度读取
+// ReadBuf 按照指定长度读取 文件已经映射时直接从映射中读取
 func (w *Wal) ReadBuf(off, length int) ([]byte, []byte, error) {
-	return readDataWithLength(w.wal, off, length)
+	if key, value, ok, err := w.readMapped(off, length); ok {
+		return key, value, err
+	}
+	if err := w.flushTo(off + length); err != nil {
+		return nil, nil, err
+	}
+	r, err := readDataWithLength(w.wal, off, length, &w.format)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Key, r.Value, nil
 }
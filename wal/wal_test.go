@@ -1,7 +1,12 @@
 package wal
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/xia-Sang/bitcask/memtable"
@@ -43,3 +48,324 @@ func TestWalReader(t *testing.T) {
 	}
 
 }
+
+// 索引文件写入和读取
+func TestHintFile(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if _, err := w.Write(utils.GenerateKey(i), utils.GenerateRandomBytes(12)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := w.Write(utils.GenerateKey(3), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHint(); err != nil {
+		t.Fatal(err)
+	}
+
+	fromHint, fromWal := memtable.NewBTreeMemTable(), memtable.NewBTreeMemTable()
+	ok, err := ReadHintFile(dir, 1, nil, func(h *Hint) {
+		ApplyHint(fromHint, h)
+	})
+	if !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if err := w.Read(fromWal); err != nil {
+		t.Fatal(err)
+	}
+	i1, i2 := fromHint.Iterator(), fromWal.Iterator()
+	for ; i1.Valid() && i2.Valid(); i1.Next() {
+		k1, p1 := i1.Curr()
+		k2, p2 := i2.Curr()
+		if string(k1) != string(k2) || *p1.(*Pos) != *p2.(*Pos) {
+			t.Fatalf("%s:%v != %s:%v", k1, p1, k2, p2)
+		}
+		i2.Next()
+	}
+	if i1.Valid() || i2.Valid() {
+		t.Fatal("hint and wal mismatch")
+	}
+	if _, ok := fromHint.Get(utils.GenerateKey(3)); ok {
+		t.Fatal("tombstone not applied")
+	}
+}
+
+// 文件头和记录类型
+func TestFileFormat(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []*Record{
+		{Type: RecordPut, Key: []byte("a"), Value: []byte("1")},
+		{Type: RecordPut, Key: []byte("empty"), Value: []byte{}},
+		{Type: RecordDelete, Key: []byte("a")},
+		{Type: RecordPut, Key: []byte("b"), Value: []byte("2"), Seq: 1},
+		{Type: RecordBatchFin, Key: BatchFinKey, Seq: 1},
+	}
+	for _, r := range records {
+		if _, err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Version() != FormatVersion || w.CreatedAt().IsZero() {
+		t.Fatalf("version %d created at %v", w.Version(), w.CreatedAt())
+	}
+	var got []*Record
+	if err := w.Fold(func(r *Record, pos *Pos) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d records", len(got))
+	}
+	for i, r := range got {
+		if r.Type != records[i].Type || !bytes.Equal(r.Key, records[i].Key) || !bytes.Equal(r.Value, records[i].Value) {
+			t.Fatalf("%d: %+v", i, r)
+		}
+	}
+	// 空的 value 和删除可以区分
+	if got[1].Value == nil || got[2].Value != nil {
+		t.Fatalf("empty value %v delete %v", got[1].Value, got[2].Value)
+	}
+
+	// 文件头损坏
+	w2, err := NewWal(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w2.Write([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	w2.Close()
+	corrupt := func(fileId int, b []byte, off int64) {
+		fp, err := os.OpenFile(path.Join(dir, GetWalPath(fileId)), os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		if _, err := fp.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(2, []byte{0xff}, 14)
+	if _, err := NewWal(dir, 2); !errors.Is(err, ErrBadFileHeader) {
+		t.Fatal(err)
+	}
+	// 版本号超过当前版本
+	corrupt(1, []byte{0, 0, 0, FormatVersion + 1}, 8)
+	if _, err := NewWal(dir, 1); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatal(err)
+	}
+}
+
+// 旧格式的文件通过兼容的解码器读取 但不能继续追加
+func TestLegacyFormat(t *testing.T) {
+	for name, version := range map[string]uint32{"v0": legacyVersion} {
+		t.Run(name, func(t *testing.T) {
+			testOldFormat(t, path.Join("../testdata", name), version)
+		})
+	}
+}
+func testOldFormat(t *testing.T, src string, version uint32) {
+	dir := t.TempDir()
+	// 最初的格式没有索引文件
+	for _, name := range []string{GetWalPath(1), GetHintPath(1)} {
+		buf, err := os.ReadFile(path.Join(src, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, name), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Version() != version {
+		t.Fatalf("version %d", w.Version())
+	}
+	fromWal, fromHint := memtable.NewBTreeMemTable(), memtable.NewBTreeMemTable()
+	if err := w.Read(fromWal); err != nil {
+		t.Fatal(err)
+	}
+	hasHint, err := ReadHintFile(dir, 1, nil, func(h *Hint) {
+		ApplyHint(fromHint, h)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for iter := fromWal.Iterator(); iter.Valid(); iter.Next() {
+		key, pos := iter.Curr()
+		if p, ok := fromHint.Get(key); hasHint && (!ok || *p.(*Pos) != *pos.(*Pos)) {
+			t.Fatalf("%s: %v %v", key, pos, p)
+		}
+		_, value, err := w.ReadBuf(pos.(*Pos).Offset, pos.(*Pos).Length)
+		if err != nil || !bytes.HasPrefix(value, []byte("value-")) {
+			t.Fatalf("%s: %s %v", key, value, err)
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatal("no records")
+	}
+	if _, err := w.Write([]byte("k"), []byte("v")); !errors.Is(err, ErrLegacyFormat) {
+		t.Fatal(err)
+	}
+}
+
+// 中间的记录损坏 末尾的记录不完整
+func TestScanModes(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pos []*Pos
+	for i := range 5 {
+		p, err := w.WriteRecord(&Record{Type: RecordPut, Key: []byte(fmt.Sprint(i)), Value: []byte("value")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos = append(pos, p)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.OpenFile(path.Join(dir, GetWalPath(1)), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte{0xff}, int64(pos[1].Offset+pos[1].Length-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fp.Truncate(int64(pos[4].Offset + 3)); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	w, err = NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// 截断模式只处理末尾没有写完的记录 损坏之后还有完整的记录时返回错误
+	tests := []struct {
+		mode        ScanMode
+		offset      int
+		keys        string
+		failed      bool
+		corruptions []Corruption
+	}{
+		{ScanStrict, 0, "0", true, nil},
+		{ScanTruncate, 0, "0", true, nil},
+		{ScanTruncate, pos[2].Offset, "23", false, []Corruption{{FileId: 1, Offset: pos[4].Offset, Length: 3}}},
+		{ScanSkip, 0, "023", false, []Corruption{
+			{FileId: 1, Offset: pos[1].Offset, Length: pos[1].Length},
+			{FileId: 1, Offset: pos[4].Offset, Length: 3},
+		}},
+	}
+	for _, tt := range tests {
+		var keys string
+		corruptions, err := w.Scan(tt.offset, tt.mode, func(r *Record, pos *Pos) error {
+			keys += string(r.Key)
+			return nil
+		})
+		if tt.failed != errors.Is(err, ErrCorruptRecord) {
+			t.Fatalf("mode %d: %v", tt.mode, err)
+		}
+		if keys != tt.keys || len(corruptions) != len(tt.corruptions) {
+			t.Fatalf("mode %d: keys %q corruptions %v", tt.mode, keys, corruptions)
+		}
+		for i, c := range corruptions {
+			want := tt.corruptions[i]
+			if c.FileId != want.FileId || c.Offset != want.Offset || c.Length != want.Length || !errors.Is(c.Err, ErrCorruptRecord) {
+				t.Fatalf("mode %d: %v want %v", tt.mode, c, want)
+			}
+		}
+	}
+}
+
+// 旧的编码没有 seq 解码为0
+func TestPosCodec(t *testing.T) {
+	var codec PosCodec
+	p := &Pos{FileId: 3, Offset: 100, Length: 20, ExpireAt: -1, Seq: 42}
+	buf := codec.Encode(p)
+	if got := codec.Decode(buf).(*Pos); *got != *p {
+		t.Fatalf("%+v", got)
+	}
+	old := binary.AppendVarint(binary.AppendUvarint(binary.AppendUvarint(binary.AppendUvarint(nil, 3), 100), 20), -1)
+	if got := codec.Decode(old).(*Pos); got.Seq != 0 || got.Offset != 100 || got.ExpireAt != -1 {
+		t.Fatalf("%+v", got)
+	}
+	if codec.Decode(append(old, 0x80)) != nil {
+		t.Fatal("truncated seq decoded")
+	}
+}
+
+// 写入文件失败时记录不会留在缓冲区中 之后的写入不受影响
+func TestWriteRecordFailure(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWal(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	first, err := w.WriteRecord(&Record{Key: []byte("a"), Value: []byte("1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只读打开的文件写入失败
+	fp := w.wal
+	if w.wal, err = os.Open(path.Join(dir, GetWalPath(1))); err != nil {
+		t.Fatal(err)
+	}
+	buffered, offset := len(w.buf), w.Offset
+	big := make([]byte, WriteBufferSize)
+	if _, err := w.WriteRecord(&Record{Key: []byte("b"), Value: big}); err == nil {
+		t.Fatal("write to read-only file succeeded")
+	}
+	if len(w.buf) != buffered || w.Offset != offset {
+		t.Fatalf("buffered %d offset %d, want %d %d", len(w.buf), w.Offset, buffered, offset)
+	}
+	w.wal.Close()
+	w.wal = fp
+
+	second, err := w.WriteRecord(&Record{Key: []byte("c"), Value: big})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys string
+	if _, err := w.Scan(0, ScanStrict, func(r *Record, pos *Pos) error {
+		keys += string(r.Key)
+		return nil
+	}); err != nil || keys != "ac" {
+		t.Fatalf("keys %q: %v", keys, err)
+	}
+	if second.Offset != first.Offset+first.Length {
+		t.Fatalf("offset %d after %+v", second.Offset, first)
+	}
+}
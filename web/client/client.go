@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -23,7 +25,7 @@ func printPrompt() {
 }
 func main() {
 	scanner := bufio.NewScanner(os.Stdin)
-	fmt.Print("Enter command (put/get/delete/list/exit):\n")
+	fmt.Print("Enter command (put/get/delete/list/cas/putnx/delif/exit):\n")
 	for {
 		printPrompt()
 		scanner.Scan()
@@ -33,6 +35,8 @@ func main() {
 		case command == "exit":
 			fmt.Println("Exiting...")
 			return
+		case strings.HasPrefix(command, "putnx"):
+			handlePutIfAbsent(strings.TrimPrefix(command, "putnx"))
 		case strings.HasPrefix(command, "put"):
 			handlePut(strings.TrimPrefix(command, "put"))
 		case strings.HasPrefix(command, "get"):
@@ -41,8 +45,12 @@ func main() {
 			handleDelete(strings.TrimPrefix(command, "delete"))
 		case command == "list":
 			handleList()
+		case strings.HasPrefix(command, "cas"):
+			handleCompareAndSwap(strings.TrimPrefix(command, "cas"))
+		case strings.HasPrefix(command, "delif"):
+			handleDeleteIf(strings.TrimPrefix(command, "delif"))
 		default:
-			fmt.Println("Unknown command. Use put, get, delete, list, or exit.")
+			fmt.Println("Unknown command. Use put, get, delete, list, cas, putnx, delif, or exit.")
 		}
 	}
 }
@@ -50,17 +58,21 @@ func main() {
 func handlePut(input string) {
 	// 去除前后空白
 	input = strings.TrimSpace(input)
-	// 分割输入为 key 和 value
-	parts := strings.SplitN(input, " ", 2)
-	if len(parts) != 2 {
-		fmt.Println("Usage: put <key> <value>")
+	// 分割输入为 key 和 value 省略 value 时写入空的 value
+	key, value, _ := strings.Cut(input, " ")
+	if key == "" {
+		fmt.Println("Usage: put <key> [value]")
 		return
 	}
-	key, value := parts[0], parts[1]
 	fmt.Printf("key: %s, value: %s\n", key, value)
 
 	// 创建请求体
-	sendBody := strings.NewReader(fmt.Sprintf(`{"%s": "%s"}`, key, value))
+	data, err := json.Marshal(map[string]string{key: value})
+	if err != nil {
+		fmt.Printf("Error encoding PUT request: %v\n", err)
+		return
+	}
+	sendBody := bytes.NewReader(data)
 
 	// 发起 POST 请求
 	resp, err := http.Post(fmt.Sprintf("%s/put", serverAddr), "application/json", sendBody)
@@ -120,3 +132,52 @@ func handleList() {
 	body, _ := ioutil.ReadAll(resp.Body)
 	fmt.Println("Response:", string(body))
 }
+
+// 条件写入 期望的值为 - 时表示 key 不存在
+func handleCompareAndSwap(input string) {
+	fields := strings.Fields(input)
+	if len(fields) != 3 {
+		fmt.Println("Usage: cas <key> <expected|-> <value>")
+		return
+	}
+	req := map[string]any{"key": fields[0], "value": fields[2]}
+	if fields[1] != "-" {
+		req["expected"] = fields[1]
+	}
+	postCond("cas", req)
+}
+
+func handlePutIfAbsent(input string) {
+	key, value, _ := strings.Cut(strings.TrimSpace(input), " ")
+	if key == "" {
+		fmt.Println("Usage: putnx <key> [value]")
+		return
+	}
+	postCond("putnx", map[string]any{"key": key, "value": value})
+}
+
+func handleDeleteIf(input string) {
+	fields := strings.Fields(input)
+	if len(fields) != 2 {
+		fmt.Println("Usage: delif <key> <expected>")
+		return
+	}
+	postCond("delif", map[string]any{"key": fields[0], "expected": fields[1]})
+}
+
+// 条件不满足时服务端返回 409
+func postCond(path string, req map[string]any) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		fmt.Printf("Error encoding request: %v\n", err)
+		return
+	}
+	resp, err := http.Post(fmt.Sprintf("%s/%s", serverAddr, path), "application/json", bytes.NewReader(data))
+	if err != nil {
+		fmt.Printf("Error making %s request: %v\n", strings.ToUpper(path), err)
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("Response Status: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -14,7 +15,11 @@ var engine *bitcask.Db
 
 func init() {
 	newOptions := bitcask.NewOptions("./server")
-	engine = bitcask.NewDb(newOptions)
+	db, err := bitcask.Open(newOptions)
+	if err != nil {
+		log.Fatalf("failed to open db: %v\n", err)
+	}
+	engine = db
 }
 func main() {
 	parseCommand()
@@ -28,6 +33,9 @@ func parseCommand() {
 	http.HandleFunc("/get", handleGet)
 	http.HandleFunc("/del", handleDelete)
 	http.HandleFunc("/list", handleListKv)
+	http.HandleFunc("/cas", handleCompareAndSwap)
+	http.HandleFunc("/putnx", handlePutIfAbsent)
+	http.HandleFunc("/delif", handleDeleteIf)
 
 	fmt.Printf("Starting server at %s\n", *address)
 
@@ -69,11 +77,16 @@ func handleGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	key := r.URL.Query().Get("key")
-	val, ok := engine.Get([]byte(key))
-	if !ok {
+	val, err := engine.Get([]byte(key))
+	if errors.Is(err, bitcask.ErrKeyNotFound) {
 		http.Error(w, "Key not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("failed to get kv from db: %v\n", err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(string(val))
 }
@@ -96,15 +109,86 @@ func handleListKv(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	listKvs := "["
-	engine.Fold(func(key, value []byte) bool {
+	err := engine.Fold(func(key, value []byte) bool {
 		if listKvs != "[" {
 			listKvs += ", "
 		}
 		listKvs += fmt.Sprintf("(%s:%s)", key, value)
 		return true
 	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("failed to list kv in db: %v\n", err)
+		return
+	}
 	listKvs += "]"
+	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(listKvs)
 }
+
+// 条件写入的请求体 expected 为 null 或者省略时表示 key 不存在
+type condRequest struct {
+	Key      string  `json:"key"`
+	Expected *string `json:"expected"`
+	Value    string  `json:"value"`
+}
+
+func (c *condRequest) expected() []byte {
+	if c.Expected == nil {
+		return nil
+	}
+	return []byte(*c.Expected)
+}
+
+// 解析条件写入的请求 失败时已经写入了错误响应
+func decodeCondRequest(w http.ResponseWriter, r *http.Request) (*condRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	var req condRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// 条件不满足时返回 409
+func writeCondResult(w http.ResponseWriter, err error) {
+	if errors.Is(err, bitcask.ErrConditionFailed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Printf("failed to write kv in db: %v\n", err)
+		return
+	}
+	w.Write([]byte("OK!"))
+}
+
+func handleCompareAndSwap(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCondRequest(w, r)
+	if !ok {
+		return
+	}
+	writeCondResult(w, engine.CompareAndSwap([]byte(req.Key), req.expected(), []byte(req.Value)))
+}
+
+func handlePutIfAbsent(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCondRequest(w, r)
+	if !ok {
+		return
+	}
+	writeCondResult(w, engine.PutIfAbsent([]byte(req.Key), []byte(req.Value)))
+}
+
+func handleDeleteIf(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeCondRequest(w, r)
+	if !ok {
+		return
+	}
+	writeCondResult(w, engine.DeleteIf([]byte(req.Key), req.expected()))
+}